@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const backfillFileName = ".vmrsync-backfill.yml"
+
+// Progress of a backfill run. This is saved after every activation so that an interrupted
+// backfill can resume where it stopped. New activations shift the TripWatch history pages, so
+// progress is kept by activation rather than by page.
+type backfillState struct {
+	From     time.Time `yaml:"from"`
+	To       time.Time `yaml:"to"`
+	Done     []int     `yaml:"done"` // Activations which have been processed
+	Synced   int       `yaml:"synced"`
+	Skipped  int       `yaml:"skipped"`
+	Failed   []int     `yaml:"failed"`
+	Complete bool      `yaml:"complete"`
+}
+
+func (st *backfillState) isDone(id int) bool {
+	for _, done := range st.Done {
+		if done == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Bring across all TripWatch activations created between the -from and -to dates (inclusive).
+func backfillCommand(args []string) error {
+	const DATEFMT = "2006-01-02"
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	from := fs.String("from", "", "First day of activations to sync (YYYY-MM-DD)")
+	to := fs.String("to", "", "Last day of activations to sync (YYYY-MM-DD)")
+	rate := fs.Int("rate", 50, "Maximum TripWatch API calls per minute")
+	restart := fs.Bool("restart", false, "Ignore any saved progress and start again")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "backfill flags")
+	} else if *rate <= 0 {
+		return errors.Errorf("backfill rate must be positive")
+	}
+	// Dates are given in local (AEST) time as that's what the squadron works in.
+	tz := time.FixedZone("UTC+10", 10*60*60)
+	st := backfillState{}
+	if fromTS, err := time.ParseInLocation(DATEFMT, *from, tz); err != nil {
+		return errors.Wrapf(err, "backfill parsing -from date")
+	} else if toTS, err := time.ParseInLocation(DATEFMT, *to, tz); err != nil {
+		return errors.Wrapf(err, "backfill parsing -to date")
+	} else if toTS.Before(fromTS) {
+		return errors.Errorf("backfill -to date is before -from date")
+	} else {
+		st.From = fromTS.UTC()
+		st.To = toTS.Add(24 * time.Hour).UTC()
+	}
+
+	db, closefunc, err := setup()
+	if err != nil {
+		return errors.Wrapf(err, "backfill setup")
+	}
+	defer closefunc()
+
+	saved := backfillState{}
+	if err := readStateFile(backfillFileName, &saved); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "backfill reading saved progress")
+	} else if !*restart && !saved.Complete &&
+		saved.From.Equal(st.From) && saved.To.Equal(st.To) {
+		st = saved
+		log.Printf("Resuming backfill (%d synced, %d skipped, %d failed)",
+			st.Synced, st.Skipped, len(st.Failed))
+	}
+
+	tripwatchCallInterval = time.Minute / time.Duration(*rate)
+	return backfill(context.Background(), &st, func(ctx context.Context, a *linkActivationDB) error {
+		a.historical = true
+		return sendToDB(ctx, db, a)
+	}, func(st backfillState) error {
+		return writeStateFile(backfillFileName, st)
+	})
+}
+
+// Page through the TripWatch history and pass each activation in the backfill range to the
+// sync function. Progress is saved after every activation. A resumed backfill pages through
+// the history from the start again, skipping the activations which are already done.
+func backfill(ctx context.Context, st *backfillState,
+	sync func(context.Context, *linkActivationDB) error,
+	save func(backfillState) error,
+) error {
+	for page := 1; ; page++ {
+		activations, lastPage, err := listActivationPage(ctx, page)
+		if err != nil {
+			return errors.Wrapf(err, "backfill page %d", page)
+		}
+		for _, summary := range activations {
+			if st.isDone(summary.ID) {
+				continue
+			}
+			if created := time.Time(summary.Created); !created.IsZero() &&
+				(created.Before(st.From) || !created.Before(st.To)) {
+				// Outside of the requested range. Avoid fetching the full activation.
+			} else if err := backfillOne(ctx, st, summary.ID, sync); err != nil {
+				return errors.Wrapf(err, "backfill page %d", page)
+			}
+			st.Done = append(st.Done, summary.ID)
+			if err := save(*st); err != nil {
+				return errors.Wrapf(err, "backfill saving progress")
+			}
+		}
+		log.Printf("Backfill page %d/%d done: %d synced, %d skipped, %d failed",
+			page, lastPage, st.Synced, st.Skipped, len(st.Failed))
+		if page >= lastPage || len(activations) == 0 || olderThan(activations, st.From) {
+			break
+		}
+	}
+	st.Complete = true
+	if err := save(*st); err != nil {
+		return errors.Wrapf(err, "backfill saving progress")
+	}
+	if len(st.Failed) > 0 {
+		log.Printf("Backfill failed to sync activations: %v", st.Failed)
+	}
+	return nil
+}
+
+// The TripWatch history is listed newest first, so once a whole page was created before the
+// start of the backfill range there's nothing more to find.
+func olderThan(activations []activationSummary, from time.Time) bool {
+	for _, summary := range activations {
+		if created := time.Time(summary.Created); created.IsZero() || !created.Before(from) {
+			return false
+		}
+	}
+	return len(activations) > 0
+}
+
+// Fetch and sync a single activation. Errors syncing to the DB are recorded in the backfill
+// state rather than stopping the backfill, but TripWatch errors are returned.
+func backfillOne(ctx context.Context, st *backfillState, id int,
+	sync func(context.Context, *linkActivationDB) error,
+) error {
+	// Shouldn't take more than 60s to read and write a single activation
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	if activation, err := getOneActivation(ctx, id); err != nil {
+		return errors.Wrapf(err, "backfill get activation %d", id)
+	} else if created := time.Time(activation.Created); created.Before(st.From) ||
+		!created.Before(st.To) {
+		// Outside of the requested range.
+	} else if strings.ToLower(activation.Job.Status) == "cancelled" {
+		st.Skipped++
+	} else if err := sync(ctx, &activation); err != nil {
+		log.Printf("Backfill %v", runError{
+			error:      errors.Wrapf(err, "DB update for activation %d", id),
+			activation: &activation,
+		})
+		st.Failed = append(st.Failed, id)
+	} else {
+		st.Synced++
+		log.Printf("Backfill synced activation %d", id)
+	}
+	return nil
+}
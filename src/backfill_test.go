@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock the TripWatch history with two pages of activations
+func backfillTestServer(t *testing.T) *httptest.Server {
+	pages := map[string]string{
+		"1": `{"current_page":1,"last_page":2,"data":[` +
+			`{"id":1,"created_at":"2023-01-01T02:00:00.000000Z"},` +
+			`{"id":2,"created_at":"2022-12-01T02:00:00.000000Z"},` +
+			`{"id":3,"created_at":"2023-01-03T02:00:00.000000Z"}]}`,
+		"2": `{"current_page":2,"last_page":2,"data":[` +
+			`{"id":4,"created_at":"2023-01-04T02:00:00.000000Z"},` +
+			`{"id":5,"created_at":"2023-01-05T02:00:00.000000Z"}]}`,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/activations":
+			fmt.Fprint(w, pages[r.URL.Query().Get("page")])
+		case strings.HasPrefix(r.URL.Path, "/activations/"):
+			id := strings.TrimPrefix(r.URL.Path, "/activations/")
+			status := "Completed"
+			if id == "4" {
+				status = "Cancelled"
+			}
+			fmt.Fprintf(w, `{"id":%s,"created_at":"2023-01-0%sT02:00:00.000000Z",`+
+				`"activationsstatus":"%s"}`, id, id, status)
+		case strings.HasPrefix(r.URL.Path, "/activationtransactions/"),
+			strings.HasPrefix(r.URL.Path, "/activationrisks/"):
+			fmt.Fprint(w, "[]")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestBackfill(t *testing.T) {
+	srv := backfillTestServer(t)
+	defer srv.Close()
+	tripwatchURL = srv.URL
+	defer func() { tripwatchURL = "" }()
+
+	st := backfillState{
+		From: getTime(t, "2023-01-01T00:00:00Z"),
+		To:   getTime(t, "2023-01-05T00:00:00Z"),
+	}
+	synced := []int{}
+	saves := 0
+	err := backfill(context.Background(), &st, func(ctx context.Context, a *linkActivationDB) error {
+		if a.ID == 3 {
+			return errors.Errorf("fake DB failure")
+		}
+		synced = append(synced, a.ID)
+		return nil
+	}, func(backfillState) error {
+		saves++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, synced)
+	assert.Equal(t, 1, st.Synced)
+	assert.Equal(t, 1, st.Skipped)
+	assert.Equal(t, []int{3}, st.Failed)
+	assert.True(t, st.Complete)
+	assert.Less(t, 5, saves)
+
+	// Resume part-way through the second page
+	st = backfillState{
+		From: getTime(t, "2023-01-01T00:00:00Z"),
+		To:   getTime(t, "2023-01-06T00:00:00Z"),
+		Done: []int{1, 2, 3, 4},
+	}
+	synced = []int{}
+	err = backfill(context.Background(), &st, func(ctx context.Context, a *linkActivationDB) error {
+		synced = append(synced, a.ID)
+		return nil
+	}, func(backfillState) error { return nil })
+	assert.Nil(t, err)
+	assert.Equal(t, []int{5}, synced)
+}
+
+// Mock a TripWatch history which is listed newest first, two activations to a page. The number
+// of pages listed is counted.
+func backfillHistoryServer(t *testing.T, history *[]activationSummary, pages *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/activations":
+			*pages++
+			page, err := strconv.Atoi(r.URL.Query().Get("page"))
+			assert.Nil(t, err)
+			data := []string{}
+			for i := (page - 1) * 2; i < page*2 && i < len(*history); i++ {
+				data = append(data, fmt.Sprintf(`{"id":%d,"created_at":"%s"}`, (*history)[i].ID,
+					time.Time((*history)[i].Created).Format(time.RFC3339)))
+			}
+			fmt.Fprintf(w, `{"current_page":%d,"last_page":%d,"data":[%s]}`,
+				page, (len(*history)+1)/2, strings.Join(data, ","))
+		case strings.HasPrefix(r.URL.Path, "/activations/"):
+			id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/activations/"))
+			assert.Nil(t, err)
+			for _, summary := range *history {
+				if summary.ID == id {
+					fmt.Fprintf(w, `{"id":%d,"created_at":"%s","activationsstatus":"Completed"}`,
+						id, time.Time(summary.Created).Format(time.RFC3339))
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasPrefix(r.URL.Path, "/activationtransactions/"),
+			strings.HasPrefix(r.URL.Path, "/activationrisks/"):
+			fmt.Fprint(w, "[]")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func historyEntry(t *testing.T, id int, created string) activationSummary {
+	return activationSummary{ID: id, Created: CustomJSONTime(getTime(t, created))}
+}
+
+func TestBackfillStopsAtOlderPage(t *testing.T) {
+	history := []activationSummary{
+		historyEntry(t, 4, "2023-01-02T02:00:00Z"),
+		historyEntry(t, 3, "2023-01-01T02:00:00Z"),
+		historyEntry(t, 2, "2022-12-01T02:00:00Z"),
+		historyEntry(t, 1, "2022-11-01T02:00:00Z"),
+		historyEntry(t, 0, "2022-10-01T02:00:00Z"),
+	}
+	pages := 0
+	srv := backfillHistoryServer(t, &history, &pages)
+	defer srv.Close()
+	tripwatchURL = srv.URL
+	defer func() { tripwatchURL = "" }()
+
+	st := backfillState{
+		From: getTime(t, "2023-01-01T00:00:00Z"),
+		To:   getTime(t, "2023-01-03T00:00:00Z"),
+	}
+	err := backfill(context.Background(), &st, func(ctx context.Context, a *linkActivationDB) error {
+		return nil
+	}, func(backfillState) error { return nil })
+	assert.Nil(t, err)
+	assert.Equal(t, 2, st.Synced)
+	assert.True(t, st.Complete)
+	// The second page is entirely older than -from, so the third is never fetched
+	assert.Equal(t, 2, pages)
+}
+
+// New activations created while a backfill is interrupted shift the history pages. The resumed
+// backfill must neither miss activations nor sync those which were done again.
+func TestBackfillHistoryGrows(t *testing.T) {
+	history := []activationSummary{
+		historyEntry(t, 5, "2023-01-05T02:00:00Z"),
+		historyEntry(t, 4, "2023-01-04T02:00:00Z"),
+		historyEntry(t, 3, "2023-01-03T02:00:00Z"),
+		historyEntry(t, 2, "2023-01-02T02:00:00Z"),
+		historyEntry(t, 1, "2023-01-01T02:00:00Z"),
+	}
+	pages := 0
+	srv := backfillHistoryServer(t, &history, &pages)
+	defer srv.Close()
+	tripwatchURL = srv.URL
+	defer func() { tripwatchURL = "" }()
+
+	synced := []int{}
+	sync := func(ctx context.Context, a *linkActivationDB) error {
+		synced = append(synced, a.ID)
+		return nil
+	}
+	// Only progress which was saved survives the interruption
+	saved := backfillState{
+		From: getTime(t, "2023-01-01T00:00:00Z"),
+		To:   getTime(t, "2023-01-06T00:00:00Z"),
+	}
+	st := saved
+	err := backfill(context.Background(), &st, sync, func(st backfillState) error {
+		if len(st.Done) > 3 {
+			return errors.Errorf("interrupted")
+		}
+		saved = st
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []int{5, 4, 3}, saved.Done)
+	synced = []int{}
+
+	history = append([]activationSummary{
+		historyEntry(t, 7, "2023-02-01T02:00:00Z"),
+		historyEntry(t, 6, "2023-02-01T01:00:00Z"),
+		historyEntry(t, 8, "2023-02-01T00:00:00Z"),
+	}, history...)
+	st = saved
+	err = backfill(context.Background(), &st, sync, func(backfillState) error { return nil })
+	assert.Nil(t, err)
+	assert.True(t, st.Complete)
+	assert.Equal(t, []int{2, 1}, synced)
+	assert.Equal(t, 5, st.Synced)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Policies for activations which are cancelled in TripWatch after they were synced to DUTYJOBS.
+const (
+	// Leave the job in the DB. This was the original behaviour.
+	cancelledIgnore = "ignore"
+	// Delete the job and its crew rows.
+	cancelledDelete = "delete"
+	// Keep the job but note the cancellation in JOBREMARKS.
+	cancelledRemark = "remark"
+	// Keep the job and add it to the review queue, to be resolved with the `cancelled` command.
+	cancelledReview = "review"
+)
+
+const cancelledRemarkText = "CANCELLED IN TRIPWATCH"
+
+const reviewFileName = ".vmrsync-review.yml"
+
+var cancelledPolicy = cancelledIgnore
+
+func validateCancelledPolicy() error {
+	switch cancelledPolicy {
+	case cancelledIgnore, cancelledDelete, cancelledRemark, cancelledReview:
+		return nil
+	}
+	return errors.Errorf("unknown cancelled activation policy '%s'", cancelledPolicy)
+}
+
+// A cancelled activation waiting for an operator to decide what to do with its job.
+type reviewItem struct {
+	TripWatchID int       `yaml:"tripwatchid"`
+	DutyLogID   int       `yaml:"dutysequence"`
+	JobID       int       `yaml:"jobsequence"`
+	Cancelled   time.Time `yaml:"cancelled"`
+}
+
+func loadReviewQueue() ([]reviewItem, error) {
+	queue := []reviewItem{}
+	if err := readStateFile(reviewFileName, &queue); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Wrapf(err, "load review queue")
+	}
+	return queue, nil
+}
+
+func saveReviewQueue(queue []reviewItem) error {
+	if err := writeStateFile(reviewFileName, queue); err != nil {
+		return errors.Wrapf(err, "save review queue")
+	}
+	return nil
+}
+
+// Apply the cancelled activation policy to an activation. Activations which were never synced
+// (i.e. have no link) are left alone.
+func handleCancelled(ctx context.Context, db dbExecutor, data *linkActivationDB) error {
+	if cancelledPolicy == cancelledIgnore || !linkTableReady || data.ID == 0 {
+		return nil
+	}
+	link, linked, err := findLink(ctx, db, data.ID)
+	if err != nil {
+		return errors.Wrapf(err, "cancelled activation %d finding link", data.ID)
+	} else if !linked {
+		return nil
+	} else if locked, err := isJobLocked(ctx, db, link); err != nil {
+		return errors.Wrapf(err, "cancelled activation %d", data.ID)
+	} else if locked {
+		log.Printf("Job %d is locked, not retracting cancelled activation %d", link.JobID, data.ID)
+		return nil
+	}
+	switch cancelledPolicy {
+	case cancelledDelete:
+		if txdb, ok := db.(txBeginner); ok {
+			writes := &txWrites{}
+			if err = withTx(ctx, txdb, nil, func(tx dbExecutor) error {
+				writes.dbExecutor = tx
+				return retractJob(ctx, writes, link)
+			}); err == nil {
+				writes.commit()
+			}
+		} else {
+			err = retractJob(ctx, db, link)
+		}
+	case cancelledRemark:
+		err = remarkCancelledJob(ctx, db, link)
+	case cancelledReview:
+		err = queueForReview(link)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cancelled activation %d (%s policy)", data.ID, cancelledPolicy)
+	}
+	return nil
+}
+
+// Delete a linked job along with its crew rows and the link itself.
+func retractJob(ctx context.Context, db dbExecutor, link jobLink) error {
+	type deleteStmt struct {
+		table string
+		stmt  string
+		args  []interface{}
+	}
+	stmts := []deleteStmt{
+		{"DUTYJOBSCREW", "DELETE FROM DUTYJOBSCREW WHERE CREWJOBSEQUENCE=?",
+			[]interface{}{link.JobID}},
+		{"DUTYJOBS", "DELETE FROM DUTYJOBS WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+			[]interface{}{link.DutyLogID, link.JobID}},
+		{linkTableName, "DELETE FROM " + linkTableName + " WHERE TRIPWATCH_ID=?",
+			[]interface{}{link.TripWatchID}},
+	}
+	if snapshotTableReady {
+		stmts = append(stmts, deleteStmt{snapshotTableName,
+			"DELETE FROM " + snapshotTableName + " WHERE TRIPWATCH_ID=?",
+			[]interface{}{link.TripWatchID}})
+	}
+	if conflictTableReady {
+		stmts = append(stmts, deleteStmt{conflictTableName,
+			"DELETE FROM " + conflictTableName + " WHERE TRIPWATCH_ID=?",
+			[]interface{}{link.TripWatchID}})
+	}
+	if jobTrackTableReady {
+		stmts = append(stmts, deleteStmt{jobTrackTableName,
+			"DELETE FROM " + jobTrackTableName + " WHERE TRIPWATCH_ID=?",
+			[]interface{}{link.TripWatchID}})
+	}
+	if jobStatsTableReady {
+		stmts = append(stmts, deleteStmt{jobStatsTableName,
+			"DELETE FROM " + jobStatsTableName + " WHERE TRIPWATCH_ID=?",
+			[]interface{}{link.TripWatchID}})
+	}
+	for _, s := range stmts {
+		if result, err := db.ExecContext(ctx, s.stmt, s.args...); err != nil {
+			return errors.Wrapf(dbError{
+				error:     err,
+				name:      s.table,
+				statement: s.stmt,
+			}, "retract job %d", link.JobID)
+		} else if rowCount, err := result.RowsAffected(); err == nil && s.table == "DUTYJOBSCREW" {
+			countWrite(db, crewRows, float64(rowCount), "removed")
+		}
+	}
+	log.Printf("Deleted job %d (duty %d) for cancelled activation %d",
+		link.JobID, link.DutyLogID, link.TripWatchID)
+	return nil
+}
+
+const jobRemarksColumn = "JOBREMARKS"
+
+// Length of the JOBREMARKS column. This is the schema's len if the schema writes the column, and
+// otherwise the length of the column in the DB.
+func jobRemarksLen(ctx context.Context, db dbExecutor) (int, error) {
+	for _, table := range activeSchema.Tables {
+		for _, col := range table.Columns {
+			if table.Table == jobTableName && col.Column == jobRemarksColumn && col.Len > 0 {
+				return col.Len, nil
+			}
+		}
+	}
+	if columns, err := getDBColumns(ctx, db, jobTableName); err != nil {
+		return 0, errors.Wrapf(err, "job remarks length")
+	} else if col, ok := columns[jobRemarksColumn]; !ok || col.length <= 0 {
+		return 0, errors.Errorf("job remarks length: no %s.%s column", jobTableName, jobRemarksColumn)
+	} else {
+		return col.length, nil
+	}
+}
+
+// Add the cancellation marker to the start of the job's remarks, keeping any remarks entered in
+// the VMR desktop app after it.
+func cancelledJobRemarks(current string, maxLen int) string {
+	current = strings.TrimSpace(current)
+	if current == "" {
+		return cancelledRemarkText
+	} else if strings.Contains(current, cancelledRemarkText) {
+		return current
+	}
+	return truncate(cancelledRemarkText+". "+current, maxLen)
+}
+
+func remarkCancelledJob(ctx context.Context, db dbExecutor, link jobLink) error {
+	row, err := readJobRow(ctx, db, link, []string{jobRemarksColumn})
+	if err != nil {
+		return errors.Wrapf(err, "remark cancelled job %d", link.JobID)
+	}
+	maxLen, err := jobRemarksLen(ctx, db)
+	if err != nil {
+		return errors.Wrapf(err, "remark cancelled job %d", link.JobID)
+	}
+	current := strings.TrimSpace(dbString(row[jobRemarksColumn]))
+	remark := cancelledJobRemarks(current, maxLen)
+	if row != nil && remark == current {
+		// Already marked as cancelled
+		return nil
+	}
+	if err := tryUpdate(ctx, db, "DUTYJOBS", []column{
+		{name: jobRemarksColumn, value: remark},
+		{name: "JOBDUTYSEQUENCE", isMatch: true, value: link.DutyLogID},
+		{name: "JOBJOBSEQUENCE", isMatch: true, value: link.JobID},
+	}); err != nil {
+		return errors.Wrapf(err, "remark cancelled job %d", link.JobID)
+	}
+	return nil
+}
+
+func queueForReview(link jobLink) error {
+	if dryRun {
+		log.Printf("Dry run: would queue job %d for review", link.JobID)
+		return nil
+	}
+	queue, err := loadReviewQueue()
+	if err != nil {
+		return errors.Wrapf(err, "queue for review")
+	}
+	for _, item := range queue {
+		if item.TripWatchID == link.TripWatchID {
+			return nil
+		}
+	}
+	queue = append(queue, reviewItem{
+		TripWatchID: link.TripWatchID,
+		DutyLogID:   link.DutyLogID,
+		JobID:       link.JobID,
+		Cancelled:   now().UTC(),
+	})
+	if err := saveReviewQueue(queue); err != nil {
+		return errors.Wrapf(err, "queue for review")
+	}
+	log.Printf("Queued job %d for review as activation %d was cancelled",
+		link.JobID, link.TripWatchID)
+	return nil
+}
+
+// List the review queue, or resolve an entry in it by deleting or keeping its job.
+func cancelledCommand(args []string) error {
+	fs := flag.NewFlagSet("cancelled", flag.ContinueOnError)
+	del := fs.Int("delete", 0, "Delete the job for this cancelled TripWatch activation ID")
+	keep := fs.Int("keep", 0, "Keep the job for this cancelled TripWatch activation ID")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "cancelled flags")
+	} else if err := parseConfig(configFilePath); err != nil {
+		return errors.Wrapf(err, "cancelled config parsing")
+	}
+	unlock, err := lockState(commandStateLockWait)
+	if err != nil {
+		return errors.Wrapf(err, "cancelled command waiting for the sync cycle")
+	}
+	defer unlock()
+
+	queue, err := loadReviewQueue()
+	if err != nil {
+		return errors.Wrapf(err, "cancelled command")
+	}
+	id := *del
+	if id == 0 {
+		id = *keep
+	}
+	if id == 0 {
+		if len(queue) == 0 {
+			fmt.Println("No cancelled activations waiting for review")
+		}
+		for _, item := range queue {
+			fmt.Printf("Activation %d: job %d (duty %d), cancelled %s\n", item.TripWatchID,
+				item.JobID, item.DutyLogID, item.Cancelled.Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	for i, item := range queue {
+		if item.TripWatchID != id {
+			continue
+		}
+		if *del != 0 {
+			db, closefunc, err := setup()
+			if err != nil {
+				return errors.Wrapf(err, "cancelled setup")
+			}
+			defer closefunc()
+			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			defer cancel()
+			if err := withTx(ctx, db, nil, func(tx dbExecutor) error {
+				return retractJob(ctx, tx, jobLink{
+					TripWatchID: item.TripWatchID,
+					DutyLogID:   item.DutyLogID,
+					JobID:       item.JobID,
+				})
+			}); err != nil {
+				return errors.Wrapf(err, "cancelled deleting job %d", item.JobID)
+			}
+		}
+		if err := saveReviewQueue(append(queue[:i], queue[i+1:]...)); err != nil {
+			return errors.Wrapf(err, "cancelled command")
+		}
+		fmt.Printf("Activation %d resolved\n", id)
+		return nil
+	}
+	return errors.Errorf("activation %d is not in the review queue", id)
+}
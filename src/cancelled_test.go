@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCancelledPolicy(t *testing.T) {
+	defer func() { cancelledPolicy = cancelledIgnore }()
+	for _, policy := range []string{cancelledIgnore, cancelledDelete, cancelledRemark, cancelledReview} {
+		cancelledPolicy = policy
+		assert.Nil(t, validateCancelledPolicy())
+	}
+	cancelledPolicy = "shred"
+	assert.NotNil(t, validateCancelledPolicy())
+}
+
+func TestCancelledJobRemarks(t *testing.T) {
+	assert.Equal(t, cancelledRemarkText, cancelledJobRemarks("", 96))
+	assert.Equal(t, cancelledRemarkText, cancelledJobRemarks("   ", 96))
+	assert.Equal(t, cancelledRemarkText+". Towed to ramp", cancelledJobRemarks("Towed to ramp  ", 96))
+	// The marker isn't added twice
+	assert.Equal(t, cancelledRemarkText+". Towed to ramp",
+		cancelledJobRemarks(cancelledRemarkText+". Towed to ramp", 96))
+	// Long remarks are cut short to fit the column, keeping the marker
+	long := cancelledJobRemarks(strings.Repeat("x", 100), 96)
+	assert.Len(t, long, 96)
+	assert.True(t, strings.HasPrefix(long, cancelledRemarkText+". xxx"))
+
+	// The column length is taken from the schema when it writes JOBREMARKS
+	oldSchema := activeSchema
+	defer func() { activeSchema = oldSchema }()
+	activeSchema = mustDefaultSchema()
+	activeSchema.mergeTable(tableSchema{Table: jobTableName, Columns: []columnSchema{
+		{Column: jobRemarksColumn, JSON: "activationsnotes.remark", Len: 30},
+	}})
+	maxLen, err := jobRemarksLen(context.Background(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 30, maxLen)
+}
+
+func TestHandleCancelledIgnored(t *testing.T) {
+	// Nothing is read from or written to the DB when the policy is to ignore cancellations or
+	// when the link table isn't available.
+	recorder := &dryRunRecorder{}
+	err := handleCancelled(context.Background(), recorder, &linkActivationDB{ID: 42})
+	assert.Nil(t, err)
+	cancelledPolicy = cancelledDelete
+	defer func() { cancelledPolicy = cancelledIgnore }()
+	err = handleCancelled(context.Background(), recorder, &linkActivationDB{ID: 42})
+	assert.Nil(t, err)
+	assert.Empty(t, recorder.statements)
+}
+
+func TestReviewQueue(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := dir + "/config.yml"
+	err := os.WriteFile(cfgFile, []byte("tripwatch:\n  poll: \"60s\"\nfirebird:\n  cancelled: review\n"), 0600)
+	assert.Nil(t, err)
+	oldPath := configFilePath
+	configFilePath = cfgFile
+	defer func() {
+		configFilePath = oldPath
+		stateDir = ""
+		cancelledPolicy = cancelledIgnore
+	}()
+	err = parseConfig(cfgFile)
+	assert.Nil(t, err)
+	assert.Equal(t, cancelledReview, cancelledPolicy)
+
+	queue, err := loadReviewQueue()
+	assert.Nil(t, err)
+	assert.Empty(t, queue)
+
+	link := jobLink{TripWatchID: 88, DutyLogID: 2, JobID: 3}
+	assert.Nil(t, queueForReview(link))
+	// Queueing the same activation again doesn't add a duplicate
+	assert.Nil(t, queueForReview(link))
+	assert.Nil(t, queueForReview(jobLink{TripWatchID: 89, DutyLogID: 2, JobID: 4}))
+	queue, err = loadReviewQueue()
+	assert.Nil(t, err)
+	if assert.Len(t, queue, 2) {
+		assert.Equal(t, 88, queue[0].TripWatchID)
+		assert.Equal(t, 3, queue[0].JobID)
+		assert.Equal(t, 89, queue[1].TripWatchID)
+	}
+
+	assert.Nil(t, runCommand([]string{"cancelled"}))
+	assert.Nil(t, runCommand([]string{"cancelled", "-keep", "88"}))
+	assert.NotNil(t, runCommand([]string{"cancelled", "-keep", "88"}))
+	queue, err = loadReviewQueue()
+	assert.Nil(t, err)
+	if assert.Len(t, queue, 1) {
+		assert.Equal(t, 89, queue[0].TripWatchID)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Operator subcommands. These are given after any global flags, e.g.
+// `vmrsync -config-file x.yml checkpoint -rewind 24h`, and run once and exit rather than
+// starting the main sync loop.
+var commands = map[string]struct {
+	desc string
+	run  func(args []string) error
+}{
+	"checkpoint": {"Show or change the sync high-water mark", checkpointCommand},
+	"backfill":   {"Sync TripWatch activations created in a date range", backfillCommand},
+	"cancelled":  {"List or resolve synced jobs whose activation was cancelled", cancelledCommand},
+	"retry":      {"List failed activations, or replay dead letters", retryCommand},
+	"check-schema": {"Check the Firebird schema against the columns vmrsync uses",
+		checkSchemaCommand},
+	"export": {"Export job positions and tracks as GPX, KML or GeoJSON", exportCommand},
+}
+
+func runCommand(args []string) error {
+	if cmd, ok := commands[args[0]]; !ok {
+		return errors.Errorf("unknown command '%s'\n%s", args[0], commandUsage())
+	} else if dryRun {
+		// Commands write to the DB or state files directly, so can't honour a dry run.
+		return errors.Errorf("-dry-run can't be used with the %s command", args[0])
+	} else if err := cmd.run(args[1:]); err != nil {
+		return errors.Wrapf(err, "command %s", args[0])
+	}
+	return nil
+}
+
+func commandUsage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	usage := "Commands:\n"
+	for _, name := range names {
+		usage += fmt.Sprintf("  %-12s %s\n", name, commands[name].desc)
+	}
+	return usage
+}
+
+func checkpointCommand(args []string) error {
+	fs := flag.NewFlagSet("checkpoint", flag.ContinueOnError)
+	set := fs.String("set", "", "Set the checkpoint to this RFC3339 timestamp")
+	rewind := fs.Duration("rewind", 0, "Move the checkpoint back by this duration")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "checkpoint flags")
+	} else if err := parseConfig(configFilePath); err != nil {
+		return errors.Wrapf(err, "checkpoint config parsing")
+	}
+	unlock, err := lockState(commandStateLockWait)
+	if err != nil {
+		return errors.Wrapf(err, "checkpoint command waiting for the sync cycle")
+	}
+	defer unlock()
+
+	ts, err := loadCheckpoint()
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		fmt.Println("No checkpoint saved, the sync will start from 12 hours before boot")
+	} else if err != nil {
+		return errors.Wrapf(err, "checkpoint loading")
+	} else {
+		fmt.Printf("Checkpoint: %s\n", ts.Format(time.RFC3339))
+	}
+
+	if *set != "" {
+		if newTS, err := time.Parse(time.RFC3339, *set); err != nil {
+			return errors.Wrapf(err, "checkpoint parsing -set timestamp")
+		} else {
+			ts = newTS
+		}
+	} else if *rewind != 0 {
+		if ts.IsZero() {
+			return errors.Errorf("no checkpoint to rewind, use -set instead")
+		}
+		ts = ts.Add(-*rewind)
+	} else {
+		return nil
+	}
+	if err := saveCheckpoint(ts); err != nil {
+		return errors.Wrapf(err, "checkpoint saving")
+	}
+	fmt.Printf("Checkpoint changed to: %s\n", ts.UTC().Format(time.RFC3339))
+	return nil
+}
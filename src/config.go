@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/pkg/errors"
@@ -20,7 +21,37 @@ func parseConfig(fname string) error {
 			Port     int    `yaml:"port"`
 			Password string `yaml:"password"`
 			Path     string `yaml:"path"`
+			// Sequence number allocation per table
+			Sequences map[string]sequenceConfig `yaml:"sequences"`
+			// What to do with synced jobs whose activation is later cancelled
+			Cancelled string `yaml:"cancelled"`
+			// What to do when the DB schema doesn't match the columns vmrsync writes
+			SchemaCheck string `yaml:"schemacheck"`
 		} `yaml:"firebird"`
+		Risks riskConfig `yaml:"risks"`
+		// Job positions outside this area are rejected
+		OperatingArea areaConfig `yaml:"operatingarea"`
+		// Coastal waters forecast zone which the job weather is taken from
+		Forecast struct {
+			Zone string `yaml:"zone"`
+		} `yaml:"forecast"`
+		Retry struct {
+			Attempts   int    `yaml:"attempts"`
+			Backoff    string `yaml:"backoff"`
+			MaxBackoff string `yaml:"maxbackoff"`
+		} `yaml:"retry"`
+		State struct {
+			Dir string `yaml:"dir"`
+		} `yaml:"state"`
+		// Embedded HTTP server for health checks and the status page
+		Status struct {
+			Enabled bool   `yaml:"enabled"`
+			Listen  string `yaml:"listen"`
+		} `yaml:"status"`
+		// Extra translations of TripWatch values to the values used in Firebird
+		Mappings map[string]enumMapping `yaml:"mappings"`
+		// Override file for the mapping of activations to Firebird columns
+		Schema string `yaml:"schema"`
 	}{}
 	if file, err := os.Open(fname); err != nil {
 		return errors.Wrapf(err, "parse config file opening")
@@ -39,6 +70,86 @@ func parseConfig(fname string) error {
 			}
 			setDBConnString(cfg.Firebird.Host, cfg.Firebird.Port, cfg.Firebird.Password,
 				cfg.Firebird.Path)
+			sequenceConfigs = cfg.Firebird.Sequences
+			if err := validateSequenceConfigs(); err != nil {
+				return errors.Wrapf(err, "parse config sequences")
+			}
+			cancelledPolicy = cfg.Firebird.Cancelled
+			if cancelledPolicy == "" {
+				cancelledPolicy = cancelledIgnore
+			}
+			if err := validateCancelledPolicy(); err != nil {
+				return errors.Wrapf(err, "parse config cancelled policy")
+			}
+			schemaCheckPolicy = cfg.Firebird.SchemaCheck
+			if schemaCheckPolicy == "" {
+				schemaCheckPolicy = schemaCheckWarn
+			}
+			if err := validateSchemaCheckPolicy(); err != nil {
+				return errors.Wrapf(err, "parse config schema check")
+			}
+			if cfg.Retry.Attempts > 0 {
+				retryMaxAttempts = cfg.Retry.Attempts
+			}
+			if cfg.Retry.Backoff != "" {
+				if backoff, err := time.ParseDuration(cfg.Retry.Backoff); err != nil {
+					return errors.Wrapf(err, "parse config retry backoff")
+				} else {
+					retryBackoff = backoff
+				}
+			}
+			if cfg.Retry.MaxBackoff != "" {
+				if backoff, err := time.ParseDuration(cfg.Retry.MaxBackoff); err != nil {
+					return errors.Wrapf(err, "parse config retry max backoff")
+				} else {
+					retryMaxBackoff = backoff
+				}
+			}
+			riskCfg = defaultRiskConfig()
+			if cfg.Risks.Rule != "" {
+				riskCfg.Rule = cfg.Risks.Rule
+			}
+			if cfg.Risks.HighPriority > 0 {
+				riskCfg.HighPriority = cfg.Risks.HighPriority
+			}
+			riskCfg.Scores = cfg.Risks.Scores
+			if err := validateRiskConfig(); err != nil {
+				return errors.Wrapf(err, "parse config risks")
+			}
+			forecastZone = cfg.Forecast.Zone
+			if forecastZone == "" {
+				forecastZone = defaultForecastZone
+			}
+			if area, err := loadOperatingArea(cfg.OperatingArea, filepath.Dir(fname)); err != nil {
+				return errors.Wrapf(err, "parse config operating area")
+			} else {
+				operatingArea = area
+			}
+			if mappings, err := buildEnumMappings(cfg.Mappings); err != nil {
+				return errors.Wrapf(err, "parse config mappings")
+			} else {
+				enumMappings = mappings
+			}
+			schemaFile := cfg.Schema
+			if schemaFile != "" && !filepath.IsAbs(schemaFile) {
+				schemaFile = filepath.Join(filepath.Dir(fname), schemaFile)
+			}
+			if schema, err := loadSchema(schemaFile); err != nil {
+				return errors.Wrapf(err, "parse config schema")
+			} else {
+				activeSchema = schema
+			}
+			stateDir = cfg.State.Dir
+			if stateDir == "" {
+				stateDir = filepath.Dir(fname)
+			}
+			statusListen = ""
+			if cfg.Status.Enabled {
+				statusListen = cfg.Status.Listen
+				if statusListen == "" {
+					statusListen = defaultStatusListen
+				}
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// What to do when the Firebird schema doesn't match the columns which vmrsync writes.
+const (
+	schemaCheckWarn  = "warn"  // Log the problems and carry on (default)
+	schemaCheckError = "error" // Refuse to start if there are any errors
+	schemaCheckOff   = "off"
+)
+
+var schemaCheckPolicy = schemaCheckWarn
+
+func validateSchemaCheckPolicy() error {
+	switch schemaCheckPolicy {
+	case schemaCheckWarn, schemaCheckError, schemaCheckOff:
+		return nil
+	}
+	return errors.Errorf("unknown schema check policy '%s'", schemaCheckPolicy)
+}
+
+// Broad types of column value, as far as compatibility with Firebird column types goes.
+const (
+	valueText  = "text"
+	valueInt   = "integer"
+	valueFloat = "decimal"
+	valueTime  = "timestamp"
+)
+
+// Values from RDB$FIELDS.RDB$FIELD_TYPE
+const (
+	fbSmallint  = 7
+	fbInteger   = 8
+	fbFloat     = 10
+	fbDate      = 12
+	fbTime      = 13
+	fbChar      = 14
+	fbBigint    = 16
+	fbDouble    = 27
+	fbTimestamp = 35
+	fbVarchar   = 37
+	fbBlob      = 261
+)
+
+// A column which vmrsync reads or writes.
+type expectedColumn struct {
+	table     string
+	name      string
+	valueType string
+	maxStrlen int
+}
+
+// A column as defined in the DB.
+type dbColumn struct {
+	fieldType int
+	subType   int
+	scale     int
+	length    int
+}
+
+type schemaProblem struct {
+	table   string
+	column  string
+	isError bool
+	message string
+}
+
+func (p schemaProblem) String() string {
+	level := "WARNING"
+	if p.isError {
+		level = "ERROR"
+	}
+	return fmt.Sprintf("%-7s %s.%s: %s", level, p.table, p.column, p.message)
+}
+
+func valueType(v interface{}) string {
+	switch v.(type) {
+	case time.Time, CustomJSONTime:
+		return valueTime
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return valueInt
+	case reflect.Float32, reflect.Float64:
+		return valueFloat
+	}
+	return valueText
+}
+
+// Zero value of each transform's result (see schemaTransforms).
+func transformSample(name string) interface{} {
+	switch name {
+	case "int":
+		return 0
+	case "float":
+		return 0.0
+	case "time":
+		return CustomJSONTime{}
+	}
+	return ""
+}
+
+// List every column which is written from an activation or read when adding crew or checking
+// for locked jobs, in table order. The activation columns come from the schema and the rest
+// from the struct tags.
+func expectedColumns() ([]expectedColumn, error) {
+	expected := []expectedColumn{}
+	seen := map[string]bool{}
+	add := func(col expectedColumn) {
+		if key := col.table + "." + col.name; !seen[key] {
+			seen[key] = true
+			expected = append(expected, col)
+		}
+	}
+	for _, table := range activeSchema.Tables {
+		for _, col := range table.Columns {
+			sample := transformSample(col.Transform)
+			if col.Field != "" {
+				var err error
+				if sample, _, err = schemaFieldValue(Job{}, col.Field); err != nil {
+					return nil, errors.Wrapf(err, "expected column %s.%s", table.Table, col.Column)
+				}
+			}
+			add(expectedColumn{
+				table:     table.Table,
+				name:      col.Column,
+				valueType: valueType(sample),
+				maxStrlen: col.Len,
+			})
+		}
+	}
+	// Read to check whether a job is locked
+	add(expectedColumn{table: jobTableName, name: jobLockedColumn, valueType: valueText, maxStrlen: 1})
+	for _, tagged := range []struct {
+		table string
+		obj   interface{}
+	}{
+		{"parent", crewOnJob{}},
+		{"parent", DutyLogTable{}},
+		{"DUTYVESSELS", dutyVessel{}},
+	} {
+		if err := forEachColumn(tagged.table, reflect.ValueOf(tagged.obj), func(tableName string, col column) error {
+			add(expectedColumn{
+				table:     tableName,
+				name:      col.name,
+				valueType: valueType(col.value),
+				maxStrlen: col.maxStrlen,
+			})
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "expected columns")
+		}
+	}
+	return expected, nil
+}
+
+// Read the column definitions of a table. The map is empty if the table doesn't exist.
+func getDBColumns(ctx context.Context, db dbExecutor, tableName string) (map[string]dbColumn, error) {
+	stmt := "SELECT RF.RDB$FIELD_NAME,F.RDB$FIELD_TYPE,F.RDB$FIELD_SUB_TYPE,F.RDB$FIELD_SCALE," +
+		"COALESCE(F.RDB$CHARACTER_LENGTH,F.RDB$FIELD_LENGTH)" +
+		" FROM RDB$RELATION_FIELDS RF JOIN RDB$FIELDS F ON F.RDB$FIELD_NAME=RF.RDB$FIELD_SOURCE" +
+		" WHERE RF.RDB$RELATION_NAME=?"
+	columns := map[string]dbColumn{}
+	if rows, err := db.QueryContext(ctx, stmt, tableName); err != nil {
+		return nil, errors.Wrapf(dbError{
+			error:     err,
+			name:      tableName,
+			statement: stmt,
+		}, "get columns for table %s", tableName)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			var subType, scale, length sql.NullInt64
+			col := dbColumn{}
+			if err := rows.Scan(&name, &col.fieldType, &subType, &scale, &length); err != nil {
+				return nil, errors.Wrapf(dbError{
+					error:     err,
+					name:      tableName,
+					statement: stmt,
+				}, "get columns for table %s reading row", tableName)
+			}
+			col.subType = int(subType.Int64)
+			col.scale = int(scale.Int64)
+			col.length = int(length.Int64)
+			columns[strings.TrimSpace(name)] = col
+		}
+		return columns, nil
+	}
+}
+
+// Check that a column's value can be written to the DB column. The message is empty if it can,
+// and the bool is set if the problem stops the value being written at all.
+func checkColumnType(want expectedColumn, col dbColumn) (string, bool) {
+	switch want.valueType {
+	case valueText:
+		switch {
+		case col.fieldType == fbBlob && col.subType == 1:
+			return "", false
+		case col.fieldType != fbChar && col.fieldType != fbVarchar:
+			break
+		case want.maxStrlen > col.length:
+			return fmt.Sprintf("length %d is longer than the column (%d characters)",
+				want.maxStrlen, col.length), true
+		case want.maxStrlen < col.length:
+			return fmt.Sprintf("length %d is shorter than the column (%d characters)",
+				want.maxStrlen, col.length), false
+		default:
+			return "", false
+		}
+	case valueInt:
+		switch col.fieldType {
+		case fbSmallint, fbInteger, fbBigint, fbFloat, fbDouble:
+			return "", false
+		}
+	case valueFloat:
+		switch col.fieldType {
+		case fbFloat, fbDouble:
+			return "", false
+		case fbSmallint, fbInteger, fbBigint:
+			if col.scale < 0 {
+				// NUMERIC or DECIMAL
+				return "", false
+			}
+			return fmt.Sprintf("decimal value is rounded to %s", fbTypeName(col)), false
+		}
+	case valueTime:
+		switch col.fieldType {
+		case fbTimestamp, fbDate:
+			return "", false
+		}
+	}
+	return fmt.Sprintf("%s value can't be written to %s", want.valueType,
+		fbTypeName(col)), true
+}
+
+func fbTypeName(col dbColumn) string {
+	switch col.fieldType {
+	case fbSmallint, fbInteger, fbBigint:
+		if col.scale < 0 {
+			return "NUMERIC"
+		}
+		return map[int]string{fbSmallint: "SMALLINT", fbInteger: "INTEGER", fbBigint: "BIGINT"}[col.fieldType]
+	case fbFloat:
+		return "FLOAT"
+	case fbDouble:
+		return "DOUBLE PRECISION"
+	case fbDate:
+		return "DATE"
+	case fbTime:
+		return "TIME"
+	case fbTimestamp:
+		return "TIMESTAMP"
+	case fbChar:
+		return fmt.Sprintf("CHAR(%d)", col.length)
+	case fbVarchar:
+		return fmt.Sprintf("VARCHAR(%d)", col.length)
+	case fbBlob:
+		return "BLOB"
+	}
+	return fmt.Sprintf("type %d", col.fieldType)
+}
+
+// Compare the columns which vmrsync uses with the DB schema.
+func checkDBSchema(ctx context.Context, db dbExecutor) ([]schemaProblem, error) {
+	expected, err := expectedColumns()
+	if err != nil {
+		return nil, errors.Wrapf(err, "check DB schema")
+	}
+	problems := []schemaProblem{}
+	tables := map[string]map[string]dbColumn{}
+	for _, want := range expected {
+		if _, ok := tables[want.table]; !ok {
+			if tables[want.table], err = getDBColumns(ctx, db, want.table); err != nil {
+				return nil, errors.Wrapf(err, "check DB schema")
+			}
+			if len(tables[want.table]) == 0 {
+				problems = append(problems, schemaProblem{table: want.table, column: "*",
+					isError: true, message: "table does not exist"})
+			}
+		}
+		if len(tables[want.table]) == 0 {
+			continue
+		} else if col, ok := tables[want.table][want.name]; !ok {
+			problems = append(problems, schemaProblem{table: want.table, column: want.name,
+				isError: true, message: "column does not exist"})
+		} else if msg, isError := checkColumnType(want, col); msg != "" {
+			problems = append(problems, schemaProblem{table: want.table, column: want.name,
+				isError: isError, message: msg})
+		}
+	}
+	return problems, nil
+}
+
+func schemaReport(problems []schemaProblem) (string, int) {
+	errCount := 0
+	for _, p := range problems {
+		if p.isError {
+			errCount++
+		}
+	}
+	if len(problems) == 0 {
+		return "Firebird schema check: OK\n", 0
+	}
+	report := strings.Builder{}
+	report.WriteString(fmt.Sprintf("Firebird schema check: %d errors, %d warnings\n",
+		errCount, len(problems)-errCount))
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].isError && !problems[j].isError
+	})
+	for _, p := range problems {
+		report.WriteString(fmt.Sprintf("  %s\n", p))
+	}
+	return report.String(), errCount
+}
+
+// Check the DB schema when starting up, according to the schema check policy.
+func checkSchemaAtStartup(ctx context.Context, db dbExecutor) error {
+	if schemaCheckPolicy == schemaCheckOff {
+		return nil
+	}
+	problems, err := checkDBSchema(ctx, db)
+	if err != nil {
+		return errors.Wrapf(err, "startup schema check")
+	} else if len(problems) == 0 {
+		return nil
+	}
+	report, errCount := schemaReport(problems)
+	log.Print(report)
+	if errCount > 0 && schemaCheckPolicy == schemaCheckError {
+		return errors.Errorf("Firebird schema has %d errors", errCount)
+	}
+	return nil
+}
+
+// Check the DB schema and print a report. An error is returned if there are any errors so that
+// the command can be used in scripts.
+func checkSchemaCommand(args []string) error {
+	fs := flag.NewFlagSet("check-schema", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "check-schema flags")
+	} else if err := parseConfig(configFilePath); err != nil {
+		return errors.Wrapf(err, "check-schema config parsing")
+	}
+	db, err := openDB()
+	if err != nil {
+		return errors.Wrapf(err, "check-schema opening DB")
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	problems, err := checkDBSchema(ctx, db)
+	if err != nil {
+		return errors.Wrapf(err, "check-schema")
+	}
+	report, errCount := schemaReport(problems)
+	fmt.Print(report)
+	if errCount > 0 {
+		return errors.Errorf("Firebird schema has %d errors", errCount)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectedColumns(t *testing.T) {
+	expected, err := expectedColumns()
+	assert.Nil(t, err)
+	find := func(table, name string) expectedColumn {
+		for _, col := range expected {
+			if col.table == table && col.name == name {
+				return col
+			}
+		}
+		t.Errorf("column %s.%s not expected", table, name)
+		return expectedColumn{}
+	}
+	assert.Equal(t, expectedColumn{table: "DUTYJOBS", name: "JOBDETAILS", valueType: valueText, maxStrlen: 96},
+		find("DUTYJOBS", "JOBDETAILS"))
+	assert.Equal(t, valueTime, find("DUTYJOBS", "JOBTIMEOUT").valueType)
+	assert.Equal(t, valueInt, find("DUTYJOBS", "JOBJOBSEQUENCE").valueType)
+	assert.Equal(t, valueFloat, find("DUTYJOBS", "JOBLATDEC").valueType)
+	assert.Equal(t, valueFloat, find("DUTYJOBS", "JOBHOURSSTART").valueType)
+	assert.Equal(t, 1, find("DUTYJOBS", "JOBLOCKED").maxStrlen)
+	assert.Equal(t, 1, find("DUTYJOBSCREW", "SKIPPER").maxStrlen)
+	assert.Equal(t, valueTime, find("DUTYLOG", "DUTYDATE").valueType)
+	assert.Equal(t, valueFloat, find("DUTYVESSELS", "FUELUSED").valueType)
+
+	// Each column is only listed once
+	count := 0
+	for _, col := range expected {
+		if col.table == "DUTYJOBS" && col.name == "JOBFREQUENCY" {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestCheckColumnType(t *testing.T) {
+	text := expectedColumn{table: "DUTYJOBS", name: "JOBDETAILS", valueType: valueText, maxStrlen: 96}
+	tests := []struct {
+		name    string
+		want    expectedColumn
+		col     dbColumn
+		isError bool
+		message string
+	}{
+		{name: "varchar", want: text, col: dbColumn{fieldType: fbVarchar, length: 96}},
+		{name: "char", want: text, col: dbColumn{fieldType: fbChar, length: 96}},
+		{name: "text blob", want: text, col: dbColumn{fieldType: fbBlob, subType: 1}},
+		{name: "column too short", want: text, col: dbColumn{fieldType: fbVarchar, length: 80},
+			isError: true, message: "length 96 is longer than the column (80 characters)"},
+		{name: "column longer", want: text, col: dbColumn{fieldType: fbVarchar, length: 120},
+			message: "length 96 is shorter than the column (120 characters)"},
+		{name: "text into integer", want: text, col: dbColumn{fieldType: fbInteger},
+			isError: true, message: "text value can't be written to INTEGER"},
+		{name: "integer", want: expectedColumn{valueType: valueInt}, col: dbColumn{fieldType: fbSmallint}},
+		{name: "integer into double", want: expectedColumn{valueType: valueInt}, col: dbColumn{fieldType: fbDouble}},
+		{name: "decimal into numeric", want: expectedColumn{valueType: valueFloat},
+			col: dbColumn{fieldType: fbBigint, scale: -2}},
+		{name: "decimal into integer", want: expectedColumn{valueType: valueFloat},
+			col: dbColumn{fieldType: fbInteger}, message: "decimal value is rounded to INTEGER"},
+		{name: "decimal into varchar", want: expectedColumn{valueType: valueFloat},
+			col: dbColumn{fieldType: fbVarchar, length: 10}, isError: true,
+			message: "decimal value can't be written to VARCHAR(10)"},
+		{name: "timestamp", want: expectedColumn{valueType: valueTime}, col: dbColumn{fieldType: fbTimestamp}},
+		{name: "timestamp into varchar", want: expectedColumn{valueType: valueTime},
+			col: dbColumn{fieldType: fbVarchar, length: 20}, isError: true,
+			message: "timestamp value can't be written to VARCHAR(20)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, isError := checkColumnType(test.want, test.col)
+			assert.Equal(t, test.message, message)
+			assert.Equal(t, test.isError, isError)
+		})
+	}
+}
+
+func TestSchemaReport(t *testing.T) {
+	report, errCount := schemaReport(nil)
+	assert.Equal(t, 0, errCount)
+	assert.Equal(t, "Firebird schema check: OK\n", report)
+
+	report, errCount = schemaReport([]schemaProblem{
+		{table: "DUTYJOBS", column: "JOBDETAILS", message: "length 96 is shorter than the column (120 characters)"},
+		{table: "DUTYJOBS", column: "JOBRISK1", isError: true, message: "column does not exist"},
+	})
+	assert.Equal(t, 1, errCount)
+	assert.Equal(t, strings.Join([]string{
+		"Firebird schema check: 1 errors, 1 warnings",
+		"  ERROR   DUTYJOBS.JOBRISK1: column does not exist",
+		"  WARNING DUTYJOBS.JOBDETAILS: length 96 is shorter than the column (120 characters)",
+		"",
+	}, "\n"), report)
+}
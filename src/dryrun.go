@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var dryRun bool
+
+// A statement that would have been executed against the DB, along with the changes it would
+// make to the row(s) that currently exist.
+type dryRunStatement struct {
+	query    string
+	args     []interface{}
+	rowCount int64
+	diff     []string
+}
+
+// The dry-run recorder is a dbExecutor which passes queries through to the real DB, but
+// records all statements which would modify the DB instead of executing them.
+type dryRunRecorder struct {
+	db         dbExecutor
+	statements []dryRunStatement
+}
+
+type dryRunResult int64
+
+func (r dryRunResult) LastInsertId() (int64, error) {
+	return 0, errors.Errorf("LastInsertId not supported")
+}
+
+func (r dryRunResult) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
+
+func (r *dryRunRecorder) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return r.db.QueryContext(ctx, query, args...)
+}
+
+func (r *dryRunRecorder) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt := dryRunStatement{query: query, args: args, rowCount: 1}
+	if table, cols, where, ok := parseUpdateStatement(query); ok {
+		if diff, count, err := r.diffRow(ctx, table, cols, args[:len(cols)],
+			where, args[len(cols):]); err != nil {
+			return nil, errors.Wrapf(err, "dry run diff for table %s", table)
+		} else {
+			stmt.diff = diff
+			stmt.rowCount = count
+		}
+	} else if strings.HasPrefix(query, "DELETE FROM ") {
+		parts := strings.SplitN(strings.TrimPrefix(query, "DELETE FROM "), " WHERE ", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("dry run can't parse delete statement '%s'", query)
+		} else if _, count, err := r.diffRow(ctx, parts[0], nil, nil, parts[1], args); err != nil {
+			return nil, errors.Wrapf(err, "dry run row count for table %s", parts[0])
+		} else {
+			stmt.rowCount = count
+		}
+	}
+	r.statements = append(r.statements, stmt)
+	return dryRunResult(stmt.rowCount), nil
+}
+
+// Split an UPDATE statement, as built by tryUpdate(), into the table name, the list of
+// columns being set and the WHERE clause.
+func parseUpdateStatement(query string) (string, []string, string, bool) {
+	if !strings.HasPrefix(query, "UPDATE ") {
+		return "", nil, "", false
+	}
+	tblSplit := strings.SplitN(strings.TrimPrefix(query, "UPDATE "), " SET ", 2)
+	if len(tblSplit) != 2 {
+		return "", nil, "", false
+	}
+	whereSplit := strings.SplitN(tblSplit[1], " WHERE ", 2)
+	if len(whereSplit) != 2 {
+		return "", nil, "", false
+	}
+	cols := strings.Split(whereSplit[0], ",")
+	for i := range cols {
+		cols[i] = strings.TrimSuffix(strings.TrimSpace(cols[i]), "=?")
+	}
+	return tblSplit[0], cols, whereSplit[1], true
+}
+
+// Read the rows matched by the WHERE clause and compare the first with the new column values.
+// The number of matching rows is returned alongside a description of each changed column.
+func (r *dryRunRecorder) diffRow(ctx context.Context, table string, cols []string,
+	vals []interface{}, where string, whereArgs []interface{},
+) ([]string, int64, error) {
+	selectCols := "1"
+	if len(cols) > 0 {
+		selectCols = strings.Join(cols, ",")
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", selectCols, table, where)
+	rows, err := r.db.QueryContext(ctx, query, whereArgs...)
+	if err != nil {
+		return nil, 0, errors.Wrapf(dbError{
+			error:     err,
+			name:      table,
+			statement: query,
+		}, "dry run reading current row")
+	}
+	defer rows.Close()
+	diff := []string{}
+	var count int64
+	for ; rows.Next(); count++ {
+		if count > 0 || len(cols) == 0 {
+			continue
+		}
+		current := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range current {
+			ptrs[i] = &current[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, 0, errors.Wrapf(err, "dry run scanning current row")
+		}
+		for i, col := range cols {
+			if oldVal, newVal := dryRunValue(current[i]), dryRunValue(vals[i]); oldVal != newVal {
+				diff = append(diff, fmt.Sprintf("%s: %s -> %s", col, oldVal, newVal))
+			}
+		}
+	}
+	return diff, count, nil
+}
+
+// Convert a DB or statement value to a string for printing and comparison.
+func dryRunValue(v interface{}) string {
+	if valuer, ok := v.(driver.Valuer); ok {
+		if dv, err := valuer.Value(); err == nil {
+			v = dv
+		}
+	}
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return fmt.Sprintf("%q", strings.TrimSpace(string(val)))
+	case time.Time:
+		return val.Format("2006-01-02 15:04:05")
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+		// Custom string types (e.g. JobType) are compared with the trimmed DB CHAR value
+		return fmt.Sprintf("%q", strings.TrimSpace(rv.String()))
+	}
+	return fmt.Sprint(v)
+}
+
+// Describe all statements recorded for an activation.
+func (r *dryRunRecorder) report(activation *linkActivationDB) string {
+	report := strings.Builder{}
+	report.WriteString(fmt.Sprintf("Dry run for %s:\n", runError{activation: activation}.String()))
+	if len(r.statements) == 0 {
+		report.WriteString("  No statements\n")
+	}
+	for _, stmt := range r.statements {
+		report.WriteString(fmt.Sprintf("  %s\n", stmt.query))
+		args := make([]string, 0, len(stmt.args))
+		for _, arg := range stmt.args {
+			args = append(args, dryRunValue(arg))
+		}
+		report.WriteString(fmt.Sprintf("    args: [%s]\n", strings.Join(args, ", ")))
+		if strings.HasPrefix(stmt.query, "INSERT ") {
+			continue
+		} else if stmt.rowCount == 0 {
+			report.WriteString("    no matching rows\n")
+		} else if len(stmt.diff) == 0 && strings.HasPrefix(stmt.query, "UPDATE ") {
+			report.WriteString("    no changes\n")
+		}
+		for _, line := range stmt.diff {
+			report.WriteString(fmt.Sprintf("    %s\n", line))
+		}
+	}
+	for _, w := range activation.warnings {
+		report.WriteString(fmt.Sprintf("  Warning: %s\n", w))
+	}
+	return report.String()
+}
+
+// Run a single sync cycle with writes recorded and printed rather than being sent to the DB.
+func runDryRun() {
+	if db, closefunc, err := setup(); err != nil {
+		log.Fatalf("Cannot connect to DB: %v", err)
+	} else {
+		defer closefunc()
+		for _, err := range run(db) {
+			log.Printf("Dry run failure: %+v", err)
+		}
+	}
+}
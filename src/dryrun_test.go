@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpdateStatement(t *testing.T) {
+	table, cols, where, ok := parseUpdateStatement(
+		"UPDATE DUTYJOBS SET JOBTIMEOUT=?,JOBSEAS=? WHERE JOBTIMEOUT=? AND JOBDUTYVESSELNAME=?")
+	assert.True(t, ok)
+	assert.Equal(t, "DUTYJOBS", table)
+	assert.Equal(t, []string{"JOBTIMEOUT", "JOBSEAS"}, cols)
+	assert.Equal(t, "JOBTIMEOUT=? AND JOBDUTYVESSELNAME=?", where)
+
+	_, _, _, ok = parseUpdateStatement("INSERT INTO DUTYJOBS (JOBSEAS) VALUES (?)")
+	assert.False(t, ok)
+}
+
+func TestDryRunValue(t *testing.T) {
+	assert.Equal(t, "NULL", dryRunValue(nil))
+	assert.Equal(t, `"Calm"`, dryRunValue("Calm      "))
+	assert.Equal(t, `"Calm"`, dryRunValue(SeaStateEnum("Calm")))
+	assert.Equal(t, `"text"`, dryRunValue([]byte("text")))
+	assert.Equal(t, "56", dryRunValue(IntString(56)))
+	assert.Equal(t, "56", dryRunValue(float64(56)))
+	assert.Equal(t, "2022-01-01 06:00:35",
+		dryRunValue(CustomJSONTime(getTimeFromAEST(t, "2022-01-01T06:00:35+10:00"))))
+}
+
+func TestDryRunRecorderInsert(t *testing.T) {
+	recorder := &dryRunRecorder{}
+	result, err := recorder.ExecContext(context.Background(),
+		"INSERT INTO DUTYJOBSCREW (CREWJOBSEQUENCE,SKIPPER) VALUES (?,?)", 4, CustomBool("Y"))
+	assert.Nil(t, err)
+	count, err := result.RowsAffected()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, 1, len(recorder.statements))
+
+	report := recorder.report(&linkActivationDB{ID: 42, warnings: []string{"no usable position"}})
+	assert.Contains(t, report, "Dry run for activation 42")
+	assert.Contains(t, report, "  INSERT INTO DUTYJOBSCREW (CREWJOBSEQUENCE,SKIPPER) VALUES (?,?)\n")
+	assert.Contains(t, report, `    args: [4, "Y"]`)
+	assert.Contains(t, report, "  Warning: no usable position\n")
+}
+
+func TestDryRunRejectsCommands(t *testing.T) {
+	dryRun = true
+	defer func() { dryRun = false }()
+	for _, cmd := range []string{"backfill", "cancelled", "retry", "checkpoint"} {
+		err := runCommand([]string{cmd})
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "-dry-run")
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	exportGPX     = "gpx"
+	exportKML     = "kml"
+	exportGeoJSON = "geojson"
+
+	// Where the track of each job is read from
+	exportFromStore     = "store" // The VMRSYNC_JOBTRACK table
+	exportFromTripWatch = "tripwatch"
+)
+
+// A synced job with its position and track, ready to be written out.
+type exportJob struct {
+	TripWatchID int
+	JobID       int
+	Start       time.Time
+	Type        string
+	Vessel      string
+	Crew        []string
+	Pos         GPS // The position written to DUTYJOBS
+	Track       []trackPoint
+}
+
+// Write the positions and tracks of synced jobs as GPX, KML or GeoJSON so they can be replayed
+// on a chart.
+func exportCommand(args []string) error {
+	const DATEFMT = "2006-01-02"
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", exportGeoJSON, "Output format: gpx, kml or geojson")
+	id := fs.Int("id", 0, "Export the job for this TripWatch activation ID")
+	from := fs.String("from", "", "First day of jobs to export (YYYY-MM-DD)")
+	to := fs.String("to", "", "Last day of jobs to export (YYYY-MM-DD)")
+	source := fs.String("source", exportFromStore,
+		"Read tracks from the job track table (store) or from TripWatch sitreps (tripwatch)")
+	out := fs.String("out", "", "Write to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "export flags")
+	} else if *format != exportGPX && *format != exportKML && *format != exportGeoJSON {
+		return errors.Errorf("export format '%s' should be gpx, kml or geojson", *format)
+	} else if *source != exportFromStore && *source != exportFromTripWatch {
+		return errors.Errorf("export source '%s' should be store or tripwatch", *source)
+	} else if (*id == 0) == (*from == "" && *to == "") {
+		return errors.Errorf("export needs either -id, or -from and -to")
+	}
+	// Dates are given in local (AEST) time, which is also how job times are stored.
+	tz := time.FixedZone("UTC+10", 10*60*60)
+	var fromTS, toTS time.Time
+	if *id == 0 {
+		if ts, err := time.ParseInLocation(DATEFMT, *from, tz); err != nil {
+			return errors.Wrapf(err, "export parsing -from date")
+		} else {
+			fromTS = ts
+		}
+		if ts, err := time.ParseInLocation(DATEFMT, *to, tz); err != nil {
+			return errors.Wrapf(err, "export parsing -to date")
+		} else if ts.Before(fromTS) {
+			return errors.Errorf("export -to date is before -from date")
+		} else {
+			toTS = ts.Add(24 * time.Hour)
+		}
+	}
+	if err := parseConfig(configFilePath); err != nil {
+		return errors.Wrapf(err, "export config parsing")
+	}
+	db, err := openDB()
+	if err != nil {
+		return errors.Wrapf(err, "export opening DB")
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	jobs, err := findExportJobs(ctx, db, *id, fromTS, toTS)
+	if err != nil {
+		return errors.Wrapf(err, "export")
+	}
+	for i := range jobs {
+		if crew, err := pullMembersOnJob(ctx, db, jobs[i].JobID); err != nil {
+			return errors.Wrapf(err, "export crew for job %d", jobs[i].JobID)
+		} else {
+			for _, member := range crew {
+				if member.IsMaster.AsBool() {
+					jobs[i].Crew = append(jobs[i].Crew, member.email+" (skipper)")
+				} else {
+					jobs[i].Crew = append(jobs[i].Crew, member.email)
+				}
+			}
+		}
+		if *source == exportFromTripWatch {
+			if sitreps, err := getSitrepsForActivation(ctx, jobs[i].TripWatchID); err != nil {
+				return errors.Wrapf(err, "export track for activation %d", jobs[i].TripWatchID)
+			} else {
+				jobs[i].Track = jobTrack(&linkActivationDB{ID: jobs[i].TripWatchID, Sitreps: sitreps},
+					jobs[i].JobID)
+			}
+		} else if track, err := readJobTrack(ctx, db, jobs[i].JobID); err != nil {
+			return errors.Wrapf(err, "export track for activation %d", jobs[i].TripWatchID)
+		} else {
+			jobs[i].Track = track
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return errors.Wrapf(err, "export creating %s", *out)
+		}
+		defer file.Close()
+		w = file
+	}
+	switch *format {
+	case exportGPX:
+		err = writeGPX(w, jobs)
+	case exportKML:
+		err = writeKML(w, jobs)
+	default:
+		err = writeGeoJSON(w, jobs)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "export writing %s", *format)
+	}
+	if *out != "" {
+		fmt.Printf("Exported %d jobs to %s\n", len(jobs), *out)
+	}
+	return nil
+}
+
+// Times are stored in AEST without a timezone, so the driver's timezone is replaced.
+func aestWallClock(t time.Time) time.Time {
+	tz := time.FixedZone("UTC+10", 10*60*60)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), tz)
+}
+
+// Find the synced jobs for an activation, or the ones which departed in a time range.
+func findExportJobs(ctx context.Context, db dbExecutor, id int, from, to time.Time) ([]exportJob, error) {
+	stmt := "SELECT L.TRIPWATCH_ID,J.JOBJOBSEQUENCE,J.JOBTIMEOUT,J.JOBTYPE,J.JOBDUTYVESSELNAME," +
+		"J.JOBLATDEC,J.JOBLONDEC FROM " + linkTableName + " L INNER JOIN " + jobTableName + " J" +
+		" ON J.JOBDUTYSEQUENCE=L.JOBDUTYSEQUENCE AND J.JOBJOBSEQUENCE=L.JOBJOBSEQUENCE"
+	args := []interface{}{}
+	if id != 0 {
+		stmt += " WHERE L.TRIPWATCH_ID=?"
+		args = append(args, id)
+	} else {
+		stmt += " WHERE J.JOBTIMEOUT>=? AND J.JOBTIMEOUT<? ORDER BY J.JOBTIMEOUT"
+		args = append(args, from, to)
+	}
+	if rows, err := db.QueryContext(ctx, stmt, args...); err != nil {
+		return nil, errors.Wrapf(dbError{
+			error:     err,
+			name:      jobTableName,
+			statement: stmt,
+		}, "find jobs to export")
+	} else {
+		defer rows.Close()
+		jobs := []exportJob{}
+		for rows.Next() {
+			job := exportJob{}
+			var start sql.NullTime
+			var jobType, vessel sql.NullString
+			var lat, long sql.NullFloat64
+			if err := rows.Scan(&job.TripWatchID, &job.JobID, &start, &jobType, &vessel,
+				&lat, &long); err != nil {
+				return nil, errors.Wrapf(dbError{
+					error:     err,
+					name:      jobTableName,
+					statement: stmt,
+				}, "find jobs to export reading row")
+			}
+			if start.Valid {
+				job.Start = aestWallClock(start.Time)
+			}
+			job.Type = strings.TrimSpace(jobType.String)
+			job.Vessel = strings.TrimSpace(vessel.String)
+			job.Pos = GPS{Lat: lat.Float64, Long: long.Float64}
+			jobs = append(jobs, job)
+		}
+		return jobs, nil
+	}
+}
+
+// Read a job's track from the job track table, in the order it was reported.
+func readJobTrack(ctx context.Context, db dbExecutor, jobID int) ([]trackPoint, error) {
+	stmt := "SELECT SITREP_ID,TRIPWATCH_ID,REPORTED,LATITUDE,LONGITUDE,SPEED,HEADING,NOTE,AUTHOR" +
+		" FROM " + jobTrackTableName + " WHERE JOBJOBSEQUENCE=? ORDER BY REPORTED,SITREP_ID"
+	if rows, err := db.QueryContext(ctx, stmt, jobID); err != nil {
+		return nil, errors.Wrapf(dbError{
+			error:     err,
+			name:      jobTrackTableName,
+			statement: stmt,
+		}, "read track for job %d", jobID)
+	} else {
+		defer rows.Close()
+		track := []trackPoint{}
+		for rows.Next() {
+			point := trackPoint{JobID: jobID}
+			var reported sql.NullTime
+			var speed, heading sql.NullFloat64
+			var note, author sql.NullString
+			if err := rows.Scan(&point.SitrepID, &point.TripWatchID, &reported, &point.Lat,
+				&point.Long, &speed, &heading, &note, &author); err != nil {
+				return nil, errors.Wrapf(dbError{
+					error:     err,
+					name:      jobTrackTableName,
+					statement: stmt,
+				}, "read track for job %d reading row", jobID)
+			}
+			if reported.Valid {
+				point.Reported = CustomJSONTime(aestWallClock(reported.Time))
+			}
+			point.Speed = speed.Float64
+			point.Heading = heading.Float64
+			point.Note = note.String
+			point.Author = author.String
+			track = append(track, point)
+		}
+		return track, nil
+	}
+}
+
+func (job exportJob) name() string {
+	return fmt.Sprintf("Activation %d", job.TripWatchID)
+}
+
+// A one line summary of the job, e.g. "Tow, MR2, 2022-01-08 08:00 AEST, crew: a@b (skipper)".
+func (job exportJob) description() string {
+	parts := []string{}
+	for _, s := range []string{job.Type, job.Vessel} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if !job.Start.IsZero() {
+		tz := time.FixedZone("UTC+10", 10*60*60)
+		parts = append(parts, job.Start.In(tz).Format("2006-01-02 15:04")+" AEST")
+	}
+	if len(job.Crew) > 0 {
+		parts = append(parts, "crew: "+strings.Join(job.Crew, ", "))
+	}
+	if !job.Pos.IsZero() {
+		parts = append(parts, "position: "+job.Pos.DMSString())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// A one line summary of a sitrep, e.g. "radio@mrq.org.au: Underway (12.5 kn, heading 270)".
+func (point trackPoint) description() string {
+	desc := point.Note
+	if point.Author != "" {
+		desc = point.Author + ": " + desc
+	}
+	if point.Speed != 0 || point.Heading != 0 {
+		desc += fmt.Sprintf(" (%g kn, heading %g)", point.Speed, point.Heading)
+	}
+	return desc
+}
+
+func exportTime(t CustomJSONTime) string {
+	if time.Time(t).IsZero() {
+		return ""
+	}
+	return time.Time(t).UTC().Format(time.RFC3339)
+}
+
+type gpxFile struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	Xmlns     string     `xml:"xmlns,attr"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	Tracks    []gpxTrack `xml:"trk"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time,omitempty"`
+	Name string  `xml:"name,omitempty"`
+	Desc string  `xml:"desc,omitempty"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name"`
+	Desc     string       `xml:"desc,omitempty"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+// Write each job's position as a GPX waypoint and its sitreps as a track.
+func writeGPX(w io.Writer, jobs []exportJob) error {
+	gpx := gpxFile{Xmlns: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: "vmrsync"}
+	for _, job := range jobs {
+		if !job.Pos.IsZero() {
+			gpx.Waypoints = append(gpx.Waypoints, gpxPoint{
+				Lat:  job.Pos.Lat,
+				Lon:  job.Pos.Long,
+				Name: job.name(),
+				Desc: job.description(),
+			})
+		}
+		if len(job.Track) == 0 {
+			continue
+		}
+		segment := gpxSegment{}
+		for _, point := range job.Track {
+			segment.Points = append(segment.Points, gpxPoint{
+				Lat:  point.Lat,
+				Lon:  point.Long,
+				Time: exportTime(point.Reported),
+				Desc: point.description(),
+			})
+		}
+		gpx.Tracks = append(gpx.Tracks, gpxTrack{
+			Name:     job.name(),
+			Desc:     job.description(),
+			Segments: []gpxSegment{segment},
+		})
+	}
+	return writeXML(w, gpx)
+}
+
+type kmlFile struct {
+	XMLName  xml.Name    `xml:"kml"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Name    string      `xml:"name"`
+	Folders []kmlFolder `xml:"Folder"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name         string           `xml:"name"`
+	Description  string           `xml:"description,omitempty"`
+	TimeStamp    *kmlTimeStamp    `xml:"TimeStamp,omitempty"`
+	ExtendedData *kmlExtendedData `xml:"ExtendedData,omitempty"`
+	Point        *kmlGeometry     `xml:"Point,omitempty"`
+	LineString   *kmlGeometry     `xml:"LineString,omitempty"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlExtendedData struct {
+	Data []kmlData `xml:"Data"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlGeometry struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// KML coordinates are longitude,latitude.
+func kmlCoordinates(positions ...GPS) string {
+	coords := make([]string, 0, len(positions))
+	for _, pos := range positions {
+		coords = append(coords, fmt.Sprintf("%g,%g", pos.Long, pos.Lat))
+	}
+	return strings.Join(coords, " ")
+}
+
+// Write a KML folder for each job, with placemarks for the job position and each sitrep and a
+// line joining the sitreps.
+func writeKML(w io.Writer, jobs []exportJob) error {
+	kml := kmlFile{Xmlns: "http://www.opengis.net/kml/2.2", Document: kmlDocument{Name: "vmrsync export"}}
+	for _, job := range jobs {
+		folder := kmlFolder{Name: job.name()}
+		data := &kmlExtendedData{Data: []kmlData{
+			{Name: "tripwatch_id", Value: fmt.Sprint(job.TripWatchID)},
+			{Name: "job_id", Value: fmt.Sprint(job.JobID)},
+			{Name: "type", Value: job.Type},
+			{Name: "vessel", Value: job.Vessel},
+			{Name: "crew", Value: strings.Join(job.Crew, ", ")},
+		}}
+		if !job.Pos.IsZero() {
+			folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+				Name:         job.name(),
+				Description:  job.description(),
+				ExtendedData: data,
+				Point:        &kmlGeometry{Coordinates: kmlCoordinates(job.Pos)},
+			})
+		}
+		positions := make([]GPS, 0, len(job.Track))
+		for _, point := range job.Track {
+			pos := GPS{Lat: point.Lat, Long: point.Long}
+			positions = append(positions, pos)
+			placemark := kmlPlacemark{
+				Name:        fmt.Sprintf("Sitrep %d", point.SitrepID),
+				Description: point.description(),
+				Point:       &kmlGeometry{Coordinates: kmlCoordinates(pos)},
+			}
+			if when := exportTime(point.Reported); when != "" {
+				placemark.TimeStamp = &kmlTimeStamp{When: when}
+			}
+			folder.Placemarks = append(folder.Placemarks, placemark)
+		}
+		if len(positions) > 1 {
+			folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+				Name:         job.name() + " track",
+				Description:  job.description(),
+				ExtendedData: data,
+				LineString:   &kmlGeometry{Coordinates: kmlCoordinates(positions...)},
+			})
+		}
+		kml.Document.Folders = append(kml.Document.Folders, folder)
+	}
+	return writeXML(w, kml)
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return errors.Wrapf(err, "write XML header")
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return errors.Wrapf(err, "write XML")
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return errors.Wrapf(err, "write XML")
+	}
+	return nil
+}
+
+// Write a GeoJSON FeatureCollection with a Point feature for each job position and a
+// LineString feature for each track. The job details are given as properties of both, and the
+// track's sitrep times and notes as lists alongside its coordinates.
+func writeGeoJSON(w io.Writer, jobs []exportJob) error {
+	var err error
+	collection := geoJSON{Type: "FeatureCollection", Features: []geoJSON{}}
+	feature := func(geomType string, coords interface{}, props map[string]interface{}) error {
+		raw, err := json.Marshal(coords)
+		if err != nil {
+			return errors.Wrapf(err, "write GeoJSON coordinates")
+		}
+		collection.Features = append(collection.Features, geoJSON{
+			Type:       "Feature",
+			Geometry:   &geoJSON{Type: geomType, Coordinates: raw},
+			Properties: props,
+		})
+		return nil
+	}
+	for _, job := range jobs {
+		props := func() map[string]interface{} {
+			p := map[string]interface{}{
+				"tripwatch_id": job.TripWatchID,
+				"job_id":       job.JobID,
+				"type":         job.Type,
+				"vessel":       job.Vessel,
+				"crew":         job.Crew,
+			}
+			if !job.Start.IsZero() {
+				p["start"] = job.Start.Format(time.RFC3339)
+			}
+			return p
+		}
+		if !job.Pos.IsZero() {
+			p := props()
+			p["position_dms"] = job.Pos.DMSString()
+			if err := feature("Point", []float64{job.Pos.Long, job.Pos.Lat}, p); err != nil {
+				return err
+			}
+		}
+		if len(job.Track) == 0 {
+			continue
+		}
+		coords := make([][]float64, 0, len(job.Track))
+		times := make([]string, 0, len(job.Track))
+		notes := make([]string, 0, len(job.Track))
+		for _, point := range job.Track {
+			coords = append(coords, []float64{point.Long, point.Lat})
+			times = append(times, exportTime(point.Reported))
+			notes = append(notes, point.description())
+		}
+		p := props()
+		p["times"] = times
+		p["notes"] = notes
+		if len(coords) == 1 {
+			// A line needs at least two positions
+			err = feature("Point", coords[0], p)
+		} else {
+			err = feature("LineString", coords, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(collection); err != nil {
+		return errors.Wrapf(err, "write GeoJSON")
+	}
+	return nil
+}
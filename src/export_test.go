@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testExportJobs(t *testing.T) []exportJob {
+	return []exportJob{{
+		TripWatchID: 42,
+		JobID:       7,
+		Start:       getTimeFromAEST(t, "2022-09-17T12:20:00+10:00"),
+		Type:        "Tow",
+		Vessel:      "MR2",
+		Crew:        []string{"skipper@mrq.org.au (skipper)", "crew@mrq.org.au"},
+		Pos:         GPS{-27.475458, 153.153261},
+		Track: []trackPoint{
+			{SitrepID: 101, Reported: CustomJSONTime(getTime(t, "2022-09-17T02:24:21Z")),
+				Lat: -27.96, Long: 153.42, Speed: 12.5, Heading: 270, Note: "Underway",
+				Author: "radio@mrq.org.au"},
+			{SitrepID: 102, Reported: CustomJSONTime(getTime(t, "2022-09-17T02:40:00Z")),
+				Lat: -27.475458, Long: 153.153261, Note: "RV has arrived at target"},
+		},
+	}, {
+		TripWatchID: 43,
+		JobID:       8,
+		Type:        "Medical",
+	}}
+}
+
+func TestExportDescription(t *testing.T) {
+	jobs := testExportJobs(t)
+	assert.Equal(t, "Tow, MR2, 2022-09-17 12:20 AEST, crew: skipper@mrq.org.au (skipper), "+
+		`crew@mrq.org.au, position: 27°28'31.6"S 153°09'11.7"E`, jobs[0].description())
+	assert.Equal(t, "Medical", jobs[1].description())
+	assert.Equal(t, "radio@mrq.org.au: Underway (12.5 kn, heading 270)", jobs[0].Track[0].description())
+	assert.Equal(t, "RV has arrived at target", jobs[0].Track[1].description())
+}
+
+func TestWriteGPX(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, writeGPX(buf, testExportJobs(t)))
+	gpx := gpxFile{}
+	assert.Nil(t, xml.Unmarshal(buf.Bytes(), &gpx))
+	assert.Equal(t, "1.1", gpx.Version)
+	assert.Len(t, gpx.Waypoints, 1)
+	assert.Equal(t, "Activation 42", gpx.Waypoints[0].Name)
+	assert.Len(t, gpx.Tracks, 1)
+	assert.Equal(t, []gpxPoint{
+		{Lat: -27.96, Lon: 153.42, Time: "2022-09-17T02:24:21Z",
+			Desc: "radio@mrq.org.au: Underway (12.5 kn, heading 270)"},
+		{Lat: -27.475458, Lon: 153.153261, Time: "2022-09-17T02:40:00Z", Desc: "RV has arrived at target"},
+	}, gpx.Tracks[0].Segments[0].Points)
+}
+
+func TestWriteKML(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, writeKML(buf, testExportJobs(t)))
+	kml := kmlFile{}
+	assert.Nil(t, xml.Unmarshal(buf.Bytes(), &kml))
+	assert.Len(t, kml.Document.Folders, 2)
+	placemarks := kml.Document.Folders[0].Placemarks
+	assert.Len(t, placemarks, 4)
+	assert.Equal(t, "153.153261,-27.475458", placemarks[0].Point.Coordinates)
+	assert.Contains(t, placemarks[0].ExtendedData.Data, kmlData{Name: "vessel", Value: "MR2"})
+	assert.Equal(t, "Sitrep 101", placemarks[1].Name)
+	assert.Equal(t, "2022-09-17T02:24:21Z", placemarks[1].TimeStamp.When)
+	assert.Equal(t, "153.42,-27.96 153.153261,-27.475458", placemarks[3].LineString.Coordinates)
+	// The second job has no position or track
+	assert.Empty(t, kml.Document.Folders[1].Placemarks)
+}
+
+func TestWriteGeoJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	jobs := testExportJobs(t)
+	jobs[1].Track = jobs[0].Track[:1]
+	assert.Nil(t, writeGeoJSON(buf, jobs))
+	collection := struct {
+		Type     string
+		Features []struct {
+			Type     string
+			Geometry struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+			Properties map[string]interface{}
+		}
+	}{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &collection))
+	assert.Equal(t, "FeatureCollection", collection.Type)
+	assert.Len(t, collection.Features, 3)
+
+	point := collection.Features[0]
+	assert.Equal(t, "Point", point.Geometry.Type)
+	assert.JSONEq(t, "[153.153261,-27.475458]", string(point.Geometry.Coordinates))
+	assert.Equal(t, map[string]interface{}{
+		"tripwatch_id": 42.0,
+		"job_id":       7.0,
+		"type":         "Tow",
+		"vessel":       "MR2",
+		"crew":         []interface{}{"skipper@mrq.org.au (skipper)", "crew@mrq.org.au"},
+		"start":        jobs[0].Start.Format(time.RFC3339),
+		"position_dms": `27°28'31.6"S 153°09'11.7"E`,
+	}, point.Properties)
+
+	line := collection.Features[1]
+	assert.Equal(t, "LineString", line.Geometry.Type)
+	assert.JSONEq(t, "[[153.42,-27.96],[153.153261,-27.475458]]", string(line.Geometry.Coordinates))
+	assert.Equal(t, []interface{}{"2022-09-17T02:24:21Z", "2022-09-17T02:40:00Z"}, line.Properties["times"])
+
+	// A single sitrep is a point rather than a line
+	assert.Equal(t, "Point", collection.Features[2].Geometry.Type)
+	assert.JSONEq(t, "[153.42,-27.96]", string(collection.Features[2].Geometry.Coordinates))
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"log"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/mfitzpatrick/vmrsync/src/forecast"
 	"github.com/pkg/errors"
 )
 
@@ -34,16 +39,61 @@ func (e dbError) Error() string {
 	return fmt.Sprintf("%s: %s", e.String(), e.error.Error())
 }
 
+// The subset of the database/sql API used to read from and write to Firebird. This is
+// satisfied by *sql.DB as well as by the dry-run recorder.
+type dbExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Implemented by *sql.DB, which allows a set of writes to be grouped into one transaction.
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Run fn inside a DB transaction. The transaction is committed if fn succeeds and rolled back
+// if it returns an error.
+func withTx(ctx context.Context, db txBeginner, opts *sql.TxOptions, fn func(tx dbExecutor) error) error {
+	if tx, err := db.BeginTx(ctx, opts); err != nil {
+		return errors.Wrapf(err, "begin transaction")
+	} else if err := fn(tx); err != nil {
+		if rberr := tx.Rollback(); rberr != nil {
+			return errors.Wrapf(err, "transaction rollback also failed (%v)", rberr)
+		}
+		return err
+	} else if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "commit transaction")
+	}
+	return nil
+}
+
 type column struct {
 	name       string
 	isMatch    bool
 	isSequence bool
+	writeEmpty bool // Write zero and nil values rather than skipping them
+	isLog      bool // Merged with the DB value rather than replacing it
 	maxStrlen  int
 	value      interface{}
 }
 
 type firebirdColHandler func(tableName string, col column) error
 
+// Struct types which are written to a single column rather than being nested tables.
+func isColumnStruct(t reflect.Type) bool {
+	return t == reflect.TypeOf(time.Time{}) || t.Implements(reflect.TypeOf((*driver.Valuer)(nil)).Elem())
+}
+
+// Kinds of value which can be written to a column.
+func isColumnKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Chan, reflect.Func,
+		reflect.Interface, reflect.Ptr, reflect.UnsafePointer:
+		return false
+	}
+	return true
+}
+
 // Recursive function which will call the handler function for each item in the struct.
 func forEachColumn(tableName string, obj reflect.Value, handler firebirdColHandler) error {
 	if obj.Type().Kind() != reflect.Struct {
@@ -74,7 +124,7 @@ func forEachColumn(tableName string, obj reflect.Value, handler firebirdColHandl
 				maxStrlen = int(l)
 			}
 		}
-		if structVal.Kind() == reflect.Struct && structVal.Type() != reflect.TypeOf(CustomJSONTime{}) {
+		if structVal.Kind() == reflect.Struct && !isColumnStruct(structVal.Type()) {
 			// This references a nested struct. Call this function recursively.
 			nestedTable := tableName
 			if firebirdTag != "" {
@@ -85,6 +135,9 @@ func forEachColumn(tableName string, obj reflect.Value, handler firebirdColHandl
 			}
 		} else if firebirdTag == "" {
 			continue //Nothing here matches with the firebird DB
+		} else if !isColumnKind(structVal.Kind()) {
+			return errors.Errorf("firebird column %s.%s has unsupported kind %v",
+				tableName, firebirdTag, structVal.Kind())
 		} else if err := handler(tableName, column{
 			name:       firebirdTag,
 			isMatch:    isMatch,
@@ -98,8 +151,78 @@ func forEachColumn(tableName string, obj reflect.Value, handler firebirdColHandl
 	return nil
 }
 
+func tableExists(ctx context.Context, db dbExecutor, tableName string) (bool, error) {
+	const STMT = "SELECT COUNT(*) FROM RDB$RELATIONS WHERE RDB$RELATION_NAME=?"
+	var count int
+	if rows, err := db.QueryContext(ctx, STMT, tableName); err != nil {
+		return false, errors.Wrapf(dbError{
+			error:     err,
+			name:      "RDB$RELATIONS",
+			statement: STMT,
+		}, "finding table %s", tableName)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			if err := rows.Scan(&count); err != nil {
+				return false, errors.Wrapf(err, "scanning table count for %s", tableName)
+			}
+		}
+	}
+	return count > 0, nil
+}
+
+// Create a table from the DDL statement if it doesn't already exist.
+func ensureTable(ctx context.Context, db dbExecutor, tableName, ddl string) error {
+	if exists, err := tableExists(ctx, db, tableName); err != nil {
+		return errors.Wrapf(err, "ensure table")
+	} else if exists {
+		return nil
+	} else if _, err := db.ExecContext(ctx, ddl); err != nil {
+		return errors.Wrapf(dbError{
+			error:     err,
+			name:      tableName,
+			statement: ddl,
+		}, "ensure table creating %s", tableName)
+	}
+	return nil
+}
+
+// Tables maintained by this service. Each is created on startup if it doesn't exist, and its
+// ready flag is set once the table can be used.
+var serviceTables = []struct {
+	name  string
+	ddl   string
+	ready *bool
+}{
+	{linkTableName, linkTableDDL, &linkTableReady},
+	{vesselUseTableName, vesselUseTableDDL, &vesselUseTableReady},
+	{snapshotTableName, snapshotTableDDL, &snapshotTableReady},
+	{conflictTableName, conflictTableDDL, &conflictTableReady},
+	{jobTrackTableName, jobTrackTableDDL, &jobTrackTableReady},
+	{jobStatsTableName, jobStatsTableDDL, &jobStatsTableReady},
+}
+
+// Create any service tables which don't exist. During a dry run nothing is created, and only
+// the tables which already exist are used.
+func prepareServiceTables(ctx context.Context, db dbExecutor) error {
+	for _, tbl := range serviceTables {
+		if dryRun {
+			if exists, err := tableExists(ctx, db, tbl.name); err != nil {
+				return errors.Wrapf(err, "prepare service tables")
+			} else {
+				*tbl.ready = exists
+			}
+		} else if err := ensureTable(ctx, db, tbl.name, tbl.ddl); err != nil {
+			return errors.Wrapf(err, "prepare service tables")
+		} else {
+			*tbl.ready = true
+		}
+	}
+	return nil
+}
+
 // Create the update statement and try to execute it against the DB.
-func tryUpdate(ctx context.Context, db *sql.DB, tableName string, columns []column) error {
+func tryUpdate(ctx context.Context, db dbExecutor, tableName string, columns []column) error {
 	colList := make([]string, 0, len(columns))
 	valList := make([]interface{}, 0, len(columns))
 	keyCol := []string{}
@@ -147,30 +270,12 @@ func tryUpdate(ctx context.Context, db *sql.DB, tableName string, columns []colu
 			statement: stmt,
 		}, "trying update no rows affected")
 	}
+	countWrite(db, dbWrites, 1, tableName, "update")
 	return nil
 }
 
 // Create the insert statement and try to execute it against the DB.
-func tryInsert(ctx context.Context, db *sql.DB, tableName string, columns []column) error {
-	getMaxID := func(ctx context.Context, tableName, colName string) (int, error) {
-		maxID := 0
-		// Statement to get the maximum sequence number from the current DB table
-		idStmt := fmt.Sprintf("SELECT MAX(%s) FROM %s", colName, tableName)
-		if rows, err := db.QueryContext(ctx, idStmt); err != nil {
-			return 0, errors.Wrapf(dbError{
-				error:     err,
-				name:      tableName,
-				cols:      []column{{name: colName}},
-				statement: idStmt,
-			}, "insert getting next sequence number")
-		} else if !rows.Next() {
-			return 0, errors.Errorf("insert tx max id rows failed for table %s", tableName)
-		} else if err := rows.Scan(&maxID); err != nil {
-			return 0, errors.Errorf("insert tx max ID scan failed for table %s", tableName)
-		}
-		return maxID, nil
-	}
-
+func tryInsert(ctx context.Context, db dbExecutor, tableName string, columns []column) error {
 	colList := make([]string, 0, len(columns))
 	valList := make([]interface{}, 0, len(columns))
 	var seqCol string
@@ -186,52 +291,83 @@ func tryInsert(ctx context.Context, db *sql.DB, tableName string, columns []colu
 	if len(colList) == 0 {
 		return errors.Errorf("no columns specified for table %s", tableName)
 	}
-	if seqCol != "" {
-		// Get the next logical sequence number for the table
-		if maxID, err := getMaxID(ctx, tableName, seqCol); err != nil {
-			return errors.Wrapf(err, "insert failed to get max sequence number")
-		} else if maxID == 0 {
-			return errors.Wrapf(dbError{
-				error: errors.Errorf("max sequence number is 0"),
-				name:  tableName,
-				cols:  []column{{name: seqCol}},
-			}, "maxID cannot be 0")
-		} else {
-			valList[seqIDX] = maxID + 1
-		}
-	}
 	// Statement to insert the new record
 	insertStmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", tableName,
 		strings.Join(colList, ","),
 		strings.TrimRight(strings.Repeat("?,", len(valList)), ","))
-	// Run DB statements
-	if result, err := db.ExecContext(ctx, insertStmt, valList...); err != nil {
-		return errors.Wrapf(dbError{
-			error:     err,
-			name:      tableName,
-			cols:      columns,
-			statement: insertStmt,
-		}, "insert errored for table %s", tableName)
-	} else if rowCount, err := result.RowsAffected(); err != nil {
-		return errors.Wrapf(dbError{
-			error:     err,
-			name:      tableName,
-			cols:      columns,
-			statement: insertStmt,
-		}, "trying insert can't fetch row count affected")
-	} else if rowCount == int64(0) {
-		// Update failed - row likely doesn't exist yet.
-		return errors.Wrapf(dbError{
-			error:     errors.Errorf("RowsAffected is 0"),
-			name:      tableName,
-			cols:      columns,
-			statement: insertStmt,
-		}, "trying insert no rows affected")
+	insert := func() error {
+		if result, err := db.ExecContext(ctx, insertStmt, valList...); err != nil {
+			return errors.Wrapf(dbError{
+				error:     err,
+				name:      tableName,
+				cols:      columns,
+				statement: insertStmt,
+			}, "insert errored for table %s", tableName)
+		} else if rowCount, err := result.RowsAffected(); err != nil {
+			return errors.Wrapf(dbError{
+				error:     err,
+				name:      tableName,
+				cols:      columns,
+				statement: insertStmt,
+			}, "trying insert can't fetch row count affected")
+		} else if rowCount == int64(0) {
+			// Update failed - row likely doesn't exist yet.
+			return errors.Wrapf(dbError{
+				error:     errors.Errorf("RowsAffected is 0"),
+				name:      tableName,
+				cols:      columns,
+				statement: insertStmt,
+			}, "trying insert no rows affected")
+		}
+		countWrite(db, dbWrites, 1, tableName, "insert")
+		return nil
+	}
+	if seqCol == "" {
+		return insert()
+	}
+	// Get the next logical sequence number for the table. If another writer takes the same
+	// number first, the insert fails with a duplicate key and is retried with a new number.
+	lastID := 0
+	for attempt := 1; ; attempt++ {
+		if id, err := allocateSequence(ctx, db, tableName, seqCol, lastID); err != nil {
+			return errors.Wrapf(err, "insert failed to get next sequence number")
+		} else {
+			valList[seqIDX] = id
+			lastID = id
+		}
+		if err := insert(); err == nil {
+			return nil
+		} else if !isDuplicateKeyError(err) || attempt >= maxInsertAttempts {
+			return errors.Wrapf(err, "insert attempt %d", attempt)
+		}
+	}
+}
+
+// Insert or update a row from the struct's tagged fields. Zero values are skipped unless
+// withZero is set, so that values entered through the VMR desktop app aren't overwritten.
+func upsertRow(ctx context.Context, db dbExecutor, tableName string, row interface{}, withZero bool) error {
+	columns := []column{}
+	if err := forEachColumn(tableName, reflect.ValueOf(row),
+		func(tableName string, col column) error {
+			if col.isMatch || withZero || !reflect.ValueOf(col.value).IsZero() {
+				columns = append(columns, col)
+			}
+			return nil
+		}); err != nil {
+		return errors.Wrapf(err, "fetch col names for table %s", tableName)
+	}
+	var dberr dbError
+	if err := tryUpdate(ctx, db, tableName, columns); err == nil {
+		// This worked. Fall out of the statement chain
+	} else if !errors.As(err, &dberr) {
+		return errors.Wrapf(err, "tryUpdate returned a coding error")
+	} else if err := tryInsert(ctx, db, tableName, columns); err != nil {
+		return errors.Wrapf(err, "insert row for table %s", tableName)
 	}
 	return nil
 }
 
-func getLatestDutyLogEntry(ctx context.Context, db *sql.DB) (DutyLogTable, error) {
+func getLatestDutyLogEntry(ctx context.Context, db dbExecutor) (DutyLogTable, error) {
 	stmt := "SELECT DUTYSEQUENCE,MAX(DUTYDATE),CREW FROM DUTYLOG GROUP BY DUTYSEQUENCE,CREW"
 	if rows, err := db.QueryContext(ctx, stmt); err != nil {
 		return DutyLogTable{}, errors.Wrapf(dbError{
@@ -262,7 +398,45 @@ func getLatestDutyLogEntry(ctx context.Context, db *sql.DB) (DutyLogTable, error
 	}
 }
 
-func findMemberForEmail(ctx context.Context, db *sql.DB, email string) (Member, error) {
+var dutyLogNotFound = errors.Errorf("No duty log entry for date")
+
+// Fetch the DutyLog entry for the day (in local time) of the given timestamp. This is used for
+// activations synced after the fact, which belong to the duty on the day they happened rather
+// than the latest one.
+func getDutyLogEntryFor(ctx context.Context, db dbExecutor, ts time.Time) (DutyLogTable, error) {
+	stmt := "SELECT FIRST 1 DUTYSEQUENCE,DUTYDATE,CREW FROM DUTYLOG WHERE DUTYDATE=?" +
+		" ORDER BY DUTYSEQUENCE DESC"
+	date := ts.In(time.FixedZone("UTC+10", 10*60*60)).Format("2006-01-02")
+	if rows, err := db.QueryContext(ctx, stmt, date); err != nil {
+		return DutyLogTable{}, errors.Wrapf(dbError{
+			error:     err,
+			name:      "DUTYLOG",
+			statement: stmt,
+		}, "duty log entry for %s running DB query", date)
+	} else {
+		defer rows.Close()
+		entry := DutyLogTable{}
+		if !rows.Next() {
+			return DutyLogTable{}, errors.Wrapf(dutyLogNotFound, "duty log entry for %s", date)
+		}
+		var crewName sql.NullString
+		if err := rows.Scan(
+			&entry.DutyLog.ID,
+			&entry.DutyLog.Date,
+			&crewName,
+		); err != nil {
+			return DutyLogTable{}, errors.Wrapf(dbError{
+				error:     err,
+				name:      "DUTYLOG",
+				statement: stmt,
+			}, "duty log entry for %s scanning table columns", date)
+		}
+		entry.DutyLog.CrewName = crewName.String
+		return entry, nil
+	}
+}
+
+func findMemberForEmail(ctx context.Context, db dbExecutor, email string) (Member, error) {
 	stmt := "SELECT MEMBERNOLOCAL FROM MEMBERS WHERE LOWER(EMAILMRQ)=?"
 	if rows, err := db.QueryContext(ctx, stmt, email); err != nil {
 		return Member{}, errors.Wrapf(dbError{
@@ -286,7 +460,7 @@ func findMemberForEmail(ctx context.Context, db *sql.DB, email string) (Member,
 	}
 }
 
-func findRankingForMember(ctx context.Context, db *sql.DB, id int) (int, error) {
+func findRankingForMember(ctx context.Context, db dbExecutor, id int) (int, error) {
 	stmt := "SELECT FIRST 1 CREWRANKING FROM DUTYCREWS WHERE CREWMEMBER=?" +
 		" ORDER BY DUTYSEQUENCE DESC"
 	if rows, err := db.QueryContext(ctx, stmt, id); err != nil {
@@ -311,7 +485,7 @@ func findRankingForMember(ctx context.Context, db *sql.DB, id int) (int, error)
 	}
 }
 
-func pullMemberRecordsByEmail(ctx context.Context, db *sql.DB, dutyCrewID int, email string) (crewInfo, error) {
+func pullMemberRecordsByEmail(ctx context.Context, db dbExecutor, dutyCrewID int, email string) (crewInfo, error) {
 	stmt := "SELECT M.MEMBERNOLOCAL,M.EMAILMRQ,C.DUTYSEQUENCE,C.CREWMEMBER,C.CREWRANKING" +
 		" FROM MEMBERS M INNER JOIN DUTYCREWS C ON M.MEMBERNOLOCAL=C.CREWMEMBER" +
 		" WHERE LOWER(M.EMAILMRQ)=? AND C.DUTYSEQUENCE=?"
@@ -346,7 +520,7 @@ func pullMemberRecordsByEmail(ctx context.Context, db *sql.DB, dutyCrewID int, e
 	}
 }
 
-func pullMembersOnJob(ctx context.Context, db *sql.DB, jobID int) ([]JobCrew, error) {
+func pullMembersOnJob(ctx context.Context, db dbExecutor, jobID int) ([]JobCrew, error) {
 	if rows, err := db.QueryContext(ctx,
 		"SELECT CREWDUTYSEQUENCE,CREWJOBSEQUENCE,CREWMEMBER,CREWRANKING,SKIPPER,EMAILMRQ FROM DUTYJOBSCREW"+
 			" INNER JOIN MEMBERS ON CREWMEMBER=MEMBERNOLOCAL"+
@@ -372,7 +546,7 @@ func pullMembersOnJob(ctx context.Context, db *sql.DB, jobID int) ([]JobCrew, er
 	}
 }
 
-func (crew JobCrew) rmFromDB(ctx context.Context, db *sql.DB) error {
+func (crew JobCrew) rmFromDB(ctx context.Context, db dbExecutor) error {
 	stmt := "DELETE FROM DUTYJOBSCREW WHERE" +
 		" CREWDUTYSEQUENCE=? AND CREWJOBSEQUENCE=? AND CREWMEMBER=?"
 	if crew.DutyCrewID == 0 || crew.JobID == 0 || crew.MemberID == 0 {
@@ -400,31 +574,49 @@ func (crew JobCrew) rmFromDB(ctx context.Context, db *sql.DB) error {
 			statement: stmt,
 		}, "rmMember rows deleted is %d", rowCount)
 	}
+	countWrite(db, crewRows, 1, "removed")
 	return nil
 }
 
-func getJobID(ctx context.Context, db *sql.DB, job Job) (int, error) {
-	query := fmt.Sprintf("SELECT JOBJOBSEQUENCE FROM DUTYJOBS" +
-		" WHERE JOBTIMEOUT=? AND JOBDUTYVESSELNAME=?")
-	if rows, err := db.QueryContext(ctx, query, job.StartTime, job.VMRVessel.Name); err != nil {
-		return 0, errors.Wrapf(err, "fetch job ID for time %s and vessel %s",
-			job.StartTime, job.VMRVessel.Name)
+func getJobID(ctx context.Context, db dbExecutor, job Job) (int, error) {
+	keys, err := jobKeyColumns(&linkActivationDB{Job: job})
+	if err != nil {
+		return 0, errors.Wrapf(err, "get job ID")
+	}
+	_, jobID, err := getJobSequences(ctx, db, keys)
+	return jobID, err
+}
+
+// Find the duty and job sequence numbers of the DUTYJOBS row matching the key columns (by
+// default the departure time and vessel name).
+func getJobSequences(ctx context.Context, db dbExecutor, keys []column) (int, int, error) {
+	var dutyID, jobID int
+	where := make([]string, 0, len(keys))
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		where = append(where, key.name+"=?")
+		args = append(args, key.value)
+	}
+	query := "SELECT JOBDUTYSEQUENCE,JOBJOBSEQUENCE FROM " + jobTableName +
+		" WHERE " + strings.Join(where, " AND ")
+	if rows, err := db.QueryContext(ctx, query, args...); err != nil {
+		return 0, 0, errors.Wrapf(err, "fetch job ID for %v", args)
 	} else {
 		defer rows.Close()
 		if rows.Next() {
-			if err := rows.Scan(&job.ID); err != nil {
-				return 0, errors.Wrapf(err, "fetch job ID row scan")
+			if err := rows.Scan(&dutyID, &jobID); err != nil {
+				return 0, 0, errors.Wrapf(err, "fetch job ID row scan")
 			}
 		}
 		if rows.Next() {
-			return job.ID, errors.Errorf("getJobID returned multiple rows")
+			return dutyID, jobID, errors.Errorf("getJobID returned multiple rows")
 		}
-		return job.ID, nil
+		return dutyID, jobID, nil
 	}
 }
 
 // Add relevant crew to the crew table, linked to the job record
-func addCrewForJob(ctx context.Context, db *sql.DB, job Job) error {
+func addCrewForJob(ctx context.Context, db dbExecutor, job Job) error {
 	const TBL = "DUTYJOBSCREW"
 	addCrew := func(email string, isMaster bool) error {
 		if crew, err := pullMemberRecordsByEmail(ctx, db, job.DutyLogID, email); err != nil &&
@@ -464,6 +656,8 @@ func addCrewForJob(ctx context.Context, db *sql.DB, job Job) error {
 			} else if err := tryInsert(ctx, db, TBL, columns); err != nil {
 				return errors.Wrapf(err, "insert member records for job %d user '%s'",
 					job.ID, email)
+			} else {
+				countWrite(db, crewRows, 1, "added")
 			}
 		}
 		return nil
@@ -523,16 +717,15 @@ func aggregateFields(data *linkActivationDB) error {
 	} else {
 		data.Job.Commercial = "N"
 	}
-	if data.Job.Weather.Forecast != "" {
-		if err := parseForecast(&data.Job.Weather); err != nil {
-			return errors.Wrapf(err, "aggregateFields parsing forecast failed")
-		}
+	if err := parseForecast(data); err != nil {
+		return errors.Wrapf(err, "aggregateFields parsing forecast failed")
 	}
 	if !data.Job.Pos.IsZero() || len(data.Sitreps) > 0 {
 		if err := setGPS(data); err != nil {
 			return errors.Wrapf(err, "aggregateFields parsing latlong")
 		}
 	}
+	aggregateJobStats(data)
 
 	if data.Job.AssistedVessel.Type != "" && data.Job.AssistedVessel.Propulsion != "" {
 		if err := aggregatePropulsion(&data.Job.AssistedVessel); err != nil {
@@ -554,6 +747,10 @@ func aggregateFields(data *linkActivationDB) error {
 		return errors.Wrapf(err, "aggregateJobFreq from aggregateFields")
 	}
 
+	if err := aggregateRisks(data); err != nil {
+		return errors.Wrapf(err, "aggregateFields for risk scores")
+	}
+
 	if err := extendCommentField(data); err != nil {
 		return errors.Wrapf(err, "aggregateFields when extending the comment field")
 	}
@@ -576,61 +773,86 @@ func aggregateJobFreq(data *linkActivationDB) error {
 	return nil
 }
 
-func parseForecast(weather *Weather) error {
+// The coastal waters forecast zone whose weather is written to the job (see parseForecast()).
+const defaultForecastZone = "Gold Coast Waters"
+
+var forecastZone = defaultForecastZone
+
+// Fill in the weather and seas from the start of the configured zone's coastal waters forecast,
+// and parse the tide predictions for the job comments. TripWatch's sea state is kept if set.
+// Tides which can't be parsed are left out of the comments with a warning.
+func parseForecast(data *linkActivationDB) error {
+	job := &data.Job
+	weather := &job.Weather
+	if weather.Tides != "" {
+		tz := time.FixedZone("UTC+10", 10*60*60)
+		tides, skipped := forecast.ParseTides(weather.Tides, tz)
+		for _, tide := range skipped {
+			data.warn("ignoring unrecognised tide '%s'", tide)
+		}
+		weather.tides = tides
+	}
 	if weather.Forecast == "" {
-		return errors.Errorf("parseForecast string cannot be empty")
-	}
-
-	gcwaters := strings.Split(weather.Forecast, "Gold Coast Waters:")
-	if len(gcwaters) < 2 {
-		return errors.Errorf("parseForecast couldn't find GC forecast: %d", len(gcwaters))
-	}
-	for _, line := range strings.Split(gcwaters[1], "\n") {
-		line = strings.ToLower(strings.TrimSpace(line))
-		if strings.Contains(line, "winds:") {
-			// Find mentions of wind directions
-			if strings.Contains(line, "southeasterly") {
-				weather.WindDir = WindDirEnum("SE")
-			} else if strings.Contains(line, "southerly") {
-				weather.WindDir = WindDirEnum("S")
-			} else if strings.Contains(line, "southwesterly") {
-				weather.WindDir = WindDirEnum("SW")
-			} else if strings.Contains(line, "westerly") {
-				weather.WindDir = WindDirEnum("W")
-			} else if strings.Contains(line, "northwesterly") {
-				weather.WindDir = WindDirEnum("NW")
-			} else if strings.Contains(line, "northerly") {
-				weather.WindDir = WindDirEnum("N")
-			} else if strings.Contains(line, "northeasterly") {
-				weather.WindDir = WindDirEnum("NE")
-			} else if strings.Contains(line, "easterly") {
-				weather.WindDir = WindDirEnum("E")
-			}
+		return nil
+	}
 
-			// Parse wind speed
-			knotSplit := strings.Split(line, "knots")
-			fieldsList := strings.Fields(knotSplit[0])
-			speed := fieldsList[len(fieldsList)-1]
-			if val, err := strconv.ParseInt(speed, 10, 32); err != nil {
-				return errors.Wrapf(err, "parse wind speed %s", speed)
-			} else {
-				weather.WindSpeed.Set(int(val))
-			}
-		} else if strings.Contains(line, "weather:") {
-			if strings.Contains(line, "sunny") || strings.Contains(line, "partly cloudy") {
-				weather.RainState = "Clear"
-			} else {
+	zone, ok := forecast.FindZone(forecast.ParseCoastalWaters(weather.Forecast), forecastZone)
+	if !ok {
+		return errors.Errorf("parseForecast couldn't find %s forecast", forecastZone)
+	}
+	if len(zone.Winds) > 0 {
+		wind := zone.Winds[0]
+		if wind.Direction != "" {
+			weather.WindDir = WindDirEnum(wind.Direction)
+		}
+		weather.WindSpeed.Set(int(math.Round(wind.Max)))
+	}
+	if len(zone.Seas) > 0 && job.SeaState == "" {
+		switch height := zone.Seas[0].Max; {
+		case height < 1.25:
+			job.SeaState = SeaStateEnum("Calm")
+		case height < 2.5:
+			job.SeaState = SeaStateEnum("Moderate")
+		default:
+			job.SeaState = SeaStateEnum("Rough")
+		}
+	}
+	if zone.Weather != "" {
+		// The first sentence describes the sky, e.g. "Partly cloudy. 40% chance of showers."
+		sky := strings.ToLower(strings.SplitN(zone.Weather, ".", 2)[0])
+		weather.RainState = "Clear"
+		for _, word := range []string{"rain", "shower", "storm", "drizzle"} {
+			if strings.Contains(sky, word) {
 				weather.RainState = "Rain"
 			}
 		}
 	}
-
 	return nil
 }
 
+// List the tide predictions for the job comments.
+func tideComments(tides []forecast.Tide) string {
+	if len(tides) == 0 {
+		return ""
+	}
+	comment := strings.Builder{}
+	comment.WriteString("Tides:\n")
+	for _, tide := range tides {
+		state := "Low"
+		if tide.High {
+			state = "High"
+		}
+		comment.WriteString(fmt.Sprintf("* %s %.2f m at %s (%s)\n", state, tide.Metres,
+			tide.Time.Format("15:04 Mon 2 Jan"), tide.Station))
+	}
+	comment.WriteString("\n")
+	return comment.String()
+}
+
 // Select a GPS value to set in Firebird by searching through the list of job Sitreps as well as
 // the manually-entered GPS value. The job sitreps will be taken as precedence, and any sitrep
-// where the RV arrives at a target is the main preference.
+// where the RV arrives at a target is the main preference. Each candidate is checked against the
+// operating area (see checkPosition()) and rejected ones are skipped with a warning.
 func setGPS(data *linkActivationDB) error {
 	set := func(gps *FirebirdGPS, pos GPS) error {
 		if dms, err := pos.AsDMS(); err != nil {
@@ -648,56 +870,98 @@ func setGPS(data *linkActivationDB) error {
 		}
 	}
 
-	if sr, err := getEntryForComment(data.Sitreps, "RV has arrived at target"); err == nil {
-		if err := set(&data.Job.FirebirdGPS, sr.Pos); err == nil {
-			return nil
+	// Candidates in order of preference: arriving at the target, taking the vessel in tow, then
+	// the first sitrep with a position, and finally the position entered for the activation.
+	type candidate struct {
+		source string
+		pos    GPS
+	}
+	candidates := []candidate{}
+	for _, comment := range []string{"RV has arrived at target", "Target vessel in tow"} {
+		if sr, err := getEntryForComment(data.Sitreps, comment); err == nil {
+			candidates = append(candidates, candidate{fmt.Sprintf("sitrep %d", sr.ID), sr.Position()})
 		}
 	}
-	if sr, err := getEntryForComment(data.Sitreps, "Target vessel in tow"); err == nil {
-		if err := set(&data.Job.FirebirdGPS, sr.Pos); err == nil {
-			return nil
+	for _, sr := range data.Sitreps {
+		if pos := sr.Position(); !pos.IsZero() {
+			candidates = append(candidates, candidate{fmt.Sprintf("sitrep %d", sr.ID), pos})
 		}
 	}
-	if len(data.Sitreps) > 0 {
-		if err := set(&data.Job.FirebirdGPS, data.Sitreps[0].Pos); err == nil {
+	if !data.Job.Pos.IsZero() {
+		candidates = append(candidates, candidate{"activation position", data.Job.Pos})
+	}
+
+	rejected := map[candidate]bool{}
+	for _, c := range candidates {
+		if rejected[c] {
+			continue
+		} else if pos, swapped, err := checkPosition(c.pos); err != nil {
+			data.warn("ignoring %s: %v", c.source, err)
+			rejected[c] = true
+		} else if err := set(&data.Job.FirebirdGPS, pos); err != nil {
+			return errors.Wrapf(err, "parse GPS setting from %s", c.source)
+		} else {
+			if swapped {
+				data.warn("latitude and longitude of %s were swapped, using %s", c.source, pos)
+			}
 			return nil
 		}
 	}
-	if err := set(&data.Job.FirebirdGPS, data.Job.Pos); err != nil {
-		return errors.Wrapf(err, "parse GPS setting from overall job pos")
+	if len(candidates) > 0 {
+		data.warn("no usable position, latitude and longitude not set")
 	}
-
 	return nil
 }
 
+// Replace the job comments with the TripWatch log. The log is merged with the comments in the
+// DB when the job is written (see mergeSitrepLog()).
 func extendCommentField(data *linkActivationDB) error {
-	comment := strings.Builder{}
-	if _, err := comment.WriteString("[Log entry maintained by TripWatch]\n"); err != nil {
-		return errors.Wrapf(err, "extendCommentField header statement")
-	}
-	if _, err := comment.WriteString(fmt.Sprintf("%s\n\n", strings.TrimSpace(data.Job.Comments))); err != nil {
-		return errors.Wrapf(err, "extendCommentField main body")
-	}
-	for _, sitrep := range data.Sitreps {
-		entry := fmt.Sprintf("* %s AEST: %s\n",
-			sitrep.Updated.AEST().Format("15:04"),
-			strings.TrimSpace(sitrep.Comment))
-		if idx, err := comment.WriteString(entry); err != nil {
-			return errors.Wrapf(err, "extendCommentField sitrep %d", idx)
-		}
-	}
-	data.Job.Comments = comment.String()
+	data.Job.Comments = newSitrepLog(data).String()
 	return nil
 }
 
-func sendToDB(ctx context.Context, db *sql.DB, data *linkActivationDB) error {
+func sendToDB(ctx context.Context, db dbExecutor, data *linkActivationDB) error {
 	// Aggregate any field entries that it is possible to aggregate
 	if err := aggregateFields(data); err != nil {
 		return errors.Wrapf(err, "sendToDB failed to aggregate fields")
 	}
 
-	// Fetch the latest DutyLog table entry
-	if dl, err := getLatestDutyLogEntry(ctx, db); err != nil {
+	// Where possible, write the job and its crew rows in one transaction so that a failure part
+	// way through can't leave a job with partial crew records.
+	if txdb, ok := db.(txBeginner); ok {
+		opts := &sql.TxOptions{}
+		if usesLockedSequences() {
+			opts.Isolation = sql.LevelSerializable
+		}
+		writes := &txWrites{}
+		if err := withTx(ctx, txdb, opts, func(tx dbExecutor) error {
+			writes.dbExecutor = tx
+			return writeActivation(ctx, writes, data)
+		}); err != nil {
+			return errors.Wrapf(err, "sendToDB transaction for activation %d", data.ID)
+		}
+		writes.commit()
+		return nil
+	}
+	return writeActivation(ctx, db, data)
+}
+
+// Write all DB records for an activation whose fields have already been aggregated.
+func writeActivation(ctx context.Context, db dbExecutor, data *linkActivationDB) error {
+	hash := activationHash(*data)
+	// Fetch the latest DutyLog table entry, or for a backfilled activation the entry for the
+	// day it happened
+	getDutyLog := getLatestDutyLogEntry
+	if data.historical {
+		getDutyLog = func(ctx context.Context, db dbExecutor) (DutyLogTable, error) {
+			start := time.Time(data.Job.StartTime)
+			if start.IsZero() {
+				start = time.Time(data.Created)
+			}
+			return getDutyLogEntryFor(ctx, db, start)
+		}
+	}
+	if dl, err := getDutyLog(ctx, db); err != nil {
 		return errors.Wrapf(err, "sendToDB failed to get duty log entry")
 	} else {
 		// We set the DutyLogID field to the latest table entry, but this is
@@ -707,46 +971,144 @@ func sendToDB(ctx context.Context, db *sql.DB, data *linkActivationDB) error {
 	}
 
 	// Build a map of tables that contains the list of columns and associated data
+	schemaTables, err := activeSchema.columns(data)
+	if err != nil {
+		return errors.Wrapf(err, "build all insert statements from schema")
+	}
 	tables := make(map[string][]column)
-	dbObj := reflect.ValueOf(*data)
-	if err := forEachColumn("parent", dbObj, func(tableName string, col column) error {
-		// Truncate string lengths if required
-		if s, ok := col.value.(string); ok {
-			if len(s) > col.maxStrlen {
-				col.value = s[:col.maxStrlen]
+	for tableName, columns := range schemaTables {
+		for _, col := range columns {
+			// Truncate string lengths if required. Logs are fitted when they're merged.
+			if s, ok := col.value.(string); ok && !col.isLog {
+				col.value = truncate(s, col.maxStrlen)
+			}
+			if !col.isSequence && (col.value == nil || reflect.ValueOf(col.value).IsZero()) {
+				if col.isMatch {
+					return errors.Wrapf(matchFieldIsZero, "match field %s.%s cannot be zero",
+						tableName, col.name)
+				} else if !col.writeEmpty {
+					// Don't include values that are the zero-value for that type, unless
+					// TripWatch is allowed to clear the column
+					continue
+				}
 			}
+			tables[tableName] = append(tables[tableName], col)
 		}
-		if !col.isSequence && reflect.ValueOf(col.value).IsZero() {
-			if col.isMatch {
-				return errors.Wrapf(matchFieldIsZero, "match field cannot be zero")
-			} else {
-				// Don't include values that are the zero-value for that type
-				return nil
+	}
+
+	// Jobs which have been synced before are found by their link rather than by matching
+	link, linked := jobLink{}, false
+	if linkTableReady && data.ID != 0 {
+		if link, linked, err = findLink(ctx, db, data.ID); err != nil {
+			return errors.Wrapf(err, "sendToDB finding link")
+		}
+	}
+
+	// Jobs which are locked in the VMR desktop app are left alone. Otherwise the job's current
+	// row shows which columns have been edited in the app since they were last synced.
+	state := jobRowState{}
+	if linkTableReady && data.ID != 0 {
+		existing := link
+		if !linked {
+			if keys, err := jobKeyColumns(data); err != nil {
+				return errors.Wrapf(err, "sendToDB finding existing job")
+			} else if existing.DutyLogID, existing.JobID, err = getJobSequences(ctx, db, keys); err != nil {
+				return errors.Wrapf(err, "sendToDB finding existing job")
 			}
-		} else if _, ok := tables[tableName]; !ok {
-			tables[tableName] = make([]column, 0)
 		}
-		tables[tableName] = append(tables[tableName], col)
-		return nil
-	}); err != nil {
-		return errors.Wrapf(err, "build all insert statements column loop")
+		if existing.JobID == 0 {
+			// A new job
+		} else if state, err = readJobState(ctx, db, data.ID, existing, tables[jobTableName]); err != nil {
+			return errors.Wrapf(err, "sendToDB")
+		} else if state.locked {
+			log.Printf("Job %d is locked, not syncing activation %d", existing.JobID, data.ID)
+			return nil
+		}
+	}
+	// Keep any text added to the job's log columns in the VMR desktop app
+	for i, col := range tables[jobTableName] {
+		if s, ok := col.value.(string); ok && col.isLog {
+			tables[jobTableName][i].value = mergeSitrepLog(dbString(state.current[col.name]), s,
+				col.maxStrlen)
+		}
 	}
 
 	// For each table, synchronise the data with the firebird DB
+	written := []column{}
 	for table, columns := range tables {
 		var dberr dbError
+		if linked && table == jobTableName {
+			owned, conflicts := state.ownedColumns(data.ID, linkedJobColumns(columns, link))
+			if err := tryUpdate(ctx, db, table, owned); err == nil {
+				data.Job.ID = link.JobID
+				written = owned
+				if err := recordConflicts(ctx, db, conflicts); err != nil {
+					return errors.Wrapf(err, "sendToDB")
+				}
+				continue
+			} else if !errors.As(err, &dberr) {
+				return errors.Wrapf(err, "tryUpdate returned a coding error")
+			}
+			// The linked job has been removed from the DB. Fall back to matching.
+			linked = false
+		}
 		// First try an SQL update statement, then if that fails try an SQL INSERT statement.
 		if err := tryUpdate(ctx, db, table, columns); err == nil {
 			// This worked. Move on to the next DB table
+			if table == jobTableName {
+				written = columns
+			}
 			continue
 		} else if !errors.As(err, &dberr) {
 			return errors.Wrapf(err, "tryUpdate returned a coding error")
 		} else if inserr := tryInsert(ctx, db, table, columns); inserr != nil {
 			return errors.Wrapf(inserr, "send to DB insert table %s", table)
 		}
+		if table == jobTableName {
+			written = columns
+		}
+	}
+
+	// The job keeps the duty it was first written to, which may not be the latest one
+	jobDutyID := data.Job.DutyLogID
+	if linkTableReady && data.ID != 0 {
+		if !linked {
+			if keys, err := jobKeyColumns(data); err != nil {
+				return errors.Wrapf(err, "sendToDB finding job to link")
+			} else if dutyID, jobID, err := getJobSequences(ctx, db, keys); err != nil {
+				return errors.Wrapf(err, "sendToDB finding job to link")
+			} else {
+				link = jobLink{DutyLogID: dutyID, JobID: jobID}
+				data.Job.ID = jobID
+			}
+		}
+		if link.DutyLogID != 0 {
+			jobDutyID = link.DutyLogID
+		}
+		link.TripWatchID = data.ID
+		link.LastSynced = now().UTC()
+		link.PayloadHash = hash
+		if link.JobID == 0 {
+			// Only possible during a dry run, where the job hasn't really been inserted.
+		} else if err := saveLink(ctx, db, link); err != nil {
+			return errors.Wrapf(err, "sendToDB saving link")
+		} else if err := saveSnapshot(ctx, db, link, state.snapshot, written); err != nil {
+			return errors.Wrapf(err, "sendToDB")
+		} else if err := saveJobTrack(ctx, db, data, link); err != nil {
+			return errors.Wrapf(err, "sendToDB")
+		} else if err := saveJobStats(ctx, db, data, link); err != nil {
+			return errors.Wrapf(err, "sendToDB")
+		}
+	}
+
+	if err := syncVesselUse(ctx, db, data, jobDutyID); err != nil {
+		return errors.Wrapf(err, "sendToDB vessel engine hours")
 	}
 
-	if err := addCrewForJob(ctx, db, data.Job); err != nil {
+	// Crew are on the roster of the job's own duty
+	job := data.Job
+	job.DutyLogID = jobDutyID
+	if err := addCrewForJob(ctx, db, job); err != nil {
 		return errors.Wrapf(err, "update job add crew rows")
 	}
 
@@ -5,8 +5,11 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -412,9 +415,9 @@ func TestSendToDB_NewRecord(t *testing.T) {
 		assert.Equal(t, "Calm", strings.TrimSpace(seastate))
 		assert.Equal(t, MAX_PRELOADED_SEQUENCE+3, seq)
 		assert.Equal(t,
-			"[Log entry maintained by TripWatch]\n"+
+			sitrepLogStart+"\n"+
 				"This is the comments field. This field is a large blob field that"+
-				" contains multi-line data to be stored in the DB.",
+				" contains multi-line data to be stored in the DB.\n\n"+sitrepLogEnd,
 			strings.TrimSpace(longdesc))
 		assert.False(t, rows.Next())
 	}
@@ -487,3 +490,641 @@ func TestSendToDB_UpdatedRecordStaysWithDutyLogID(t *testing.T) {
 		assert.False(t, rows.Next())
 	}
 }
+
+func TestSendToDB_DryRun(t *testing.T) {
+	dbObj := &linkActivationDB{
+		ID: 42,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-01T06:00:35+10:00")),
+			SeaState:  "dry run",
+			VMRVessel: VMRVessel{
+				ID:   2,
+				Name: "MR2",
+			},
+		},
+	}
+	recorder := &dryRunRecorder{db: realDB}
+	err := sendToDB(context.Background(), recorder, dbObj)
+	assert.Nil(t, err)
+	if assert.Less(t, 0, len(recorder.statements)) {
+		assert.True(t, strings.HasPrefix(recorder.statements[0].query, "UPDATE DUTYJOBS SET"))
+		assert.Equal(t, int64(1), recorder.statements[0].rowCount)
+		assert.Contains(t, recorder.statements[0].diff, `JOBSEAS: "calm" -> "dry run"`)
+	}
+
+	// Check that data in DB was not changed
+	var seastate string
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT JOBSEAS FROM DUTYJOBS"+
+			" WHERE JOBTIMEOUT='2022-01-01 06:00:35' AND JOBDUTYVESSELNAME='MR2'").Scan(&seastate)
+	assert.Nil(t, err)
+	assert.Equal(t, "calm", strings.TrimSpace(seastate))
+}
+
+func TestGetDutyLogEntryFor(t *testing.T) {
+	// Early morning local time is still the previous day in UTC
+	dl, err := getDutyLogEntryFor(context.Background(), realDB,
+		getTimeFromAEST(t, "2022-01-02T06:00:35+10:00"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dl.DutyLog.ID)
+	assert.Equal(t, "GREEN", strings.TrimSpace(dl.DutyLog.CrewName))
+
+	_, err = getDutyLogEntryFor(context.Background(), realDB,
+		getTimeFromAEST(t, "2021-06-01T10:00:00+10:00"))
+	assert.ErrorIs(t, err, dutyLogNotFound)
+}
+
+func TestWithTxRollback(t *testing.T) {
+	const SEQ = 14
+	err := withTx(context.Background(), realDB, nil, func(tx dbExecutor) error {
+		if _, err := tx.ExecContext(context.Background(),
+			"INSERT INTO DUTYLOG (DUTYSEQUENCE,DUTYDATE,CREW,SKIPPER) VALUES (?,'2022-01-08','RED',1)",
+			SEQ); err != nil {
+			return err
+		}
+		return errors.Errorf("fake failure after insert")
+	})
+	assert.NotNil(t, err)
+
+	// The insert must have been rolled back
+	var count int
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT COUNT(*) FROM DUTYLOG WHERE DUTYSEQUENCE=?", SEQ).Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// And committed when there's no error
+	err = withTx(context.Background(), realDB, nil, func(tx dbExecutor) error {
+		_, err := tx.ExecContext(context.Background(),
+			"INSERT INTO DUTYLOG (DUTYSEQUENCE,DUTYDATE,CREW,SKIPPER) VALUES (?,'2022-01-08','RED',1)",
+			SEQ)
+		return err
+	})
+	assert.Nil(t, err)
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT COUNT(*) FROM DUTYLOG WHERE DUTYSEQUENCE=?", SEQ).Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	_, err = realDB.ExecContext(context.Background(),
+		"DELETE FROM DUTYLOG WHERE DUTYSEQUENCE=?", SEQ)
+	assert.Nil(t, err)
+}
+
+func TestAllocateSequenceGenerator(t *testing.T) {
+	maxID, err := getMaxID(context.Background(), realDB, "DUTYJOBS", "JOBJOBSEQUENCE")
+	assert.Nil(t, err)
+	id, err := allocateSequence(context.Background(), realDB, "DUTYJOBS", "JOBJOBSEQUENCE", 0)
+	assert.Nil(t, err)
+	assert.Less(t, maxID, id)
+
+	// Simulate another writer taking numbers beyond the generator
+	id, err = allocateSequence(context.Background(), realDB, "DUTYJOBS", "JOBJOBSEQUENCE", id+10)
+	assert.Nil(t, err)
+	assert.Less(t, maxID+11, id)
+	next, err := allocateSequence(context.Background(), realDB, "DUTYJOBS", "JOBJOBSEQUENCE", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, id+1, next)
+}
+
+func TestSendToDB_LinkedJob(t *testing.T) {
+	err := prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+	assert.True(t, linkTableReady)
+	defer func() {
+		linkTableReady = false
+		vesselUseTableReady = false
+		snapshotTableReady = false
+		conflictTableReady = false
+		jobTrackTableReady = false
+		jobStatsTableReady = false
+	}()
+
+	dbObj := &linkActivationDB{
+		ID: 9001,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-03T08:00:00+10:00")),
+			SeaState:  "calm",
+			VMRVessel: VMRVessel{
+				ID:   2,
+				Name: "MR2",
+			},
+		},
+	}
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	link, ok, err := findLink(context.Background(), realDB, 9001)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Less(t, 0, link.JobID)
+	assert.Equal(t, activationHash(*dbObj), link.PayloadHash)
+
+	// Changing the departure time must update the linked job rather than add a new one
+	dbObj.Job.ID = 0
+	dbObj.Job.StartTime = CustomJSONTime(getTimeFromAEST(t, "2022-01-03T08:30:00+10:00"))
+	dbObj.Job.SeaState = "moderate"
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	assert.Equal(t, link.JobID, dbObj.Job.ID)
+
+	var count int
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT COUNT(*) FROM DUTYJOBS WHERE JOBTIMEOUT='2022-01-03 08:00:00'").Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+	var seastate string
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT JOBSEAS FROM DUTYJOBS WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+		link.DutyLogID, link.JobID).Scan(&seastate)
+	assert.Nil(t, err)
+	assert.Equal(t, "moderate", strings.TrimSpace(seastate))
+
+	// Crew are taken from the linked job's duty, even once a later duty has been started
+	var master string
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT FIRST 1 M.EMAILMRQ FROM MEMBERS M INNER JOIN DUTYCREWS C"+
+			" ON M.MEMBERNOLOCAL=C.CREWMEMBER WHERE C.DUTYSEQUENCE=?", link.DutyLogID).Scan(&master)
+	assert.Nil(t, err)
+	_, err = realDB.ExecContext(context.Background(),
+		"INSERT INTO DUTYLOG (DUTYSEQUENCE,DUTYDATE,CREW,SKIPPER)"+
+			" SELECT MAX(DUTYSEQUENCE)+1,'2022-01-08','BLACK',1 FROM DUTYLOG")
+	assert.Nil(t, err)
+	dbObj.Job.VMRVessel.Master = strings.ToLower(strings.TrimSpace(master))
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	err = dbObj.Job.dbMatchesCrewList(context.Background(), realDB, link.JobID)
+	assert.Nil(t, err)
+
+	// Creating the table again is a no-op
+	err = prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+}
+
+func TestHandleCancelled(t *testing.T) {
+	err := prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+	defer func() {
+		linkTableReady = false
+		vesselUseTableReady = false
+		snapshotTableReady = false
+		conflictTableReady = false
+		jobTrackTableReady = false
+		jobStatsTableReady = false
+		cancelledPolicy = cancelledIgnore
+	}()
+
+	dbObj := &linkActivationDB{
+		ID: 9002,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-04T08:00:00+10:00")),
+			SeaState:  "calm",
+			VMRVessel: VMRVessel{
+				ID:   2,
+				Name: "MR2",
+			},
+		},
+	}
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	link, ok, err := findLink(context.Background(), realDB, 9002)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// The operator's remarks are kept, and the marker is only added once
+	_, err = realDB.ExecContext(context.Background(),
+		"UPDATE DUTYJOBS SET JOBREMARKS=? WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+		"Towed to ramp", link.DutyLogID, link.JobID)
+	assert.Nil(t, err)
+	cancelledPolicy = cancelledRemark
+	for i := 0; i < 2; i++ {
+		err = handleCancelled(context.Background(), realDB, dbObj)
+		assert.Nil(t, err)
+		var remarks string
+		err = realDB.QueryRowContext(context.Background(),
+			"SELECT JOBREMARKS FROM DUTYJOBS WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+			link.DutyLogID, link.JobID).Scan(&remarks)
+		assert.Nil(t, err)
+		assert.Equal(t, cancelledRemarkText+". Towed to ramp", strings.TrimSpace(remarks))
+	}
+
+	cancelledPolicy = cancelledDelete
+	err = handleCancelled(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	var count int
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT COUNT(*) FROM DUTYJOBS WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+		link.DutyLogID, link.JobID).Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+	_, ok, err = findLink(context.Background(), realDB, 9002)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Once the link is gone there is nothing more to retract
+	err = handleCancelled(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+}
+
+func TestSendToDB_VesselUse(t *testing.T) {
+	err := prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+	defer func() {
+		linkTableReady = false
+		vesselUseTableReady = false
+		snapshotTableReady = false
+		conflictTableReady = false
+		jobTrackTableReady = false
+		jobStatsTableReady = false
+	}()
+	dl, err := getLatestDutyLogEntry(context.Background(), realDB)
+	assert.Nil(t, err)
+
+	// Two jobs on the same duty roll the engine hours forward and add up the fuel
+	for i, vessel := range []VMRVessel{
+		{ID: 7, Name: "MR7", StartHoursPort: 100.5, EndHoursPort: 102, StartHoursStbd: 90,
+			EndHoursStbd: 91.5, StartHours3: 10, EndHours3: 11, FuelUsed: 40},
+		{ID: 7, Name: "MR7", StartHoursPort: 102, EndHoursPort: 104.5, StartHoursStbd: 91.5,
+			EndHoursStbd: 94, FuelUsed: 55.5},
+	} {
+		err = sendToDB(context.Background(), realDB, &linkActivationDB{
+			ID: 9100 + i,
+			Job: Job{
+				StartTime: CustomJSONTime(getTimeFromAEST(t, fmt.Sprintf("2022-01-05T0%d:00:00+10:00", 8+i))),
+				VMRVessel: vessel,
+			},
+		})
+		assert.Nil(t, err)
+	}
+	// Re-syncing a job doesn't count its fuel twice
+	err = sendToDB(context.Background(), realDB, &linkActivationDB{
+		ID: 9101,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-05T09:00:00+10:00")),
+			VMRVessel: VMRVessel{ID: 7, Name: "MR7", StartHoursPort: 102, EndHoursPort: 104.5,
+				StartHoursStbd: 91.5, EndHoursStbd: 94, FuelUsed: 55.5},
+		},
+	})
+	assert.Nil(t, err)
+
+	var name string
+	var startPort, endPort, startStbd, endStbd, fuel float64
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT DUTYVESSELNAME,STARTHOURSPORT,ENDHOURSPORT,STARTHOURSSTAR,ENDHOURSSTAR,"+
+			"FUELUSED FROM DUTYVESSELS WHERE DUTYSEQUENCE=? AND DUTYVESSELNO=7",
+		dl.DutyLog.ID).Scan(&name, &startPort, &endPort, &startStbd, &endStbd, &fuel)
+	assert.Nil(t, err)
+	assert.Equal(t, "MR7", strings.TrimSpace(name))
+	assert.Equal(t, 100.5, startPort)
+	assert.Equal(t, 104.5, endPort)
+	assert.Equal(t, 90.0, startStbd)
+	assert.Equal(t, 94.0, endStbd)
+	assert.Equal(t, 95.5, fuel)
+
+	// The number of engines is left as it was set in the VMR desktop app
+	_, err = realDB.ExecContext(context.Background(),
+		"UPDATE DUTYVESSELS SET DUTYENGINES=2 WHERE DUTYSEQUENCE=? AND DUTYVESSELNO=7", dl.DutyLog.ID)
+	assert.Nil(t, err)
+	err = sendToDB(context.Background(), realDB, &linkActivationDB{
+		ID: 9102,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-05T10:00:00+10:00")),
+			VMRVessel: VMRVessel{ID: 7, Name: "MR7", StartHoursPort: 104.5, EndHoursPort: 105},
+		},
+	})
+	assert.Nil(t, err)
+	var engines int
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT DUTYENGINES FROM DUTYVESSELS WHERE DUTYSEQUENCE=? AND DUTYVESSELNO=7",
+		dl.DutyLog.ID).Scan(&engines)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, engines)
+}
+
+func TestCheckDBSchema(t *testing.T) {
+	columns, err := getDBColumns(context.Background(), realDB, "DUTYJOBS")
+	assert.Nil(t, err)
+	assert.Equal(t, fbTimestamp, columns["JOBTIMEOUT"].fieldType)
+	assert.Equal(t, 30, columns["JOBDUTYVESSELNAME"].length)
+
+	columns, err = getDBColumns(context.Background(), realDB, "NOSUCHTABLE")
+	assert.Nil(t, err)
+	assert.Empty(t, columns)
+
+	problems, err := checkDBSchema(context.Background(), realDB)
+	assert.Nil(t, err)
+	for _, p := range problems {
+		assert.False(t, p.isError, p.String())
+	}
+}
+
+func TestSendToDB_ClearValues(t *testing.T) {
+	activation := func(body string) *linkActivationDB {
+		data := &linkActivationDB{}
+		err := json.Unmarshal([]byte(body), data)
+		assert.Nil(t, err)
+		data.raw = []byte(body)
+		return data
+	}
+	err := sendToDB(context.Background(), realDB, activation(`{"id":9200,
+		"activationsrvdeparttime":"2022-01-05T22:00:00Z","activationsrvvessel":"MARINERESCUE2",
+		"activationsdvpobadult":2,"activationsdvpobchildren":3,"activationsdonationreceived":"50"}`))
+	assert.Nil(t, err)
+	// TripWatch clears the children and donation, and doesn't send the adults
+	err = sendToDB(context.Background(), realDB, activation(`{"id":9200,
+		"activationsrvdeparttime":"2022-01-05T22:00:00Z","activationsrvvessel":"MARINERESCUE2",
+		"activationsdvpobchildren":0,"activationsdonationreceived":null}`))
+	assert.Nil(t, err)
+
+	var adults, kids int
+	var donation sql.NullFloat64
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT JOBADULTS,JOBCHILDREN,JOBDONATION FROM DUTYJOBS"+
+			" WHERE JOBTIMEOUT='2022-01-06 08:00:00' AND JOBDUTYVESSELNAME='Marine Rescue 2'").
+		Scan(&adults, &kids, &donation)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, adults)
+	assert.Equal(t, 0, kids)
+	assert.False(t, donation.Valid)
+}
+
+func TestSendToDB_FieldOwnership(t *testing.T) {
+	err := prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+	assert.True(t, snapshotTableReady)
+	assert.True(t, conflictTableReady)
+	defer func() {
+		linkTableReady = false
+		vesselUseTableReady = false
+		snapshotTableReady = false
+		conflictTableReady = false
+		jobTrackTableReady = false
+		jobStatsTableReady = false
+	}()
+
+	dbObj := &linkActivationDB{
+		ID: 9300,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-07T08:00:00+10:00")),
+			SeaState:  "calm",
+			Purpose:   "Tow",
+			VMRVessel: VMRVessel{
+				ID:   2,
+				Name: "MR2",
+			},
+		},
+	}
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	link, ok, err := findLink(context.Background(), realDB, 9300)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	jobRow := func() (string, string) {
+		var seas, details string
+		err := realDB.QueryRowContext(context.Background(),
+			"SELECT JOBSEAS,JOBDETAILS FROM DUTYJOBS WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+			link.DutyLogID, link.JobID).Scan(&seas, &details)
+		assert.Nil(t, err)
+		return strings.TrimSpace(seas), strings.TrimSpace(details)
+	}
+
+	// The sea state is corrected in the VMR app, so TripWatch no longer updates it
+	_, err = realDB.ExecContext(context.Background(),
+		"UPDATE DUTYJOBS SET JOBSEAS='rough' WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+		link.DutyLogID, link.JobID)
+	assert.Nil(t, err)
+	dbObj.Job.SeaState = "moderate"
+	dbObj.Job.Purpose = "Tow to ramp"
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	seas, details := jobRow()
+	assert.Equal(t, "rough", seas)
+	assert.Equal(t, "Tow to ramp", details)
+	var twValue string
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT TRIPWATCH_VALUE FROM "+conflictTableName+" WHERE TRIPWATCH_ID=9300 AND COLUMN_NAME='JOBSEAS'").
+		Scan(&twValue)
+	assert.Nil(t, err)
+	assert.Equal(t, `"moderate"`, strings.TrimSpace(twValue))
+
+	// Locked jobs aren't changed at all
+	_, err = realDB.ExecContext(context.Background(),
+		"UPDATE DUTYJOBS SET JOBLOCKED='Y' WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+		link.DutyLogID, link.JobID)
+	assert.Nil(t, err)
+	dbObj.Job.Purpose = "Search"
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	_, details = jobRow()
+	assert.Equal(t, "Tow to ramp", details)
+}
+
+func TestSendToDB_SitrepLog(t *testing.T) {
+	err := prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+	defer func() {
+		linkTableReady = false
+		vesselUseTableReady = false
+		snapshotTableReady = false
+		conflictTableReady = false
+		jobTrackTableReady = false
+		jobStatsTableReady = false
+	}()
+
+	sitrep := func(id int, ts, note string) Sitrep {
+		return Sitrep{ID: id, Updated: CustomJSONTime(getTime(t, ts)), Comment: note}
+	}
+	dbObj := &linkActivationDB{
+		ID: 9400,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-08T08:00:00+10:00")),
+			Comments:  "Tow to ramp",
+			VMRVessel: VMRVessel{
+				ID:   2,
+				Name: "MR2",
+			},
+		},
+		Sitreps: []Sitrep{sitrep(501, "2022-01-07T22:05:00Z", "Underway")},
+	}
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	link, ok, err := findLink(context.Background(), realDB, 9400)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// Notes added in the VMR app are kept as new sitreps arrive
+	_, err = realDB.ExecContext(context.Background(),
+		"UPDATE DUTYJOBS SET JOBDETAILS_LONG='Owner called' || ASCII_CHAR(10) || JOBDETAILS_LONG"+
+			" WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?", link.DutyLogID, link.JobID)
+	assert.Nil(t, err)
+	dbObj.Job.Comments = "Tow to ramp"
+	dbObj.Sitreps = append(dbObj.Sitreps, sitrep(502, "2022-01-07T22:40:00Z", "On scene"))
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	var comments string
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT JOBDETAILS_LONG FROM DUTYJOBS WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+		link.DutyLogID, link.JobID).Scan(&comments)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"Owner called",
+		"",
+		sitrepLogStart,
+		"Tow to ramp",
+		"",
+		"* 08:05 AEST #501: Underway",
+		"* 08:40 AEST #502: On scene",
+		sitrepLogEnd,
+	}, "\n"), comments)
+}
+
+func TestSendToDB_JobTrack(t *testing.T) {
+	err := prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+	defer func() {
+		linkTableReady = false
+		vesselUseTableReady = false
+		snapshotTableReady = false
+		conflictTableReady = false
+		jobTrackTableReady = false
+		jobStatsTableReady = false
+	}()
+	assert.True(t, jobTrackTableReady)
+
+	dbObj := &linkActivationDB{
+		ID: 9500,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-09T08:00:00+10:00")),
+			VMRVessel: VMRVessel{
+				ID:   2,
+				Name: "MR2",
+			},
+		},
+		Sitreps: []Sitrep{
+			{ID: 601, Updated: CustomJSONTime(getTime(t, "2022-01-08T22:05:00Z")),
+				Pos: GPS{-27.96, 153.42}, Speed: 20, Heading: 45, Comment: "Underway"},
+			{ID: 602, Updated: CustomJSONTime(getTime(t, "2022-01-08T22:40:00Z")),
+				Pos: GPS{-27.91, 153.45}, Comment: "RV has arrived at target"},
+		},
+	}
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	link, ok, err := findLink(context.Background(), realDB, 9500)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	readTrack := func() map[int]float64 {
+		rows, err := realDB.QueryContext(context.Background(),
+			"SELECT SITREP_ID,LATITUDE FROM "+jobTrackTableName+" WHERE JOBJOBSEQUENCE=?", link.JobID)
+		assert.Nil(t, err)
+		defer rows.Close()
+		track := map[int]float64{}
+		for rows.Next() {
+			var id int
+			var lat float64
+			assert.Nil(t, rows.Scan(&id, &lat))
+			track[id] = lat
+		}
+		return track
+	}
+	assert.Equal(t, map[int]float64{601: -27.96, 602: -27.91}, readTrack())
+
+	// Points are updated in place, and removed along with their sitreps
+	dbObj.Sitreps = []Sitrep{dbObj.Sitreps[1]}
+	dbObj.Sitreps[0].Pos = GPS{-27.92, 153.45}
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]float64{602: -27.92}, readTrack())
+}
+
+func TestExportJobs(t *testing.T) {
+	err := prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+	defer func() {
+		linkTableReady = false
+		vesselUseTableReady = false
+		snapshotTableReady = false
+		conflictTableReady = false
+		jobTrackTableReady = false
+		jobStatsTableReady = false
+	}()
+
+	dbObj := &linkActivationDB{
+		ID: 9600,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-10T08:00:00+10:00")),
+			Type:      "Tow",
+			VMRVessel: VMRVessel{
+				ID:   2,
+				Name: "MR2",
+			},
+		},
+		Sitreps: []Sitrep{
+			{ID: 701, Updated: CustomJSONTime(getTime(t, "2022-01-09T22:05:00Z")),
+				Pos: GPS{-27.96, 153.42}, Comment: "Underway"},
+			{ID: 702, Updated: CustomJSONTime(getTime(t, "2022-01-09T22:40:00Z")),
+				Pos: GPS{-27.91, 153.45}, Comment: "RV has arrived at target"},
+		},
+	}
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+
+	tz := time.FixedZone("UTC+10", 10*60*60)
+	jobs, err := findExportJobs(context.Background(), realDB, 0,
+		time.Date(2022, 1, 10, 0, 0, 0, 0, tz), time.Date(2022, 1, 11, 0, 0, 0, 0, tz))
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, 9600, jobs[0].TripWatchID)
+	assert.Equal(t, "MR2", jobs[0].Vessel)
+	assert.Equal(t, GPS{-27.91, 153.45}, jobs[0].Pos)
+	assert.True(t, getTimeFromAEST(t, "2022-01-10T08:00:00+10:00").Equal(jobs[0].Start))
+
+	track, err := readJobTrack(context.Background(), realDB, jobs[0].JobID)
+	assert.Nil(t, err)
+	assert.Len(t, track, 2)
+	assert.Equal(t, 701, track[0].SitrepID)
+	assert.True(t, getTime(t, "2022-01-09T22:05:00Z").Equal(time.Time(track[0].Reported)))
+}
+
+func TestSendToDB_JobStats(t *testing.T) {
+	err := prepareServiceTables(context.Background(), realDB)
+	assert.Nil(t, err)
+	defer func() {
+		linkTableReady = false
+		vesselUseTableReady = false
+		snapshotTableReady = false
+		conflictTableReady = false
+		jobTrackTableReady = false
+		jobStatsTableReady = false
+	}()
+	assert.True(t, jobStatsTableReady)
+
+	dbObj := &linkActivationDB{
+		ID: 9700,
+		Job: Job{
+			StartTime: CustomJSONTime(getTimeFromAEST(t, "2022-01-11T08:00:00+10:00")),
+			EndTime:   CustomJSONTime(getTimeFromAEST(t, "2022-01-11T10:00:00+10:00")),
+			VMRVessel: VMRVessel{
+				ID:   2,
+				Name: "MR2",
+			},
+		},
+		Sitreps: []Sitrep{
+			{ID: 801, Updated: CustomJSONTime(getTime(t, "2022-01-10T22:05:00Z")),
+				Pos: GPS{-27.95, 153.42}, Comment: "Underway"},
+			{ID: 802, Updated: CustomJSONTime(getTime(t, "2022-01-10T22:40:00Z")),
+				Pos: GPS{-27.80, 153.42}, Comment: "RV has arrived at target"},
+		},
+	}
+	err = sendToDB(context.Background(), realDB, dbObj)
+	assert.Nil(t, err)
+
+	var distance sql.NullFloat64
+	var toTarget, onScene, towing sql.NullInt64
+	err = realDB.QueryRowContext(context.Background(),
+		"SELECT DISTANCE_NM,MINUTES_TO_TARGET,MINUTES_ON_SCENE,MINUTES_TOWING FROM "+
+			jobStatsTableName+" WHERE TRIPWATCH_ID=?", 9700).Scan(&distance, &toTarget, &onScene, &towing)
+	assert.Nil(t, err)
+	assert.Equal(t, sql.NullFloat64{Float64: 9, Valid: true}, distance)
+	assert.Equal(t, sql.NullInt64{Int64: 40, Valid: true}, toTarget)
+	assert.False(t, onScene.Valid)
+	assert.False(t, towing.Valid)
+}
@@ -31,31 +31,39 @@ type testParent struct {
 }
 
 func TestForEachCol(t *testing.T) {
-	db := &linkActivationDB{
-		ID: 42,
-		Job: Job{
-			StartTime: CustomJSONTime(time.Now()),
-			VMRVessel: VMRVessel{
-				ID:   1,
-				Name: "MR1",
-			},
-		},
+	link := jobLink{
+		TripWatchID: 42,
+		JobID:       7,
+		LastSynced:  time.Now(),
 	}
-	mainObj := reflect.ValueOf(*db)
-	err := forEachColumn("parent", mainObj, func(tableName string, col column) error {
-		if col.name == "JOBDUTYVESSELNAME" {
-			assert.Equal(t, db.Job.VMRVessel.Name, col.value)
-		} else if col.name == "JOBDUTYVESSELNO" {
-			assert.Equal(t, db.Job.VMRVessel.ID, col.value)
-		} else if col.name == "JOBTIMEOUT" {
-			assert.Equal(t, db.Job.StartTime, col.value)
+	mainObj := reflect.ValueOf(link)
+	colNames := []string{}
+	err := forEachColumn(linkTableName, mainObj, func(tableName string, col column) error {
+		colNames = append(colNames, col.name)
+		if col.name == "TRIPWATCH_ID" {
+			assert.Equal(t, link.TripWatchID, col.value)
+			assert.True(t, col.isMatch)
+		} else if col.name == "JOBJOBSEQUENCE" {
+			assert.Equal(t, link.JobID, col.value)
+		} else if col.name == "LAST_SYNCED" {
+			// Timestamps are a single column, not a nested table
+			assert.Equal(t, linkTableName, tableName)
+			assert.Equal(t, link.LastSynced, col.value)
 		}
 		return nil
 	})
 	assert.Nil(t, err)
+	assert.Equal(t, []string{"TRIPWATCH_ID", "JOBDUTYSEQUENCE", "JOBJOBSEQUENCE",
+		"LAST_SYNCED", "PAYLOAD_HASH"}, colNames)
+
+	// Tagged fields which can't be written to a column are an error
+	err = forEachColumn("parent", reflect.ValueOf(struct {
+		List []string `firebird:"LIST"`
+	}{}), func(tableName string, col column) error { return nil })
+	assert.NotNil(t, err)
 
 	// Test that a nested struct can do for each col as well
-	colNames := []string{}
+	colNames = []string{}
 	coj := crewOnJob{}
 	o := reflect.ValueOf(coj)
 	err = forEachColumn("parent", o, func(tableName string, col column) error {
@@ -125,6 +133,39 @@ func TestAggregateFields(t *testing.T) {
 	assert.Equal(t, "SE", string(data.Job.Weather.WindDir))
 	assert.Equal(t, "10 - 20 knots", string(data.Job.Weather.WindSpeed))
 	assert.Equal(t, "Clear", data.Job.Weather.RainState)
+	assert.Equal(t, SeaStateEnum("Moderate"), data.Job.SeaState)
+
+	// The forecast zone is configurable, and tides are listed in the comments
+	forecastZone = "Byron Coast"
+	defer func() { forecastZone = defaultForecastZone }()
+	data.Job = Job{
+		SeaState: "Calm",
+		Weather: Weather{
+			Forecast: data.Job.Weather.Forecast,
+			Tides: "[Gold Coast Seaway -> 27/05/2022 (Fri) @ 12:07 -> low -> 0.24]" +
+				" [Gold Coast Seaway -> 27/05/2022 (Fri) @ 18:45 -> high -> 1.54]",
+		},
+	}
+	err = aggregateFields(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "SE", string(data.Job.Weather.WindDir))
+	assert.Equal(t, "10 - 20 knots", string(data.Job.Weather.WindSpeed))
+	assert.Equal(t, SeaStateEnum("Calm"), data.Job.SeaState)
+	assert.Contains(t, data.Job.Comments, "Tides:\n"+
+		"* Low 0.24 m at 12:07 Fri 27 May (Gold Coast Seaway)\n"+
+		"* High 1.54 m at 18:45 Fri 27 May (Gold Coast Seaway)\n")
+	// Unrecognised tides are skipped with a warning rather than failing the activation
+	data.Job.Weather.Tides = "[Gold Coast Seaway -> high tide around lunch]" +
+		" [Gold Coast Seaway -> 27/05/2022 (Fri) @ 18:45 -> high -> 1.54]"
+	err = aggregateFields(data)
+	assert.Nil(t, err)
+	assert.Contains(t, data.Job.Comments, "Tides:\n"+
+		"* High 1.54 m at 18:45 Fri 27 May (Gold Coast Seaway)\n")
+	assert.Equal(t, []string{"ignoring unrecognised tide 'Gold Coast Seaway -> high tide around lunch'"},
+		data.warnings)
+	forecastZone = "Moreton Bay Bar"
+	err = aggregateFields(data)
+	assert.NotNil(t, err)
 
 	// Check GPS parsing
 	data = &linkActivationDB{
@@ -344,6 +385,19 @@ func TestSetGPS(t *testing.T) {
 	assert.Equal(t, -27.0, data.Job.FirebirdGPS.Lat)
 	assert.Equal(t, 153.789, data.Job.FirebirdGPS.Long)
 
+	// Sitreps without a position fall back to the one in the note, then to the next sitrep
+	data = linkActivationDB{
+		Sitreps: []Sitrep{
+			{Comment: "Underway"},
+			{Comment: "On scene -> [DMS Latitude: -27˚ 30' 36S,  Longitude: 153˚ 9' 0E]"},
+			{Pos: GPS{-27.557, 153.456}, Comment: "Returning to base now."},
+		},
+	}
+	err = setGPS(&data)
+	assert.Nil(t, err)
+	assert.Equal(t, -27.51, data.Job.FirebirdGPS.Lat)
+	assert.Equal(t, 153.15, data.Job.FirebirdGPS.Long)
+
 	// Use the manually-entered GPS as final resort if no sitreps are present
 	data = linkActivationDB{
 		Job: Job{
@@ -355,4 +409,36 @@ func TestSetGPS(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, -27.999, data.Job.FirebirdGPS.Lat)
 	assert.Equal(t, 153.0877, data.Job.FirebirdGPS.Long)
+
+	// Placeholders and positions outside the operating area are skipped, and swapped positions
+	// are corrected, with a warning for each
+	operatingArea = testArea
+	defer func() { operatingArea = nil }()
+	data = linkActivationDB{
+		Job: Job{Pos: GPS{-27.999, 153.0877}},
+		Sitreps: []Sitrep{
+			{ID: 1, Pos: GPS{-27, 153}, Comment: "RV has arrived at target"},
+			{ID: 2, Pos: GPS{-33.86, 151.21}, Comment: "Target vessel in tow"},
+			{ID: 3, Pos: GPS{153.42, -27.95}, Comment: "Returning to base now."},
+		},
+	}
+	err = setGPS(&data)
+	assert.Nil(t, err)
+	assert.Equal(t, -27.95, data.Job.FirebirdGPS.Lat)
+	assert.Equal(t, 153.42, data.Job.FirebirdGPS.Long)
+	assert.Equal(t, []string{
+		"ignoring sitrep 1: position -27,153 looks like a placeholder",
+		"ignoring sitrep 2: position -33.86,151.21 is outside the operating area",
+		"latitude and longitude of sitrep 3 were swapped, using -27.95,153.42",
+	}, data.warnings)
+
+	data.Sitreps = data.Sitreps[:2]
+	data.Job.Pos = GPS{-27, 153}
+	data.warnings = nil
+	data.Job.FirebirdGPS = FirebirdGPS{}
+	err = setGPS(&data)
+	assert.Nil(t, err)
+	assert.True(t, GPS{data.Job.FirebirdGPS.Lat, data.Job.FirebirdGPS.Long}.IsZero())
+	assert.Len(t, data.warnings, 4)
+	assert.Equal(t, "no usable position, latitude and longitude not set", data.warnings[3])
 }
@@ -0,0 +1,179 @@
+// Package forecast parses the Bureau of Meteorology coastal waters forecast and the tide
+// predictions which TripWatch attaches to each activation.
+package forecast
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Wind, sea or swell conditions for part of the forecast period.
+type Condition struct {
+	// Compass point (N, NE, ...), or "" for variable winds and seas
+	Direction string
+	// Wind speed in knots or height in metres. Min is 0 for "below" and "up to" forecasts.
+	Min, Max float64
+	// The phrase which introduced a change from the previous conditions (e.g. "tending",
+	// "increasing"), or "" for the first conditions
+	Change string
+}
+
+// The forecast for a single coastal waters zone. The first of each list of conditions is the
+// one which applies at the start of the forecast period.
+type Zone struct {
+	Name    string // e.g. "Gold Coast Waters"
+	Area    string // e.g. "Cape Moreton to Point Danger"
+	Winds   []Condition
+	Seas    []Condition
+	Swells  [][]Condition // Swell1, Swell2, ...
+	Weather string
+}
+
+var (
+	zoneRE  = regexp.MustCompile(`\[([^\]]*)\]`)
+	fieldRE = regexp.MustCompile(`(?i)\b(winds|seas|swell\d*|weather):`)
+	tokenRE = regexp.MustCompile(`[a-z]+(?:-[a-z]+)*|\d+(?:\.\d+)?%?`)
+)
+
+var directions = map[string]string{
+	"northerly":      "N",
+	"northeasterly":  "NE",
+	"easterly":       "E",
+	"southeasterly":  "SE",
+	"southerly":      "S",
+	"southwesterly":  "SW",
+	"westerly":       "W",
+	"northwesterly":  "NW",
+	"variable":       "",
+	"north-easterly": "NE",
+	"south-easterly": "SE",
+	"south-westerly": "SW",
+	"north-westerly": "NW",
+}
+
+var changes = map[string]bool{
+	"tending":    true,
+	"becoming":   true,
+	"shifting":   true,
+	"turning":    true,
+	"increasing": true,
+	"reaching":   true,
+	"easing":     true,
+	"decreasing": true,
+	"rising":     true,
+	"then":       true,
+}
+
+// Parse a coastal waters forecast. Each zone is given in square brackets, as in
+// "[Gold Coast Waters: Cape Moreton to Point Danger, Winds: ... Seas: ... Weather: ...]". A
+// forecast without brackets is parsed as a single zone.
+func ParseCoastalWaters(text string) []Zone {
+	zones := []Zone{}
+	matches := zoneRE.FindAllStringSubmatch(text, -1)
+	if len(matches) == 0 {
+		matches = [][]string{{text, text}}
+	}
+	for _, m := range matches {
+		if zone, ok := parseZone(m[1]); ok {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// Find a zone by name, ignoring case.
+func FindZone(zones []Zone, name string) (Zone, bool) {
+	for _, zone := range zones {
+		if strings.EqualFold(zone.Name, strings.TrimSpace(name)) {
+			return zone, true
+		}
+	}
+	return Zone{}, false
+}
+
+func parseZone(text string) (Zone, bool) {
+	parts := strings.SplitN(text, ":", 2)
+	if len(parts) != 2 {
+		return Zone{}, false
+	}
+	zone := Zone{Name: strings.TrimSpace(parts[0])}
+	fields := fieldRE.FindAllStringSubmatchIndex(parts[1], -1)
+	if len(fields) == 0 {
+		return Zone{}, false
+	}
+	zone.Area = strings.Trim(strings.TrimSpace(parts[1][:fields[0][0]]), ",")
+	for i, f := range fields {
+		end := len(parts[1])
+		if i+1 < len(fields) {
+			end = fields[i+1][0]
+		}
+		value := strings.TrimSpace(parts[1][f[1]:end])
+		switch label := strings.ToLower(parts[1][f[2]:f[3]]); {
+		case label == "winds":
+			zone.Winds = parseConditions(value, "knot")
+		case label == "seas":
+			zone.Seas = parseConditions(value, "metre")
+		case strings.HasPrefix(label, "swell"):
+			zone.Swells = append(zone.Swells, parseConditions(value, "metre"))
+		case label == "weather":
+			zone.Weather = strings.Join(strings.Fields(value), " ")
+		}
+	}
+	return zone, true
+}
+
+// Pick out each direction and speed (or height) from a forecast phrase such as "North to
+// northwesterly 10 to 15 knots tending westerly 15 to 20 knots in the afternoon". A change
+// phrase, or a second direction or magnitude, starts new conditions. Directions carry over to
+// the next conditions, so "increasing to 20 knots" keeps the wind direction.
+func parseConditions(text, unit string) []Condition {
+	tokens := tokenRE.FindAllString(strings.ToLower(text), -1)
+	conditions := []Condition{}
+	current := Condition{}
+	hasDir, hasSize := false, false
+	next := func(change string) {
+		if hasDir || hasSize {
+			conditions = append(conditions, current)
+		}
+		current = Condition{Direction: current.Direction, Change: change}
+		hasDir, hasSize = false, false
+	}
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if changes[tok] {
+			next(tok)
+		} else if dir, ok := directions[tok]; ok {
+			// "north of Yamba" is a place rather than a direction, so only the -erly forms count
+			if hasDir || hasSize {
+				next("")
+			}
+			current.Direction = dir
+			hasDir = true
+		} else if n, err := strconv.ParseFloat(tok, 64); err == nil {
+			min, max := n, n
+			j := i + 1
+			if j+1 < len(tokens) && tokens[j] == "to" {
+				if m, err := strconv.ParseFloat(tokens[j+1], 64); err == nil {
+					max = m
+					j += 2
+				}
+			}
+			if j >= len(tokens) || !strings.HasPrefix(tokens[j], unit) {
+				continue
+			}
+			if i > 0 && (tokens[i-1] == "below" || tokens[i-1] == "under" ||
+				(tokens[i-1] == "to" && i > 1 && tokens[i-2] == "up")) {
+				min = 0
+			}
+			if hasSize {
+				next("")
+			}
+			current.Min, current.Max = min, max
+			hasSize = true
+			i = j
+		}
+	}
+	next("")
+	return conditions
+}
@@ -0,0 +1,113 @@
+package forecast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testForecast = "[Byron Coast: Point Danger to Wooli, Winds:" +
+	"  Southeasterly 10 to 15 knots, reaching up to 20 knots" +
+	" north of Yamba in the evening.\r\n" +
+	" Seas:  Around 1 metre, increasing to 1 to 1.5 metres offshore north of Cape Byron.\r\n" +
+	" Swell1:  Southerly around 1 metre inshore, increasing to 1.5 metres offshore.\r\n" +
+	" Swell2:  Easterly 1.5 metres.\r\n Weather:  Mostly clear.\r\n] " +
+	"[Gold Coast Waters: Cape Moreton to Point Danger," +
+	" Winds:  Easterly 10 to 15 knots, increasing to 15 to 20 knots north of Point Lookout in" +
+	" the afternoon. Inshore winds tending southwesterly around 10 knots in the morning.\r\n" +
+	" Seas:  Below 1 metre.\r\n" +
+	" Swell1:  Southerly around 1 metre.\r\n" +
+	" Weather:  Partly cloudy. 40% chance of showers offshore.\r\n]"
+
+func TestParseCoastalWaters(t *testing.T) {
+	zones := ParseCoastalWaters(testForecast)
+	assert.Len(t, zones, 2)
+
+	byron, ok := FindZone(zones, "byron coast")
+	assert.True(t, ok)
+	assert.Equal(t, "Point Danger to Wooli", byron.Area)
+	assert.Equal(t, []Condition{
+		{Direction: "SE", Min: 10, Max: 15},
+		{Direction: "SE", Min: 0, Max: 20, Change: "reaching"},
+	}, byron.Winds)
+	assert.Equal(t, []Condition{
+		{Min: 1, Max: 1},
+		{Min: 1, Max: 1.5, Change: "increasing"},
+	}, byron.Seas)
+	assert.Equal(t, [][]Condition{
+		{{Direction: "S", Min: 1, Max: 1}, {Direction: "S", Min: 1.5, Max: 1.5, Change: "increasing"}},
+		{{Direction: "E", Min: 1.5, Max: 1.5}},
+	}, byron.Swells)
+	assert.Equal(t, "Mostly clear.", byron.Weather)
+
+	gc, ok := FindZone(zones, "Gold Coast Waters")
+	assert.True(t, ok)
+	assert.Equal(t, []Condition{
+		{Direction: "E", Min: 10, Max: 15},
+		{Direction: "E", Min: 15, Max: 20, Change: "increasing"},
+		{Direction: "SW", Min: 10, Max: 10, Change: "tending"},
+	}, gc.Winds)
+	assert.Equal(t, []Condition{{Min: 0, Max: 1}}, gc.Seas)
+	assert.Equal(t, "Partly cloudy. 40% chance of showers offshore.", gc.Weather)
+
+	_, ok = FindZone(zones, "Moreton Bay")
+	assert.False(t, ok)
+}
+
+func TestParseConditions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []Condition
+	}{
+		{"South to southeasterly 15 to 20 knots.", []Condition{{Direction: "SE", Min: 15, Max: 20}}},
+		{"North to northwesterly 10 to 15 knots tending westerly 15 to 20 knots during the afternoon.",
+			[]Condition{
+				{Direction: "NW", Min: 10, Max: 15},
+				{Direction: "W", Min: 15, Max: 20, Change: "tending"},
+			}},
+		{"Variable about 10 knots, becoming north-easterly 10 to 15 knots later.",
+			[]Condition{
+				{Min: 10, Max: 10},
+				{Direction: "NE", Min: 10, Max: 15, Change: "becoming"},
+			}},
+		{"Southerly 20 to 25 knots easing to 15 to 20 knots.",
+			[]Condition{
+				{Direction: "S", Min: 20, Max: 25},
+				{Direction: "S", Min: 15, Max: 20, Change: "easing"},
+			}},
+		{"Winds below 10 knots.", []Condition{{Min: 0, Max: 10}}},
+		{"Light winds.", []Condition{}},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			assert.Equal(t, test.want, parseConditions(test.text, "knot"))
+		})
+	}
+}
+
+func TestParseTides(t *testing.T) {
+	tz := time.FixedZone("UTC+10", 10*60*60)
+	tides, skipped := ParseTides("[Gold Coast Seaway -> 27/05/2022 (Fri) @ 12:07 -> low -> 0.24]"+
+		" [Gold Coast Seaway -> 27/05/2022 (Fri) @ 18:45 -> high -> 1.54]", tz)
+	assert.Empty(t, skipped)
+	assert.Equal(t, []Tide{
+		{Station: "Gold Coast Seaway", Time: time.Date(2022, 5, 27, 12, 7, 0, 0, tz), Metres: 0.24},
+		{Station: "Gold Coast Seaway", Time: time.Date(2022, 5, 27, 18, 45, 0, 0, tz), High: true,
+			Metres: 1.54},
+	}, tides)
+
+	tides, skipped = ParseTides("", tz)
+	assert.Empty(t, skipped)
+	assert.Empty(t, tides)
+
+	// Entries which can't be parsed are skipped, keeping the others
+	tides, skipped = ParseTides("[Gold Coast Seaway -> sometime -> high -> 1.5]"+
+		" [Gold Coast Seaway -> 31/02/2022 (Thu) @ 09:10 -> high -> 1.5]"+
+		" [Gold Coast Seaway -> 27/05/2022 (Fri) @ 18:45 -> high -> 1.54]", tz)
+	assert.Equal(t, []string{
+		"Gold Coast Seaway -> sometime -> high -> 1.5",
+		"Gold Coast Seaway -> 31/02/2022 (Thu) @ 09:10 -> high -> 1.5",
+	}, skipped)
+	assert.Len(t, tides, 1)
+}
@@ -0,0 +1,50 @@
+package forecast
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A high or low tide prediction.
+type Tide struct {
+	Station string
+	Time    time.Time
+	High    bool
+	Metres  float64
+}
+
+var tideRE = regexp.MustCompile(`(?i)^(.+?)\s*->\s*(\d{1,2}/\d{1,2}/\d{4})\s*(?:\(\w+\))?\s*@\s*` +
+	`(\d{1,2}:\d{2})\s*->\s*(high|low)\s*->\s*(-?\d+(?:\.\d+)?)$`)
+
+// Parse the tide predictions, which TripWatch gives as a list of
+// "[Station -> dd/mm/yyyy (Day) @ hh:mm -> high|low -> height]". Times are in loc. The tide list
+// is typed in by hand, so entries which can't be parsed are skipped and returned alongside the
+// tides which could be.
+func ParseTides(text string, loc *time.Location) ([]Tide, []string) {
+	tides := []Tide{}
+	skipped := []string{}
+	for _, m := range zoneRE.FindAllStringSubmatch(text, -1) {
+		parts := tideRE.FindStringSubmatch(strings.TrimSpace(m[1]))
+		if parts == nil {
+			skipped = append(skipped, m[1])
+			continue
+		}
+		tide := Tide{Station: parts[1], High: strings.EqualFold(parts[4], "high")}
+		if t, err := time.ParseInLocation("2/1/2006 15:04", parts[2]+" "+parts[3], loc); err != nil {
+			skipped = append(skipped, m[1])
+			continue
+		} else {
+			tide.Time = t
+		}
+		if h, err := strconv.ParseFloat(parts[5], 64); err != nil {
+			skipped = append(skipped, m[1])
+			continue
+		} else {
+			tide.Metres = h
+		}
+		tides = append(tides, tide)
+	}
+	return tides, skipped
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// The area the unit operates in, given in the config either as a list of [latitude, longitude]
+// points or as a GeoJSON file containing Polygon or MultiPolygon geometry.
+type areaConfig struct {
+	Points [][]float64 `yaml:"points"`
+	File   string      `yaml:"file"`
+}
+
+// The outline of an area. The last point joins back to the first.
+type polygon []GPS
+
+// Positions outside all of these polygons are rejected. There is no check if it is empty.
+var operatingArea []polygon
+
+// Load the operating area. Relative file paths are relative to dir.
+func loadOperatingArea(cfg areaConfig, dir string) ([]polygon, error) {
+	area := []polygon{}
+	if len(cfg.Points) > 0 {
+		poly := polygon{}
+		for _, p := range cfg.Points {
+			if len(p) != 2 {
+				return nil, errors.Errorf("operating area point %v should be [latitude, longitude]", p)
+			}
+			poly = append(poly, GPS{Lat: p[0], Long: p[1]})
+		}
+		area = append(area, poly)
+	}
+	if cfg.File != "" {
+		fname := cfg.File
+		if !filepath.IsAbs(fname) {
+			fname = filepath.Join(dir, fname)
+		}
+		if b, err := os.ReadFile(fname); err != nil {
+			return nil, errors.Wrapf(err, "operating area reading %s", fname)
+		} else if polys, err := parseGeoJSONArea(b); err != nil {
+			return nil, errors.Wrapf(err, "operating area parsing %s", fname)
+		} else {
+			area = append(area, polys...)
+		}
+	}
+	for _, poly := range area {
+		if len(poly) < 3 {
+			return nil, errors.Errorf("operating area needs at least 3 points, got %d", len(poly))
+		}
+		for _, p := range poly {
+			if math.Abs(p.Lat) > 90 || math.Abs(p.Long) > 180 {
+				return nil, errors.Errorf("operating area point (%f, %f) out of range", p.Lat, p.Long)
+			}
+		}
+	}
+	return area, nil
+}
+
+// The parts of a GeoJSON object used by vmrsync, for reading operating areas and writing
+// exports (see writeGeoJSON()).
+type geoJSON struct {
+	Type        string                 `json:"type"`
+	Coordinates json.RawMessage        `json:"coordinates,omitempty"`
+	Geometry    *geoJSON               `json:"geometry,omitempty"`
+	Properties  map[string]interface{} `json:"properties,omitempty"`
+	Features    []geoJSON              `json:"features,omitempty"`
+	Geometries  []geoJSON              `json:"geometries,omitempty"`
+}
+
+// Pull the outer ring of every polygon out of a GeoJSON object. GeoJSON gives positions as
+// [longitude, latitude].
+func parseGeoJSONArea(b []byte) ([]polygon, error) {
+	var obj geoJSON
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, errors.Wrapf(err, "GeoJSON unmarshalling")
+	}
+	polys := []polygon{}
+	var walk func(obj geoJSON) error
+	walk = func(obj geoJSON) error {
+		var rings [][][][]float64
+		switch obj.Type {
+		case "FeatureCollection":
+			for _, f := range obj.Features {
+				if err := walk(f); err != nil {
+					return err
+				}
+			}
+		case "GeometryCollection":
+			for _, g := range obj.Geometries {
+				if err := walk(g); err != nil {
+					return err
+				}
+			}
+		case "Feature":
+			if obj.Geometry != nil {
+				return walk(*obj.Geometry)
+			}
+		case "Polygon":
+			var poly [][][]float64
+			if err := json.Unmarshal(obj.Coordinates, &poly); err != nil {
+				return errors.Wrapf(err, "GeoJSON polygon coordinates")
+			}
+			rings = append(rings, poly)
+		case "MultiPolygon":
+			if err := json.Unmarshal(obj.Coordinates, &rings); err != nil {
+				return errors.Wrapf(err, "GeoJSON multipolygon coordinates")
+			}
+		}
+		for _, poly := range rings {
+			if len(poly) == 0 {
+				continue
+			}
+			outline := polygon{}
+			for _, p := range poly[0] {
+				if len(p) < 2 {
+					return errors.Errorf("GeoJSON position %v should be [longitude, latitude]", p)
+				}
+				outline = append(outline, GPS{Lat: p[1], Long: p[0]})
+			}
+			polys = append(polys, outline)
+		}
+		return nil
+	}
+	if err := walk(obj); err != nil {
+		return nil, err
+	} else if len(polys) == 0 {
+		return nil, errors.Errorf("GeoJSON has no polygons")
+	}
+	return polys, nil
+}
+
+// Whether the position is inside the polygon, by counting how many edges a line running east
+// from the position crosses. Areas are small enough for lat/long to be treated as flat.
+func (poly polygon) contains(pos GPS) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a.Lat > pos.Lat) != (b.Lat > pos.Lat) &&
+			pos.Long < a.Long+(pos.Lat-a.Lat)*(b.Long-a.Long)/(b.Lat-a.Lat) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func inOperatingArea(pos GPS) bool {
+	if len(operatingArea) == 0 {
+		return true
+	}
+	for _, poly := range operatingArea {
+		if poly.contains(pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// Placeholder positions such as "-27,153" are whole degrees, which real positions practically
+// never are.
+func isPlaceholderPosition(pos GPS) bool {
+	return pos.Lat == math.Trunc(pos.Lat) && pos.Long == math.Trunc(pos.Long)
+}
+
+func isValidPosition(pos GPS) bool {
+	return math.Abs(pos.Lat) <= 90 && math.Abs(pos.Long) <= 180
+}
+
+// Check a candidate job position. A position with latitude and longitude swapped is corrected
+// if the swapped position is valid and in the operating area. Otherwise positions which are
+// placeholders or outside the operating area are rejected with the reason why.
+func checkPosition(pos GPS) (checked GPS, swapped bool, err error) {
+	swap := GPS{Lat: pos.Long, Long: pos.Lat}
+	if pos.IsZero() {
+		return GPS{}, false, errors.Errorf("no position")
+	} else if isPlaceholderPosition(pos) {
+		return GPS{}, false, errors.Errorf("position %s looks like a placeholder", pos)
+	} else if isValidPosition(pos) && inOperatingArea(pos) {
+		return pos, false, nil
+	} else if isValidPosition(swap) && inOperatingArea(swap) {
+		return swap, true, nil
+	} else if !isValidPosition(pos) {
+		return GPS{}, false, errors.Errorf("position %s out of range", pos)
+	}
+	return GPS{}, false, errors.Errorf("position %s is outside the operating area", pos)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Roughly the Gold Coast Broadwater and the waters offshore
+var testArea = []polygon{{
+	{Lat: -27.3, Long: 153.3},
+	{Lat: -27.3, Long: 153.7},
+	{Lat: -28.2, Long: 153.7},
+	{Lat: -28.2, Long: 153.3},
+}}
+
+func TestLoadOperatingArea(t *testing.T) {
+	area, err := loadOperatingArea(areaConfig{}, "")
+	assert.Nil(t, err)
+	assert.Empty(t, area)
+
+	area, err = loadOperatingArea(areaConfig{Points: [][]float64{
+		{-27.3, 153.3}, {-27.3, 153.7}, {-28.2, 153.7}, {-28.2, 153.3},
+	}}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, testArea, area)
+
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "area.geojson"), []byte(`{
+		"type": "FeatureCollection",
+		"features": [{
+			"type": "Feature",
+			"properties": {"name": "Gold Coast"},
+			"geometry": {
+				"type": "Polygon",
+				"coordinates": [[[153.3, -27.3], [153.7, -27.3], [153.7, -28.2], [153.3, -28.2],
+					[153.3, -27.3]]]
+			}
+		}]
+	}`), 0o644))
+	area, err = loadOperatingArea(areaConfig{File: "area.geojson"}, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []polygon{append(testArea[0], GPS{Lat: -27.3, Long: 153.3})}, area)
+
+	_, err = loadOperatingArea(areaConfig{Points: [][]float64{{-27.3, 153.3}, {-27.3}}}, "")
+	assert.NotNil(t, err)
+	_, err = loadOperatingArea(areaConfig{Points: [][]float64{{-27.3, 153.3}, {-27.4, 153.3}}}, "")
+	assert.NotNil(t, err)
+	_, err = loadOperatingArea(areaConfig{File: "missing.geojson"}, dir)
+	assert.NotNil(t, err)
+	_, err = parseGeoJSONArea([]byte(`{"type": "Point", "coordinates": [153.4, -27.9]}`))
+	assert.NotNil(t, err)
+}
+
+func TestCheckPosition(t *testing.T) {
+	operatingArea = testArea
+	defer func() { operatingArea = nil }()
+
+	pos, swapped, err := checkPosition(GPS{-27.95, 153.42})
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	assert.Equal(t, GPS{-27.95, 153.42}, pos)
+
+	pos, swapped, err = checkPosition(GPS{153.42, -27.95})
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	assert.Equal(t, GPS{-27.95, 153.42}, pos)
+
+	_, _, err = checkPosition(GPS{-27, 153})
+	assert.ErrorContains(t, err, "placeholder")
+	_, _, err = checkPosition(GPS{-33.86, 151.21})
+	assert.ErrorContains(t, err, "outside the operating area")
+	_, _, err = checkPosition(GPS{})
+	assert.NotNil(t, err)
+
+	// Without an operating area only placeholders and impossible positions are caught
+	operatingArea = nil
+	_, _, err = checkPosition(GPS{-33.86, 151.21})
+	assert.Nil(t, err)
+	pos, swapped, err = checkPosition(GPS{151.21, -33.86})
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	assert.Equal(t, GPS{-33.86, 151.21}, pos)
+}
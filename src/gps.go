@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"math"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -41,16 +43,25 @@ func (g *GPS) UnmarshalJSON(bytes []byte) error {
 		return nil
 	}
 
-	// Split string into pieces based on spaces or commas
-	if floats, err := pullFloatsFromString(rawString); err != nil {
+	var floats []float64
+	if pos, ok := findCoordinates(rawString); ok {
+		floats = []float64{pos.Lat, pos.Long}
+	} else if f, err := pullFloatsFromString(rawString); err != nil {
+		// Split string into pieces based on spaces or commas
 		return errors.Wrapf(err, "unmarshal GPS float extraction from '%s'", rawString)
-	} else if len(floats) == 1 && floats[0] == 0 {
+	} else {
+		floats = f
+	}
+
+	if len(floats) == 1 && floats[0] == 0 {
 		// Special case - a zero-value is input to ignore this field. Leave the lat and long
 		// values as 0 and do no further actions.
 	} else if len(floats) != 2 {
 		return errors.Errorf("unmarshal GPS expected exactly 2 numbers, got %d from %s",
 			len(floats), rawString)
-	} else if math.Abs(floats[0]) > 90 || math.Abs(floats[1]) > 180 {
+	} else if pos, swap := (GPS{floats[0], floats[1]}), (GPS{floats[1], floats[0]}); !isValidPosition(pos) &&
+		!isValidPosition(swap) {
+		// Positions with latitude and longitude swapped are corrected by checkPosition()
 		return errors.Errorf("GPS position out of range (%f, %f)", floats[0], floats[1])
 	} else {
 		g.Lat = floats[0]
@@ -67,6 +78,30 @@ func (g GPS) AsDMS() (GPS_DMS, error) {
 	}, nil
 }
 
+func (g GPS) String() string {
+	return fmt.Sprintf("%g,%g", g.Lat, g.Long)
+}
+
+// Format the position in degrees, minutes and seconds, e.g. 27°28'31.6"S 153°09'11.7"E.
+func (g GPS) DMSString() string {
+	dms, _ := g.AsDMS()
+	format := func(d DMS, pos, neg string) string {
+		hemisphere := neg
+		if d.Hemisphere {
+			hemisphere = pos
+		}
+		// Round the seconds first so that 59.96 carries into the minutes
+		tenths := int(math.Round((float64(d.Min)*60 + d.Sec) * 10))
+		deg := d.Deg
+		if tenths >= 36000 {
+			deg++
+			tenths -= 36000
+		}
+		return fmt.Sprintf(`%d°%02d'%04.1f"%s`, deg, tenths/600, float64(tenths%600)/10, hemisphere)
+	}
+	return format(dms.Lat, "N", "S") + " " + format(dms.Long, "E", "W")
+}
+
 func (g GPS) IsZero() bool {
 	return (g.Lat == 0.0 && g.Long == 0.0)
 }
@@ -106,3 +141,74 @@ func pullFloatsFromString(in string) ([]float64, error) {
 	}
 	return floats, nil
 }
+
+var (
+	// NMEA latitude and longitude fields, as in "2728.5275,S,15309.1957,E"
+	nmeaRE = regexp.MustCompile(`\b(\d{2})(\d{2}(?:\.\d+)?),\s*([NS]),\s*(\d{3})(\d{2}(?:\.\d+)?),\s*([EW])\b`)
+	// A single latitude or longitude in decimal degrees, DM.m or DMS, as in "-27˚ 28.5275'S" or
+	// "153° 9' 11.74\"E". Either a degree symbol or a hemisphere letter must be present.
+	angleRE = regexp.MustCompile(`([-+]?\d+(?:\.\d+)?)\s*(?:([˚°º])\s*(?:(\d+(?:\.\d+)?)\s*['′’]\s*` +
+		`(?:(\d+(?:\.\d+)?)\s*(?:"|″|”|'')?)?)?)?\s*(?:([NSEW])\b)?`)
+)
+
+// Find a position written in degrees and minutes (or seconds) with hemisphere letters, or in
+// NMEA format, anywhere in the text. Plain decimal numbers aren't matched because notes contain
+// plenty of other numbers. The first latitude and the first longitude are used.
+func findCoordinates(text string) (GPS, bool) {
+	if m := nmeaRE.FindStringSubmatch(text); m != nil {
+		lat, latOK := angleFromParts(m[1], m[2], "", m[3])
+		long, longOK := angleFromParts(m[4], m[5], "", m[6])
+		if latOK && longOK {
+			return GPS{Lat: lat, Long: long}, true
+		}
+	}
+
+	var pos GPS
+	hasLat, hasLong := false, false
+	for _, m := range angleRE.FindAllStringSubmatch(text, -1) {
+		if m[2] == "" && m[5] == "" {
+			continue
+		}
+		angle, ok := angleFromParts(m[1], m[3], m[4], m[5])
+		if !ok {
+			continue
+		}
+		isLat := m[5] == "N" || m[5] == "S" || (m[5] == "" && !hasLat)
+		if isLat && !hasLat && math.Abs(angle) <= 90 {
+			pos.Lat = angle
+			hasLat = true
+		} else if !isLat && !hasLong && math.Abs(angle) <= 180 {
+			pos.Long = angle
+			hasLong = true
+		}
+		if hasLat && hasLong {
+			return pos, true
+		}
+	}
+	return GPS{}, false
+}
+
+// Convert degrees, minutes and seconds to decimal degrees. The result is negative if either the
+// degrees are or the hemisphere is south or west, so "-27˚ 28'S" is still south.
+func angleFromParts(deg, min, sec, hemisphere string) (float64, bool) {
+	d, err := strconv.ParseFloat(deg, 64)
+	if err != nil {
+		return 0, false
+	}
+	var m, s float64
+	if min != "" {
+		if m, err = strconv.ParseFloat(min, 64); err != nil || m >= 60 {
+			return 0, false
+		}
+	}
+	if sec != "" {
+		if s, err = strconv.ParseFloat(sec, 64); err != nil || s >= 60 {
+			return 0, false
+		}
+	}
+	angle := math.Abs(d) + m/60 + s/3600
+	if strings.HasPrefix(deg, "-") || hemisphere == "S" || hemisphere == "W" {
+		angle = -angle
+	}
+	return angle, true
+}
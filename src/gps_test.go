@@ -75,6 +75,12 @@ func TestGPS(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, GPS{Lat: 0, Long: 0}, g)
 
+	// Degrees and minutes
+	err = (&g).UnmarshalJSON([]byte(`"27° 28.5275' S, 153° 9.1957' E"`))
+	assert.Nil(t, err)
+	assert.InDelta(t, -27.475458, g.Lat, 1e-6)
+	assert.InDelta(t, 153.153262, g.Long, 1e-6)
+
 	// Check NULL-value handling
 	err = (&g).UnmarshalJSON([]byte(`null`))
 	assert.Nil(t, err)
@@ -96,6 +102,11 @@ func TestDMSFromDD(t *testing.T) {
 	}, dmsFromDD(-27.84264))
 }
 
+func TestDMSString(t *testing.T) {
+	assert.Equal(t, `27°28'31.6"S 153°09'11.7"E`, GPS{-27.475458084, 153.153261417}.DMSString())
+	assert.Equal(t, `1°00'00.0"N 0°30'00.0"W`, GPS{0.99999999, -0.5}.DMSString())
+}
+
 func TestPullFloatsFromString(t *testing.T) {
 	floats, err := pullFloatsFromString("-27.1 153.1")
 	assert.Nil(t, err)
@@ -125,3 +136,40 @@ func TestPullFloatsFromString(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []float64{-27.2, 153.6}, floats)
 }
+
+func TestFindCoordinates(t *testing.T) {
+	tests := []struct {
+		text string
+		want GPS
+	}{
+		{"RV has arrived at target -> [DM.m Latitude: -27˚ 28.527485060091'S,  Longitude: 153˚ " +
+			"9.1956850340028'E]  [DMS Latitude: -27˚ 28' 31.64910360546S,  Longitude: 153˚ 9' " +
+			"11.741102040168E] ", GPS{-27.475458084, 153.153261417}},
+		{"[DMS Latitude: -27˚ 28' 31.64910360546S,  Longitude: 153˚ 9' 11.741102040168E]",
+			GPS{-27.475458084, 153.153261417}},
+		{`27°28'31.6"S 153°09'11.7"E`, GPS{-27.475444444, 153.153250000}},
+		{"Longitude 153.1532E, latitude 27.4754S", GPS{-27.4754, 153.1532}},
+		{"-27.4754° 153.1532°", GPS{-27.4754, 153.1532}},
+		{"$GPRMC,022421,A,2728.5275,S,15309.1957,E,0.0,0.0,170922,,", GPS{-27.475458333, 153.153261667}},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			pos, ok := findCoordinates(test.text)
+			assert.True(t, ok)
+			assert.InDelta(t, test.want.Lat, pos.Lat, 1e-6)
+			assert.InDelta(t, test.want.Long, pos.Long, 1e-6)
+		})
+	}
+
+	for _, text := range []string{
+		"",
+		"RV has arrived at target",
+		"Towing at 5 knots with 2 POB",
+		"-27.4754 153.1532",
+		"Latitude: -27˚ 28.5275'S",
+		"-27˚ 75.1'S, 153˚ 9.1'E",
+	} {
+		_, ok := findCoordinates(text)
+		assert.False(t, ok, text)
+	}
+}
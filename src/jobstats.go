@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const jobStatsTableName = "VMRSYNC_JOBSTATS"
+
+// The distance and times worked out for each job (see aggregateJobStats()), for the monthly
+// reports to Marine Rescue Queensland. Values which couldn't be worked out are NULL. The same
+// values can also be written to DUTYJOBS columns by mapping the JobStats fields in the schema.
+const jobStatsTableDDL = "CREATE TABLE " + jobStatsTableName + " (" +
+	"TRIPWATCH_ID INTEGER NOT NULL PRIMARY KEY," +
+	"JOBJOBSEQUENCE INTEGER NOT NULL," +
+	"DISTANCE_NM DOUBLE PRECISION," +
+	"MINUTES_TO_TARGET INTEGER," +
+	"MINUTES_ON_SCENE INTEGER," +
+	"MINUTES_TOWING INTEGER)"
+
+// Set once the job stats table is known to exist (see prepareServiceTables()).
+var jobStatsTableReady bool
+
+type jobStatsRow struct {
+	TripWatchID     int             `firebird:"TRIPWATCH_ID,match"`
+	JobID           int             `firebird:"JOBJOBSEQUENCE"`
+	DistanceNM      sql.NullFloat64 `firebird:"DISTANCE_NM"`
+	MinutesToTarget sql.NullInt64   `firebird:"MINUTES_TO_TARGET"`
+	MinutesOnScene  sql.NullInt64   `firebird:"MINUTES_ON_SCENE"`
+	MinutesTowing   sql.NullInt64   `firebird:"MINUTES_TOWING"`
+}
+
+const (
+	earthRadiusNM = 3440.065
+	// The RV has left the scene once a sitrep is this far from where it arrived at the target
+	leftSceneNM = 0.25
+)
+
+// Great-circle distance between two positions in nautical miles.
+func distanceNM(a, b GPS) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Lat - a.Lat)
+	dLong := toRad(b.Long - a.Long)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadiusNM * math.Asin(math.Sqrt(h))
+}
+
+// Whole minutes from one time to another, or 0 if either is missing or they're out of order.
+func minutesBetween(from, to time.Time) int {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return int(math.Round(to.Sub(from).Minutes()))
+}
+
+// Work out the distance steamed along the sitrep track and the times to the target, on scene
+// and towing. Positions which fail checkPosition() are left out of the track.
+func aggregateJobStats(data *linkActivationDB) {
+	sitreps := make([]Sitrep, len(data.Sitreps))
+	copy(sitreps, data.Sitreps)
+	sort.SliceStable(sitreps, func(i, j int) bool {
+		return time.Time(sitreps[i].Updated).Before(time.Time(sitreps[j].Updated))
+	})
+
+	stats := JobStats{}
+	var last GPS
+	var arrived, towing *Sitrep
+	var arrivedPos GPS
+	var leftScene time.Time
+	for i := range sitreps {
+		sr := &sitreps[i]
+		pos, _, err := checkPosition(sr.Position())
+		if err == nil {
+			if !last.IsZero() {
+				stats.DistanceNM += distanceNM(last, pos)
+			}
+			last = pos
+		}
+		if arrived == nil && strings.HasPrefix(sr.Comment, "RV has arrived at target") {
+			arrived = sr
+			if err == nil {
+				arrivedPos = pos
+			}
+		} else if towing == nil && strings.HasPrefix(sr.Comment, "Target vessel in tow") {
+			towing = sr
+		} else if arrived != nil && leftScene.IsZero() && err == nil && !arrivedPos.IsZero() &&
+			distanceNM(arrivedPos, pos) > leftSceneNM {
+			leftScene = time.Time(sr.Updated)
+		}
+	}
+	stats.DistanceNM = math.Round(stats.DistanceNM*10) / 10
+
+	start := time.Time(data.Job.StartTime)
+	end := time.Time(data.Job.EndTime)
+	if arrived != nil {
+		stats.MinutesToTarget = minutesBetween(start, time.Time(arrived.Updated))
+		if towing != nil {
+			leftScene = time.Time(towing.Updated)
+		}
+		stats.MinutesOnScene = minutesBetween(time.Time(arrived.Updated), leftScene)
+	}
+	if towing != nil {
+		stats.MinutesTowing = minutesBetween(time.Time(towing.Updated), end)
+	}
+	data.Job.JobStats = stats
+}
+
+func formatMinutes(minutes int) string {
+	if minutes < 60 {
+		return fmt.Sprintf("%d min", minutes)
+	}
+	return fmt.Sprintf("%d h %02d min", minutes/60, minutes%60)
+}
+
+// Summarise the job stats for the job comments.
+func statsComments(stats JobStats) string {
+	lines := []string{}
+	if stats.DistanceNM > 0 {
+		lines = append(lines, fmt.Sprintf("* %.1f NM steamed", stats.DistanceNM))
+	}
+	if stats.MinutesToTarget > 0 {
+		lines = append(lines, fmt.Sprintf("* %s from departure to target", formatMinutes(stats.MinutesToTarget)))
+	}
+	if stats.MinutesOnScene > 0 {
+		lines = append(lines, fmt.Sprintf("* %s on scene", formatMinutes(stats.MinutesOnScene)))
+	}
+	if stats.MinutesTowing > 0 {
+		lines = append(lines, fmt.Sprintf("* %s from tow to return", formatMinutes(stats.MinutesTowing)))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return "Job summary:\n" + strings.Join(lines, "\n") + "\n\n"
+}
+
+// Record the job stats in the sidecar table.
+func saveJobStats(ctx context.Context, db dbExecutor, data *linkActivationDB, link jobLink) error {
+	if !jobStatsTableReady || link.JobID == 0 {
+		return nil
+	}
+	stats := data.Job.JobStats
+	row := jobStatsRow{
+		TripWatchID:     data.ID,
+		JobID:           link.JobID,
+		DistanceNM:      sql.NullFloat64{Float64: stats.DistanceNM, Valid: stats.DistanceNM > 0},
+		MinutesToTarget: sql.NullInt64{Int64: int64(stats.MinutesToTarget), Valid: stats.MinutesToTarget > 0},
+		MinutesOnScene:  sql.NullInt64{Int64: int64(stats.MinutesOnScene), Valid: stats.MinutesOnScene > 0},
+		MinutesTowing:   sql.NullInt64{Int64: int64(stats.MinutesTowing), Valid: stats.MinutesTowing > 0},
+	}
+	if err := upsertRow(ctx, db, jobStatsTableName, row, true); err != nil {
+		return errors.Wrapf(err, "save job stats for activation %d", data.ID)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistanceNM(t *testing.T) {
+	// One minute of latitude is a nautical mile
+	assert.InDelta(t, 1.0, distanceNM(GPS{-27.5, 153.4}, GPS{-27.5 - 1.0/60, 153.4}), 0.001)
+	assert.InDelta(t, 60.0, distanceNM(GPS{0, 10}, GPS{0, 11}), 0.05)
+	assert.Equal(t, 0.0, distanceNM(GPS{-27.5, 153.4}, GPS{-27.5, 153.4}))
+}
+
+func TestAggregateJobStats(t *testing.T) {
+	sitrep := func(ts string, pos GPS, comment string) Sitrep {
+		return Sitrep{Updated: CustomJSONTime(getTime(t, ts)), Pos: pos, Comment: comment}
+	}
+	data := &linkActivationDB{
+		Job: Job{
+			StartTime: CustomJSONTime(getTime(t, "2022-09-17T02:00:00Z")),
+			EndTime:   CustomJSONTime(getTime(t, "2022-09-17T04:10:00Z")),
+		},
+		Sitreps: []Sitrep{
+			sitrep("2022-09-17T02:05:00Z", GPS{-27.95, 153.42}, "Underway"),
+			// Out of order, as TripWatch sometimes returns them
+			sitrep("2022-09-17T02:55:00Z", GPS{-27.80, 153.42}, "Target vessel in tow"),
+			sitrep("2022-09-17T02:35:00Z", GPS{-27.80, 153.42}, "RV has arrived at target"),
+			// Placeholder positions don't count towards the distance
+			sitrep("2022-09-17T03:00:00Z", GPS{-27, 153}, "Heading home"),
+			sitrep("2022-09-17T04:05:00Z", GPS{-27.95, 153.42}, "Back at base"),
+		},
+	}
+	aggregateJobStats(data)
+	assert.Equal(t, JobStats{
+		DistanceNM:      18.0,
+		MinutesToTarget: 35,
+		MinutesOnScene:  20,
+		MinutesTowing:   75,
+	}, data.Job.JobStats)
+	assert.Equal(t, "Job summary:\n"+
+		"* 18.0 NM steamed\n"+
+		"* 35 min from departure to target\n"+
+		"* 20 min on scene\n"+
+		"* 1 h 15 min from tow to return\n\n", statsComments(data.Job.JobStats))
+
+	// Without a tow, the RV leaves the scene when it moves away from the target
+	data.Sitreps[1].Comment = "Standing by"
+	data.Sitreps[3].Pos = GPS{-27.85, 153.42}
+	aggregateJobStats(data)
+	assert.Equal(t, JobStats{
+		DistanceNM:      18.0,
+		MinutesToTarget: 35,
+		MinutesOnScene:  25,
+	}, data.Job.JobStats)
+
+	// Nothing can be worked out without sitreps
+	data.Sitreps = nil
+	aggregateJobStats(data)
+	assert.Equal(t, JobStats{}, data.Job.JobStats)
+	assert.Equal(t, "", statsComments(data.Job.JobStats))
+}
+
+func TestJobStatsSchemaColumns(t *testing.T) {
+	// The stats can be written to DUTYJOBS columns by mapping them in a schema override
+	schema, err := parseSchema([]byte(`
+tables:
+  - table: DUTYJOBS
+    columns:
+      - {column: JOBDISTANCE, field: JobStats.DistanceNM}
+      - {column: JOBONSCENE, field: MinutesOnScene}
+`))
+	assert.Nil(t, err)
+	data := &linkActivationDB{Job: Job{JobStats: JobStats{DistanceNM: 12.5, MinutesOnScene: 20}}}
+	tables, err := schema.columns(data)
+	assert.Nil(t, err)
+	col, ok := schemaColumn(tables[jobTableName], "JOBDISTANCE")
+	assert.True(t, ok)
+	assert.Equal(t, 12.5, col.value)
+	col, ok = schemaColumn(tables[jobTableName], "JOBONSCENE")
+	assert.True(t, ok)
+	assert.Equal(t, 20, col.value)
+}
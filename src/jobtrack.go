@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const jobTrackTableName = "VMRSYNC_JOBTRACK"
+
+// Every sitrep position reported during a job, so that the full track of the rescue vessel is
+// available for post-incident reviews. DUTYJOBS only has room for a single position (see
+// setGPS()).
+const jobTrackTableDDL = "CREATE TABLE " + jobTrackTableName + " (" +
+	"JOBJOBSEQUENCE INTEGER NOT NULL," +
+	"SITREP_ID INTEGER NOT NULL," +
+	"TRIPWATCH_ID INTEGER NOT NULL," +
+	"REPORTED TIMESTAMP," +
+	"LATITUDE DOUBLE PRECISION," +
+	"LONGITUDE DOUBLE PRECISION," +
+	"SPEED DOUBLE PRECISION," +
+	"HEADING DOUBLE PRECISION," +
+	"NOTE VARCHAR(1024)," +
+	"AUTHOR VARCHAR(100)," +
+	"PRIMARY KEY (JOBJOBSEQUENCE,SITREP_ID))"
+
+// Set once the job track table is known to exist (see prepareServiceTables()).
+var jobTrackTableReady bool
+
+type trackPoint struct {
+	JobID       int            `firebird:"JOBJOBSEQUENCE,match"`
+	SitrepID    int            `firebird:"SITREP_ID,match"`
+	TripWatchID int            `firebird:"TRIPWATCH_ID"`
+	Reported    CustomJSONTime `firebird:"REPORTED"`
+	Lat         float64        `firebird:"LATITUDE"`
+	Long        float64        `firebird:"LONGITUDE"`
+	Speed       float64        `firebird:"SPEED"`
+	Heading     float64        `firebird:"HEADING"`
+	Note        string         `firebird:"NOTE" len:"1024"`
+	Author      string         `firebird:"AUTHOR" len:"100"`
+}
+
+// The track points for each sitrep with a position, either recorded by TripWatch or written in
+// the note.
+func jobTrack(data *linkActivationDB, jobID int) []trackPoint {
+	track := []trackPoint{}
+	for _, sr := range data.Sitreps {
+		pos := sr.Position()
+		if sr.ID == 0 || pos.IsZero() {
+			continue
+		}
+		track = append(track, trackPoint{
+			JobID:       jobID,
+			SitrepID:    sr.ID,
+			TripWatchID: data.ID,
+			Reported:    sr.Updated,
+			Lat:         pos.Lat,
+			Long:        pos.Long,
+			Speed:       usageValue(sr.Speed),
+			Heading:     usageValue(sr.Heading),
+			Note:        truncate(strings.TrimSpace(sr.Comment), 1024),
+			Author:      truncate(sr.UpdatedBy, 100),
+		})
+	}
+	return track
+}
+
+// Write the activation's track to the job it is linked to. Points for sitreps which have since
+// been deleted in TripWatch are removed.
+func saveJobTrack(ctx context.Context, db dbExecutor, data *linkActivationDB, link jobLink) error {
+	if !jobTrackTableReady || link.JobID == 0 {
+		return nil
+	}
+	track := jobTrack(data, link.JobID)
+	for _, point := range track {
+		if err := upsertRow(ctx, db, jobTrackTableName, point, true); err != nil {
+			return errors.Wrapf(err, "save job track for activation %d sitrep %d",
+				data.ID, point.SitrepID)
+		}
+	}
+
+	stmt := "DELETE FROM " + jobTrackTableName + " WHERE JOBJOBSEQUENCE=?"
+	args := []interface{}{link.JobID}
+	if len(track) > 0 {
+		params := make([]string, 0, len(track))
+		for _, point := range track {
+			params = append(params, "?")
+			args = append(args, point.SitrepID)
+		}
+		stmt += fmt.Sprintf(" AND SITREP_ID NOT IN (%s)", strings.Join(params, ","))
+	}
+	if _, err := db.ExecContext(ctx, stmt, args...); err != nil {
+		return errors.Wrapf(dbError{
+			error:     err,
+			name:      jobTrackTableName,
+			statement: stmt,
+		}, "save job track for activation %d removing old points", data.ID)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobTrack(t *testing.T) {
+	data := &linkActivationDB{
+		ID: 42,
+		Sitreps: []Sitrep{
+			{ID: 101, Updated: CustomJSONTime(getTime(t, "2022-09-17T02:24:21Z")),
+				UpdatedBy: "radio@mrq.org.au", Pos: GPS{-27.557, 153.456}, Speed: 12.3, Heading: 270,
+				Comment: "Underway "},
+			{ID: 102, Comment: "Waiting for the tide"},
+			{ID: 103, Updated: CustomJSONTime(getTime(t, "2022-09-17T02:40:00Z")),
+				Comment: "RV has arrived at target -> [DM.m Latitude: -27˚ 30'S,  Longitude: 153˚ 6'E]"},
+		},
+	}
+	assert.Equal(t, []trackPoint{
+		{
+			JobID:       7,
+			SitrepID:    101,
+			TripWatchID: 42,
+			Reported:    CustomJSONTime(getTime(t, "2022-09-17T02:24:21Z")),
+			Lat:         -27.557,
+			Long:        153.456,
+			Speed:       12.3,
+			Heading:     270,
+			Note:        "Underway",
+			Author:      "radio@mrq.org.au",
+		},
+		{
+			JobID:       7,
+			SitrepID:    103,
+			TripWatchID: 42,
+			Reported:    CustomJSONTime(getTime(t, "2022-09-17T02:40:00Z")),
+			Lat:         -27.5,
+			Long:        153.1,
+			Note:        "RV has arrived at target -> [DM.m Latitude: -27˚ 30'S,  Longitude: 153˚ 6'E]",
+		},
+	}, jobTrack(data, 7))
+
+	assert.Empty(t, jobTrack(&linkActivationDB{ID: 42}, 7))
+
+	// Long notes and authors are cut short to fit their columns, without splitting the ˚
+	data.Sitreps = []Sitrep{{ID: 104, Pos: GPS{-27.557, 153.456},
+		UpdatedBy: strings.Repeat("a", 120) + "@mrq.org.au",
+		Comment:   strings.Repeat("x", 1023) + "˚ 30'S and a long way past the end of the column"}}
+	track := jobTrack(data, 7)
+	if assert.Len(t, track, 1) {
+		assert.Equal(t, strings.Repeat("x", 1023), track[0].Note)
+		assert.Equal(t, strings.Repeat("a", 100), track[0].Author)
+	}
+}
@@ -4,107 +4,150 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mfitzpatrick/vmrsync/src/forecast"
 	"github.com/pkg/errors"
 )
 
 /*
  * Design Philosophy:
  * The purpose of this file is to link the VMR Firebird database with the TripWatch JSON
- * API. This is done using struct tags. When data is received from TripWatch, it is sorted
- * into fields in this structure using the appropriately-named struct tags. Then the same
- * data is sent to the corresponding firebird DB table also by using the firebird struct
- * tags.
+ * API. When data is received from TripWatch, it is sorted into fields in this structure
+ * using the json struct tags. The fields of the activation are then mapped to firebird DB
+ * columns by the schema in schema.yml (see schema.go), which can be overridden in the config.
+ * The firebird struct tags are only used for the tables which vmrsync itself maintains.
  */
 
 type VMRVessel struct {
-	ID             int               `firebird:"JOBDUTYVESSELNO" json:"activationsrvsequence"`
-	Name           VMRVesselNameEnum `firebird:"JOBDUTYVESSELNAME,match" len:"30" json:"activationsrvvessel"`
-	StartHoursPort IntString         `firebird:"JOBHOURSSTART" json:"activationsrvenginehours1start"`
+	ID             int               `json:"activationsrvsequence"`
+	Name           VMRVesselNameEnum `json:"activationsrvvessel"`
+	StartHoursPort IntString         `json:"activationsrvenginehours1start"`
 	StartHoursStbd IntString         `json:"activationsrvenginehours2start"`
-	EndHoursPort   IntString         `firebird:"JOBHOURSEND" json:"activationsrvenginehours1end"`
+	EndHoursPort   IntString         `json:"activationsrvenginehours1end"`
 	EndHoursStbd   IntString         `json:"activationsrvenginehours2end"`
+	StartHours3    IntString         `json:"activationsrvenginehours3start"`
+	EndHours3      IntString         `json:"activationsrvenginehours3end"`
+	FuelUsed       IntString         `json:"activationsfuelused"`
 	Master         string            `json:"activationsrvmaster"`
 	CrewList       StringList        `json:"activationsrvcrew"`
 }
 
 type AssistedVessel struct {
-	Rego       string         `firebird:"JOBVESSELREGO" len:"10" json:"activationsdvvesselsregistration"`
-	Name       string         `firebird:"JOBVESSELNAME" len:"30" json:"activationsdvvesselsname"`
-	Length     LengthEnum     `firebird:"JOBLOA" len:"10" json:"activationsdvvesselslength"`
-	Type       BoatTypeEnum   `firebird:"JOBVESSELTYPE" len:"20" json:"activationsdvvesselstype"`
-	Propulsion PropulsionEnum `firebird:"JOBPROPULSION" len:"20" json:"activationsdvvesselsenginetype"`
+	Rego       string         `json:"activationsdvvesselsregistration"`
+	Name       string         `json:"activationsdvvesselsname"`
+	Length     LengthEnum     `json:"activationsdvvesselslength"`
+	Type       BoatTypeEnum   `json:"activationsdvvesselstype"`
+	Propulsion PropulsionEnum `json:"activationsdvvesselsenginetype"`
 	EngineQTY  int            `json:"activationsdvvesselsenginequantity"`
-	NumAdults  int            `firebird:"JOBADULTS" json:"activationsdvpobadult"`
-	NumKids    int            `firebird:"JOBCHILDREN" json:"activationsdvpobchildren"`
+	NumAdults  int            `json:"activationsdvpobadult"`
+	NumKids    int            `json:"activationsdvpobchildren"`
 	Phone      IntString      `json:"activationsdvcontactnumber"`
 	RadioChan  IntString      `json:"activationsdvradiochannel"`
 }
 
 type Emergency struct {
-	Emergency         CustomBool     `firebird:"JOBEMERGENCY" len:"1"`
-	PoliceNum         string         `firebird:"JOBQASNO" len:"10" json:"activationspoliceincidentnumber"`
-	Notified          CustomBool     `firebird:"JOBPOLICE" len:"1" json:"activationspolicenotified"`
+	Emergency         CustomBool
+	PoliceNum         string         `json:"activationspoliceincidentnumber"`
+	Notified          CustomBool     `json:"activationspolicenotified"`
 	PoliceName        string         `json:"activationspolicenotifiedcontact"`
 	Time              CustomJSONTime `json:"activationspolicenotifiedtime"`
 	AgenciesAttending StringList     `json:"activationsqasattending"`
 }
 
 type FirebirdGPS struct {
-	Lat  float64 `firebird:"JOBLATDEC"`
-	Long float64 `firebird:"JOBLONDEC"`
+	Lat  float64
+	Long float64
 
 	// Breaking it down to DMS for Firebird
-	LatD  int     `firebird:"JOBLATDEG"`
-	LatM  int     `firebird:"JOBLATMIN"`
-	LatS  float64 `firebird:"JOBLATSEC"`
-	LongD int     `firebird:"JOBLONDEG"`
-	LongM int     `firebird:"JOBLONMIN"`
-	LongS float64 `firebird:"JOBLONSEC"`
+	LatD  int
+	LatM  int
+	LatS  float64
+	LongD int
+	LongM int
+	LongS float64
 }
 
 type Weather struct {
-	Forecast  string        `json:"activationsactivationweatherforecast"`
-	WindSpeed WindSpeedEnum `firebird:"JOBWINDSPEED" len:"20"`
-	WindDir   WindDirEnum   `firebird:"JOBWINDDIRECTION" len:"3"`
-	RainState string        `firebird:"JOBWEATHER" len:"20"`
+	Forecast  string `json:"activationsactivationweatherforecast"`
+	Tides     string `json:"activationsactivationhightidetime"`
+	WindSpeed WindSpeedEnum
+	WindDir   WindDirEnum
+	RainState string
+	tides     []forecast.Tide // Parsed from Tides
+}
+
+// Risk scores derived from the TripWatch activation risks (see aggregateRisks()).
+type JobRisks struct {
+	Risk1 int
+	Risk2 int
+	Risk3 int
+	Risk4 int
+	Risk5 int
+}
+
+// Distance steamed and times worked out from the sitreps (see aggregateJobStats()). Times are
+// in minutes, and each is zero if the sitreps needed for it are missing.
+type JobStats struct {
+	DistanceNM      float64
+	MinutesToTarget int // From departure until arriving at the target
+	MinutesOnScene  int // From arriving at the target until starting the tow or leaving
+	MinutesTowing   int // From starting the tow until returning
 }
 
 type Job struct {
-	DutyLogID   int             `firebird:"JOBDUTYSEQUENCE,id"` //NB: hacky use of the `id` label. Don't change order.
-	ID          int             `firebird:"JOBJOBSEQUENCE,id"`
+	DutyLogID   int // Sequence numbers, which are filled in from the DB
+	ID          int
 	Status      string          `json:"activationsstatus"`
-	StartTime   CustomJSONTime  `firebird:"JOBTIMEOUT,match" json:"activationsrvdeparttime"`
-	EndTime     CustomJSONTime  `firebird:"JOBTIMEIN" json:"activationsrvreturntime"`
-	Type        JobType         `firebird:"JOBTYPE" len:"20" json:"activationstype"`
-	Action      JobAction       `firebird:"JOBACTIONTAKEN" len:"20" json:"activationsdvactionrequested"`
-	Purpose     string          `firebird:"JOBDETAILS" len:"96" json:"activationspurpose"`
-	Comments    string          `firebird:"JOBDETAILS_LONG" len:"4096" json:"activationscomments"`
-	Donation    IntString       `firebird:"JOBDONATION" json:"activationsdonationreceived"`
-	Frequency   string          `firebird:"JOBFREQUENCY" len:"30"`
-	WaterLimits WaterLimitsEnum `firebird:"JOBWATERLIMITS" len:"20" json:"activationsoperationsareaclassification"`
-	SeaState    SeaStateEnum    `firebird:"JOBSEAS" len:"20" json:"activationsobservedseastate"`
-	Commercial  CustomBool      `firebird:"JOBCOMMERCIALVESSEL" len:"1"`
-	Pos         GPS             `json:"activationsposition"`
-	ActivatedBy JobSource       `firebird:"JOBACTIVATION" len:"20" json:"activationssource"`
-	Freq        JobFreq         `firebird:"JOBFREQUENCY" len:"30"`
-	AssistNum   IntString       `firebird:"JOBASSISTNO" json:"activationsdonationreceiptnumber"`
+	StartTime   CustomJSONTime  `json:"activationsrvdeparttime"`
+	EndTime     CustomJSONTime  `json:"activationsrvreturntime"`
+	Type        JobType         `json:"activationstype"`
+	Action      JobAction       `json:"activationsdvactionrequested"`
+	Purpose     string          `json:"activationspurpose"`
+	Comments    string          `json:"activationscomments"`
+	Donation    IntString       `json:"activationsdonationreceived"`
+	WaterLimits WaterLimitsEnum `json:"activationsoperationsareaclassification"`
+	SeaState    SeaStateEnum    `json:"activationsobservedseastate"`
+	Commercial  CustomBool
+	Pos         GPS       `json:"activationsposition"`
+	ActivatedBy JobSource `json:"activationssource"`
+	Freq        JobFreq
+	AssistNum   IntString `json:"activationsdonationreceiptnumber"`
 	VMRVessel
 	AssistedVessel
 	Emergency
 	FirebirdGPS
 	Weather
+	JobRisks
+	JobStats
 }
 
 type linkActivationDB struct {
 	ID      int            `json:"id"`
 	Created CustomJSONTime `json:"created_at"`
 	Updated CustomJSONTime `json:"updated_at"`
-	Job     `firebird:"DUTYJOBS"`
+	Job
 	Sitreps []Sitrep
+	Risks   []Risk
+	raw     json.RawMessage // The activation as returned by TripWatch
+	// Problems with the activation's data which didn't stop it being synced
+	warnings []string
+	// Synced by a backfill, so the job belongs to the duty on the day of the activation
+	historical bool
+}
+
+// Record a problem with the activation's data. Warnings are logged, and listed in the dry run
+// report instead during a dry run. The sync cycle also lists them in its report and on the status
+// page (see cycleReport()).
+func (a *linkActivationDB) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	a.warnings = append(a.warnings, msg)
+	if !dryRun {
+		log.Printf("Activation %d: %s", a.ID, msg)
+	}
 }
 
 type DutyLogTable struct {
@@ -150,16 +193,43 @@ type crewOnJob struct {
 
 // This matches the data returned by the /activationtransactions API.
 type Sitrep struct {
-	Updated CustomJSONTime `json:"updated_at"`
-	Pos     GPS            `json:"activationstransactionscurrentposition"`
-	Comment string         `json:"activationstransactionsnote"`
+	ID        int            `json:"id"`
+	Updated   CustomJSONTime `json:"updated_at"`
+	UpdatedBy string         `json:"activationstransactionsupdatedby"`
+	Pos       GPS            `json:"activationstransactionscurrentposition"`
+	Speed     IntString      `json:"activationstransactionscurrentspeed"`
+	Heading   IntString      `json:"activationstransactionscurrentheading"`
+	Comment   string         `json:"activationstransactionsnote"`
+}
+
+type Risk struct {
+	ID          int            `json:"id"`
+	Updated     CustomJSONTime `json:"updated_at"`
+	Priority    IntString      `json:"activationsriskspriority"`
+	Status      string         `json:"activationsrisksstatus"`
+	Description string         `json:"activationsrisksdescription"`
+}
+
+// The sitrep's position, or the one written in its note if TripWatch didn't record a position
+// (the app adds "[DM.m Latitude: ..., Longitude: ...]" to some notes).
+func (s Sitrep) Position() GPS {
+	if s.Pos.IsZero() {
+		if pos, ok := findCoordinates(s.Comment); ok {
+			return pos
+		}
+	}
+	return s.Pos
+}
+
+func (r Risk) IsAcknowledged() bool {
+	return strings.ToLower(strings.TrimSpace(r.Status)) != "unacknowledged"
 }
 
 var sitrepNotFoundError = errors.New("sitrep not found")
 
 func getEntryForComment(s []Sitrep, comment string) (Sitrep, error) {
 	for _, sr := range s {
-		if strings.HasPrefix(sr.Comment, comment) && !sr.Pos.IsZero() {
+		if strings.HasPrefix(sr.Comment, comment) && !sr.Position().IsZero() {
 			return sr, nil
 		}
 	}
@@ -422,27 +492,9 @@ func (j *JobType) UnmarshalJSON(bytes []byte) error {
 	var jt string
 	if err := json.Unmarshal(bytes, &jt); err != nil {
 		return errors.Wrapf(err, "JobType parse JSON '%s'", string(bytes))
-	} else {
-		switch jt {
-		case "Medivac":
-			*j = JobType("Medical")
-		case "SAR":
-			*j = JobType("Search")
-		case "Assist":
-			*j = JobType("Breakdown")
-		case "Training":
-			*j = JobType("Training/Patrol")
-		case "Scattering of Ashes":
-			*j = JobType("Dispersal")
-		case "Public Service":
-			*j = JobType("PR/Promo")
-		case "MAYDAY", "PANPAN":
-			*j = JobType("EPIRB")
-		default:
-			*j = JobType(jt)
-		}
-		return nil
 	}
+	*j = JobType(mapEnum(mapJobType, jt))
+	return nil
 }
 
 func (j JobType) ToJobAction() JobAction {
@@ -468,37 +520,9 @@ func (j *JobAction) UnmarshalJSON(bytes []byte) error {
 	var ja string
 	if err := json.Unmarshal(bytes, &ja); err != nil {
 		return errors.Wrapf(err, "JobAction parse JSON '%s'", string(bytes))
-	} else {
-		lja := strings.ToLower(ja)
-		switch {
-		case strings.Contains(lja, "jump"):
-			*j = JobAction("Jump Start")
-		case strings.Contains(lja, "medivac"),
-			strings.Contains(lja, "medevac"),
-			strings.Contains(lja, "medical"):
-			*j = JobAction("Medivac")
-		case strings.Contains(lja, "nil"):
-			*j = JobAction("Nil")
-		case strings.Contains(lja, "pump"):
-			*j = JobAction("Pump Out")
-		case strings.Contains(lja, "search"),
-			strings.Contains(lja, "sar"):
-			*j = JobAction("Search & Rescue")
-		case strings.Contains(lja, "fuel"):
-			*j = JobAction("Supplied Fuel")
-		case strings.Contains(lja, "tow"):
-			*j = JobAction("Tow")
-		case strings.Contains(lja, "train"):
-			*j = JobAction("Training")
-		case strings.Contains(lja, "unground"):
-			*j = JobAction("Ungrounded")
-		case strings.Contains(lja, "investigate"):
-			*j = JobAction("Investigate")
-		default:
-			*j = JobAction("Other")
-		}
-		return nil
 	}
+	*j = JobAction(mapEnum(mapJobAction, ja))
+	return nil
 }
 
 func (j JobAction) IsZero() bool {
@@ -511,17 +535,9 @@ func (w *WaterLimitsEnum) UnmarshalJSON(bytes []byte) error {
 	var wl string
 	if err := json.Unmarshal(bytes, &wl); err != nil {
 		return errors.Wrapf(err, "WaterLimitsEnum parse JSON '%s'", string(bytes))
-	} else {
-		switch wl {
-		case "A", "B", "C":
-			*w = WaterLimitsEnum("Open")
-		case "D":
-			*w = WaterLimitsEnum("Partially Smooth")
-		case "E":
-			*w = WaterLimitsEnum("Smooth")
-		}
-		return nil
 	}
+	*w = WaterLimitsEnum(mapEnum(mapWaterLimits, wl))
+	return nil
 }
 
 type VMRVesselNameEnum string
@@ -530,19 +546,9 @@ func (n *VMRVesselNameEnum) UnmarshalJSON(bytes []byte) error {
 	var vn string
 	if err := json.Unmarshal(bytes, &vn); err != nil {
 		return errors.Wrapf(err, "VMRVesselNameEnum parse JSON '%s'", string(bytes))
-	} else {
-		switch vn {
-		case "MARINERESCUE1":
-			*n = VMRVesselNameEnum("Marine Rescue 1")
-		case "MARINERESCUE2":
-			*n = VMRVesselNameEnum("Marine Rescue 2")
-		case "MARINERESCUE4":
-			*n = VMRVesselNameEnum("Marine Rescue 4")
-		case "MARINERESCUE5":
-			*n = VMRVesselNameEnum("Marine Rescue 5")
-		}
-		return nil
 	}
+	*n = VMRVesselNameEnum(mapEnum(mapVesselName, vn))
+	return nil
 }
 
 type BoatTypeEnum string
@@ -551,22 +557,8 @@ func (b *BoatTypeEnum) UnmarshalJSON(bytes []byte) error {
 	var bn string
 	if err := json.Unmarshal(bytes, &bn); err != nil {
 		return errors.Wrapf(err, "BoatTypeEnum parse JSON '%s'", string(bytes))
-	} else {
-		bn = strings.ToLower(bn)
-		switch {
-		case strings.Contains(bn, "jet ski"), strings.Contains(bn, "jetski"):
-			*b = "PWC"
-		case strings.Contains(bn, "yacht"), strings.Contains(bn, "sail"),
-			strings.Contains(bn, "ketch"), strings.Contains(bn, "schooner"):
-			*b = "Sailing"
-		case strings.Contains(bn, "kayak"), strings.Contains(bn, "paddle"):
-			*b = "Paddle"
-		default:
-			if len(bn) > 0 {
-				*b = "Speed/Motor Boat"
-			}
-		}
 	}
+	*b = BoatTypeEnum(mapEnum(mapBoatType, bn))
 	return nil
 }
 
@@ -581,26 +573,8 @@ func (p *PropulsionEnum) UnmarshalJSON(bytes []byte) error {
 	var pn string
 	if err := json.Unmarshal(bytes, &pn); err != nil {
 		return errors.Wrapf(err, "PropulsionEnum parse JSON '%s'", string(bytes))
-	} else {
-		pn = strings.ToLower(pn)
-		if len(strings.TrimSpace(pn)) == 0 {
-			// Special case - ignore empty string
-			*p = PropulsionEnum("")
-			return nil
-		}
-		switch {
-		case strings.Contains(pn, "outboard"):
-			*p = "Single Outboard"
-		case strings.Contains(pn, "inboard"):
-			*p = "Single Inboard"
-		case strings.Contains(pn, "paddle"), strings.Contains(pn, "oar"):
-			*p = "Oars"
-		case strings.Contains(pn, "wind"), strings.Contains(pn, "sail"):
-			*p = "Sail"
-		default:
-			*p = "Single Outboard"
-		}
 	}
+	*p = PropulsionEnum(mapEnum(mapPropulsion, pn))
 	return nil
 }
 
@@ -632,16 +606,8 @@ func (j *JobSource) UnmarshalJSON(bytes []byte) error {
 	var js string
 	if err := json.Unmarshal(bytes, &js); err != nil {
 		return errors.Wrapf(err, "JobSource parse JSON '%s'", string(bytes))
-	} else {
-		switch js {
-		case "Water Police", "Land Police":
-			*j = "Police"
-		case "Ambulance Service":
-			*j = "QAS"
-		default:
-			*j = "Base"
-		}
 	}
+	*j = JobSource(mapEnum(mapJobSource, js))
 	return nil
 }
 
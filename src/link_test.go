@@ -91,4 +91,15 @@ func TestSitrepGet(t *testing.T) {
 	sr, err := getEntryForComment(s, "RV has arrived at target")
 	assert.Nil(t, err)
 	assert.Equal(t, GPS{-27, 153}, sr.Pos)
+
+	// The position in the note is used if none was recorded
+	s = []Sitrep{
+		{Comment: "RV has arrived at target"},
+		{Comment: "RV has arrived at target -> [DM.m Latitude: -27˚ 30'S,  Longitude: 153˚ 6'E]"},
+	}
+	sr, err = getEntryForComment(s, "RV has arrived at target")
+	assert.Nil(t, err)
+	assert.Equal(t, GPS{-27.5, 153.1}, sr.Position())
+	sr.Pos = GPS{-27, 153}
+	assert.Equal(t, GPS{-27, 153}, sr.Position())
 }
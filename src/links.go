@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const linkTableName = "VMRSYNC_LINKS"
+
+// Maps each TripWatch activation to the DUTYJOBS row it was written to. Once an activation has
+// a link, the job is found by its sequence numbers rather than by departure time and vessel
+// name, so that edits to those fields in TripWatch update the existing job.
+const linkTableDDL = "CREATE TABLE " + linkTableName + " (" +
+	"TRIPWATCH_ID INTEGER NOT NULL PRIMARY KEY," +
+	"JOBDUTYSEQUENCE INTEGER NOT NULL," +
+	"JOBJOBSEQUENCE INTEGER NOT NULL," +
+	"LAST_SYNCED TIMESTAMP," +
+	"PAYLOAD_HASH CHAR(64))"
+
+// Set once the link table is known to exist (see prepareServiceTables()). Links are neither
+// read nor written until then.
+var linkTableReady bool
+
+type jobLink struct {
+	TripWatchID int       `firebird:"TRIPWATCH_ID,match"`
+	DutyLogID   int       `firebird:"JOBDUTYSEQUENCE"`
+	JobID       int       `firebird:"JOBJOBSEQUENCE"`
+	LastSynced  time.Time `firebird:"LAST_SYNCED"`
+	PayloadHash string    `firebird:"PAYLOAD_HASH" len:"64"`
+}
+
+// Find the job linked to a TripWatch activation. The returned bool is false if there is no link.
+func findLink(ctx context.Context, db dbExecutor, tripwatchID int) (jobLink, bool, error) {
+	stmt := "SELECT JOBDUTYSEQUENCE,JOBJOBSEQUENCE,LAST_SYNCED,PAYLOAD_HASH FROM " +
+		linkTableName + " WHERE TRIPWATCH_ID=?"
+	if rows, err := db.QueryContext(ctx, stmt, tripwatchID); err != nil {
+		return jobLink{}, false, errors.Wrapf(dbError{
+			error:     err,
+			name:      linkTableName,
+			statement: stmt,
+		}, "find link for activation %d", tripwatchID)
+	} else {
+		defer rows.Close()
+		if !rows.Next() {
+			return jobLink{}, false, nil
+		}
+		link := jobLink{TripWatchID: tripwatchID}
+		var lastSynced sql.NullTime
+		var hash sql.NullString
+		if err := rows.Scan(&link.DutyLogID, &link.JobID, &lastSynced, &hash); err != nil {
+			return jobLink{}, false, errors.Wrapf(dbError{
+				error:     err,
+				name:      linkTableName,
+				statement: stmt,
+			}, "find link for activation %d reading row", tripwatchID)
+		}
+		link.LastSynced = lastSynced.Time
+		link.PayloadHash = hash.String
+		return link, true, nil
+	}
+}
+
+// Insert or update the link row for an activation.
+func saveLink(ctx context.Context, db dbExecutor, link jobLink) error {
+	if err := upsertRow(ctx, db, linkTableName, link, true); err != nil {
+		return errors.Wrapf(err, "save link for activation %d", link.TripWatchID)
+	}
+	return nil
+}
+
+// Rewrite the DUTYJOBS columns so that the row is matched on the linked sequence numbers. The
+// columns which are normally used to find the job become ordinary columns which are updated.
+func linkedJobColumns(columns []column, link jobLink) []column {
+	linked := make([]column, 0, len(columns))
+	for _, col := range columns {
+		switch col.name {
+		case "JOBDUTYSEQUENCE":
+			col.value = link.DutyLogID
+			col.isSequence = false
+			col.isMatch = true
+		case "JOBJOBSEQUENCE":
+			col.value = link.JobID
+			col.isSequence = false
+			col.isMatch = true
+		default:
+			col.isMatch = false
+		}
+		linked = append(linked, col)
+	}
+	return linked
+}
+
+// Hash of the activation data which is written to the DB. The sequence numbers are left out as
+// they are filled in from the DB rather than from TripWatch.
+func activationHash(data linkActivationDB) string {
+	data.Job.DutyLogID = 0
+	data.Job.ID = 0
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%+v", data))))
+}
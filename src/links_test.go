@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkedJobColumns(t *testing.T) {
+	columns := []column{
+		{name: "JOBDUTYSEQUENCE", isSequence: true, value: 3},
+		{name: "JOBJOBSEQUENCE", isSequence: true, value: 0},
+		{name: "JOBTIMEOUT", isMatch: true, value: "09:10"},
+		{name: "JOBDUTYVESSELNAME", isMatch: true, value: "MR5"},
+		{name: "JOBSEAS", value: "calm"},
+	}
+	linked := linkedJobColumns(columns, jobLink{TripWatchID: 88, DutyLogID: 2, JobID: 3})
+	assert.Equal(t, []column{
+		{name: "JOBDUTYSEQUENCE", isMatch: true, value: 2},
+		{name: "JOBJOBSEQUENCE", isMatch: true, value: 3},
+		{name: "JOBTIMEOUT", value: "09:10"},
+		{name: "JOBDUTYVESSELNAME", value: "MR5"},
+		{name: "JOBSEAS", value: "calm"},
+	}, linked)
+	// The original columns are untouched
+	assert.True(t, columns[0].isSequence)
+	assert.True(t, columns[2].isMatch)
+}
+
+func TestActivationHash(t *testing.T) {
+	data := linkActivationDB{ID: 88, Job: Job{SeaState: "calm"}}
+	hash := activationHash(data)
+	assert.Len(t, hash, 64)
+
+	// Sequence numbers filled in from the DB don't change the hash
+	data.Job.ID = 3
+	data.Job.DutyLogID = 2
+	assert.Equal(t, hash, activationHash(data))
+
+	data.Job.SeaState = "rough"
+	assert.NotEqual(t, hash, activationHash(data))
+}
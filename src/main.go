@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -14,7 +15,8 @@ import (
 
 // When booting, initialise the 'last updated time' to the previous 12 hours. This
 // is a means of ensuring we don't pull all old jobs across if the system is crashing
-// for some significant time and then repaired.
+// for some significant time and then repaired. If a checkpoint has been persisted by a
+// previous run, that value is used instead (see restoreCheckpoint()).
 var lastUpdatedTS time.Time = now().UTC().Add(-12 * time.Hour)
 var now = time.Now
 var configFilePath string
@@ -24,6 +26,8 @@ var Version string = "development"
 func init() {
 	flag.StringVar(&configFilePath, "config-file", ".config.yml", "Configuration YAML file")
 	flag.BoolVar(&printVersion, "version", false, "Print version information and exit")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Run one sync cycle, printing the SQL it would execute instead of writing to the DB")
 }
 
 // Error type returned by the run() function in main.go
@@ -64,46 +68,175 @@ func openDB() (*sql.DB, error) {
 func setup() (*sql.DB, func(), error) {
 	if err := parseConfig(configFilePath); err != nil {
 		return nil, nil, errors.Wrapf(err, "Config parsing failed")
+	} else if err := restoreCheckpoint(); err != nil {
+		return nil, nil, errors.Wrapf(err, "Checkpoint restore failed")
 	} else if db, err := openDB(); err != nil {
 		return nil, nil, errors.Wrapf(err, "Unable to open DB")
 	} else if err := db.Ping(); err != nil {
 		return nil, nil, errors.Wrapf(err, "No connection to DB")
+	} else if err := prepareDB(db); err != nil {
+		return nil, nil, errors.Wrapf(err, "DB preparation failed")
 	} else {
 		return db, func() { db.Close() }, nil
 	}
 }
 
+// Create any DB objects which are maintained by this service.
+func prepareDB(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := prepareServiceTables(ctx, db); err != nil {
+		return errors.Wrapf(err, "prepare DB service tables")
+	} else if err := checkSchemaAtStartup(ctx, db); err != nil {
+		return errors.Wrapf(err, "prepare DB schema check")
+	} else if dryRun {
+		// Nothing can be written to the DB during a dry run.
+		return nil
+	} else if err := prepareSequences(ctx, db); err != nil {
+		return errors.Wrapf(err, "prepare DB sequences")
+	}
+	return nil
+}
+
 // Primary execution cycle. This retrieves data from TripWatch and sends it to the Firebird DB.
 func run(db *sql.DB) []error {
 	var errlist []error
+	cycleTS := now().UTC()
+	start := time.Now()
+	// Only advance the checkpoint if every activation in this cycle has either been written or
+	// saved to the retry queue, so that nothing can be missed.
+	advance := true
 	// Shouldn't take more than 60s to perform the whole update (read and write)
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
+	synced := map[int]bool{}
+	written := 0
+	warnings := []cycleWarning{}
+	defer func() {
+		if report := cycleReport(written, errlist, warnings); report != "" {
+			log.Print(report)
+		}
+		serviceStatus.recordCycle(cycleTS, written, errlist, warnings)
+		countCycle(time.Since(start), errlist)
+	}()
+	if !dryRun {
+		// The retry queue and checkpoint can also be changed by operator commands, so hold the
+		// state lock from loading them until they're saved.
+		unlock, err := lockState(cycleStateLockWait)
+		if err != nil {
+			errlist = append(errlist, errors.Wrapf(err, "Sync cycle skipped"))
+			return errlist
+		}
+		defer unlock()
+		// Pick up a checkpoint rewound by the checkpoint command since the last cycle, which
+		// would otherwise be overwritten by this cycle's checkpoint.
+		if ts, err := loadCheckpoint(); err == nil && ts.Before(lastUpdatedTS) {
+			log.Printf("Checkpoint rewound to %s", ts.Format(time.RFC3339))
+			lastUpdatedTS = ts
+		}
+	}
+	queue, err := loadRetryQueue()
+	if err != nil {
+		errlist = append(errlist, errors.Wrapf(err, "Load retry queue"))
+		advance = false
+	}
 	if activations, err := listActivations(ctx, lastUpdatedTS.Add(-60*time.Second)); err != nil {
 		errlist = append(errlist, errors.Wrapf(err, "List TripWatch activations"))
+		advance = false
 	} else {
-		for i, activation := range activations {
-			if strings.ToLower(activations[i].Job.Status) == "cancelled" {
-				// Don't synchronise cancelled activations. Skip over them.
-				continue
-			} else if err := sendToDB(ctx, db, &activations[i]); err != nil {
-				errlist = append(errlist, runError{
-					error:      errors.Wrapf(err, "DB update for activation %d", activation.ID),
-					activation: &activations[i],
-				})
+		for i := range activations {
+			synced[activations[i].ID] = true
+			err := syncActivation(ctx, db, &activations[i])
+			countActivation(&activations[i], err)
+			warnings = append(warnings, activationWarnings(&activations[i])...)
+			if err != nil {
+				errlist = append(errlist, err)
+				queue.fail(activations[i].ID, err)
+			} else {
+				written++
+				queue.succeed(activations[i].ID)
+			}
+		}
+	}
+	if dryRun {
+		return errlist
+	}
+	// Retry activations which failed in earlier cycles and are now due
+	for _, id := range queue.due(cycleTS) {
+		if synced[id] {
+			continue
+		}
+		if activation, err := getOneActivation(ctx, id); err != nil {
+			countActivation(nil, err)
+			errlist = append(errlist, errors.Wrapf(err, "Retry activation %d", id))
+			queue.fail(id, err)
+		} else if err := syncActivation(ctx, db, &activation); err != nil {
+			countActivation(&activation, err)
+			warnings = append(warnings, activationWarnings(&activation)...)
+			errlist = append(errlist, errors.Wrapf(err, "Retry"))
+			queue.fail(id, err)
+		} else {
+			countActivation(&activation, nil)
+			warnings = append(warnings, activationWarnings(&activation)...)
+			written++
+			queue.succeed(id)
+		}
+	}
+	if advance {
+		if err := saveRetryQueue(queue); err != nil {
+			errlist = append(errlist, errors.Wrapf(err, "Persist retry queue"))
+		} else {
+			lastUpdatedTS = cycleTS
+			if err := saveCheckpoint(lastUpdatedTS); err != nil {
+				errlist = append(errlist, errors.Wrapf(err, "Persist checkpoint"))
 			}
 		}
 	}
-	lastUpdatedTS = now().UTC()
 	return errlist
 }
 
+// Write a single activation to the DB, or retract it if it has been cancelled.
+func syncActivation(ctx context.Context, db *sql.DB, activation *linkActivationDB) error {
+	var exec dbExecutor = db
+	recorder := &dryRunRecorder{db: db}
+	if dryRun {
+		exec = recorder
+		defer func() { log.Print(recorder.report(activation)) }()
+	}
+	if strings.ToLower(activation.Job.Status) == "cancelled" {
+		// Don't synchronise cancelled activations, but retract them if they were
+		// synchronised before being cancelled.
+		if err := handleCancelled(ctx, exec, activation); err != nil {
+			return runError{
+				error:      errors.Wrapf(err, "DB retraction for activation %d", activation.ID),
+				activation: activation,
+			}
+		}
+	} else if err := sendToDB(ctx, exec, activation); err != nil {
+		return runError{
+			error:      errors.Wrapf(err, "DB update for activation %d", activation.ID),
+			activation: activation,
+		}
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
 	if printVersion {
 		fmt.Println(Version)
 		return
 	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+	if dryRun {
+		runDryRun()
+		return
+	}
 	// Run an infinite loop reading data from TripWatch and synchronising it with the
 	// Firebird DB.
 	// NB: this function is conditionally linked due to tags issued at build time.
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the TripWatch to Firebird enum translations, as used in the `mappings:` config.
+const (
+	mapJobType     = "jobtype"
+	mapJobAction   = "jobaction"
+	mapWaterLimits = "waterlimits"
+	mapVesselName  = "vesselname"
+	mapBoatType    = "boattype"
+	mapPropulsion  = "propulsion"
+	mapJobSource   = "jobsource"
+)
+
+// A YAML value which may be given as either a single string or a list of strings.
+type stringOrList []string
+
+func (s *stringOrList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*s = stringOrList{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return errors.Wrapf(err, "expected a string or a list of strings")
+	}
+	*s = stringOrList(list)
+	return nil
+}
+
+// One translation rule. Exactly one of Exact (case-sensitive), Contains (case-insensitive) or
+// Regex must be given, and a TripWatch value which matches is translated to Value.
+type mappingRule struct {
+	Exact    stringOrList `yaml:"exact"`
+	Contains stringOrList `yaml:"contains"`
+	Regex    string       `yaml:"regex"`
+	Value    string       `yaml:"value"`
+	re       *regexp.Regexp
+}
+
+// An ordered list of rules. The first matching rule wins, and values which match no rule are
+// translated to Default, or passed through unchanged if there is no default.
+type enumMapping struct {
+	Rules   []mappingRule `yaml:"rules"`
+	Default *string       `yaml:"default"`
+	// Drop the built-in rules instead of checking them after these ones
+	Replace bool `yaml:"replace"`
+	maxLen  int
+}
+
+func (r mappingRule) matches(value string) bool {
+	for _, exact := range r.Exact {
+		if value == exact {
+			return true
+		}
+	}
+	for _, sub := range r.Contains {
+		if strings.Contains(strings.ToLower(value), strings.ToLower(sub)) {
+			return true
+		}
+	}
+	return r.re != nil && r.re.MatchString(value)
+}
+
+func (m enumMapping) translate(value string) string {
+	for _, rule := range m.Rules {
+		if rule.matches(value) {
+			return rule.Value
+		}
+	}
+	if m.Default != nil {
+		return *m.Default
+	}
+	return value
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// The translations used when the config has no mappings.
+func builtinMappings() map[string]enumMapping {
+	return map[string]enumMapping{
+		mapJobType: {maxLen: 20, Rules: []mappingRule{
+			{Exact: stringOrList{"Medivac"}, Value: "Medical"},
+			{Exact: stringOrList{"SAR"}, Value: "Search"},
+			{Exact: stringOrList{"Assist"}, Value: "Breakdown"},
+			{Exact: stringOrList{"Training"}, Value: "Training/Patrol"},
+			{Exact: stringOrList{"Scattering of Ashes"}, Value: "Dispersal"},
+			{Exact: stringOrList{"Public Service"}, Value: "PR/Promo"},
+			{Exact: stringOrList{"MAYDAY", "PANPAN"}, Value: "EPIRB"},
+		}},
+		mapJobAction: {maxLen: 20, Default: strPtr("Other"), Rules: []mappingRule{
+			{Contains: stringOrList{"jump"}, Value: "Jump Start"},
+			{Contains: stringOrList{"medivac", "medevac", "medical"}, Value: "Medivac"},
+			{Contains: stringOrList{"nil"}, Value: "Nil"},
+			{Contains: stringOrList{"pump"}, Value: "Pump Out"},
+			{Contains: stringOrList{"search", "sar"}, Value: "Search & Rescue"},
+			{Contains: stringOrList{"fuel"}, Value: "Supplied Fuel"},
+			{Contains: stringOrList{"tow"}, Value: "Tow"},
+			{Contains: stringOrList{"train"}, Value: "Training"},
+			{Contains: stringOrList{"unground"}, Value: "Ungrounded"},
+			{Contains: stringOrList{"investigate"}, Value: "Investigate"},
+		}},
+		mapWaterLimits: {maxLen: 20, Default: strPtr(""), Rules: []mappingRule{
+			{Exact: stringOrList{"A", "B", "C"}, Value: "Open"},
+			{Exact: stringOrList{"D"}, Value: "Partially Smooth"},
+			{Exact: stringOrList{"E"}, Value: "Smooth"},
+		}},
+		mapVesselName: {maxLen: 30, Default: strPtr(""), Rules: []mappingRule{
+			{Exact: stringOrList{"MARINERESCUE1"}, Value: "Marine Rescue 1"},
+			{Exact: stringOrList{"MARINERESCUE2"}, Value: "Marine Rescue 2"},
+			{Exact: stringOrList{"MARINERESCUE4"}, Value: "Marine Rescue 4"},
+			{Exact: stringOrList{"MARINERESCUE5"}, Value: "Marine Rescue 5"},
+		}},
+		mapBoatType: {maxLen: 20, Default: strPtr("Speed/Motor Boat"), Rules: []mappingRule{
+			{Exact: stringOrList{""}, Value: ""},
+			{Contains: stringOrList{"jet ski", "jetski"}, Value: "PWC"},
+			{Contains: stringOrList{"yacht", "sail", "ketch", "schooner"}, Value: "Sailing"},
+			{Contains: stringOrList{"kayak", "paddle"}, Value: "Paddle"},
+		}},
+		mapPropulsion: {maxLen: 20, Default: strPtr("Single Outboard"), Rules: []mappingRule{
+			{Exact: stringOrList{""}, Value: ""},
+			{Contains: stringOrList{"outboard"}, Value: "Single Outboard"},
+			{Contains: stringOrList{"inboard"}, Value: "Single Inboard"},
+			{Contains: stringOrList{"paddle", "oar"}, Value: "Oars"},
+			{Contains: stringOrList{"wind", "sail"}, Value: "Sail"},
+		}},
+		mapJobSource: {maxLen: 20, Default: strPtr("Base"), Rules: []mappingRule{
+			{Exact: stringOrList{"Water Police", "Land Police"}, Value: "Police"},
+			{Exact: stringOrList{"Ambulance Service"}, Value: "QAS"},
+		}},
+	}
+}
+
+var enumMappings = builtinMappings()
+
+// Translate a TripWatch value using the named mapping.
+func mapEnum(name, value string) string {
+	return enumMappings[name].translate(strings.TrimSpace(value))
+}
+
+// Check the configured mappings and merge them with the built-in ones. The configured rules
+// are checked before the built-in rules.
+func buildEnumMappings(cfg map[string]enumMapping) (map[string]enumMapping, error) {
+	mappings := builtinMappings()
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		custom := cfg[name]
+		builtin, ok := mappings[name]
+		if !ok {
+			return nil, errors.Errorf("unknown mapping '%s'", name)
+		}
+		for i := range custom.Rules {
+			rule := &custom.Rules[i]
+			kinds := 0
+			for _, given := range []bool{len(rule.Exact) > 0, len(rule.Contains) > 0, rule.Regex != ""} {
+				if given {
+					kinds++
+				}
+			}
+			if kinds != 1 {
+				return nil, errors.Errorf("mapping %s rule %d needs exactly one of exact, contains or regex",
+					name, i+1)
+			} else if len(rule.Value) > builtin.maxLen {
+				return nil, errors.Errorf("mapping %s rule %d value '%s' is longer than %d characters",
+					name, i+1, rule.Value, builtin.maxLen)
+			} else if rule.Regex == "" {
+				continue
+			} else if re, err := regexp.Compile(rule.Regex); err != nil {
+				return nil, errors.Wrapf(err, "mapping %s rule %d regex", name, i+1)
+			} else {
+				rule.re = re
+			}
+		}
+		if custom.Default != nil && len(*custom.Default) > builtin.maxLen {
+			return nil, errors.Errorf("mapping %s default '%s' is longer than %d characters",
+				name, *custom.Default, builtin.maxLen)
+		}
+		merged := enumMapping{maxLen: builtin.maxLen, Default: builtin.Default}
+		merged.Rules = append(merged.Rules, custom.Rules...)
+		if !custom.Replace {
+			merged.Rules = append(merged.Rules, builtin.Rules...)
+		}
+		if custom.Default != nil {
+			merged.Default = custom.Default
+		}
+		mappings[name] = merged
+	}
+	return mappings, nil
+}
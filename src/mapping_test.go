@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func testMappings(t *testing.T, cfg string) (map[string]enumMapping, error) {
+	mappings := map[string]enumMapping{}
+	err := yaml.Unmarshal([]byte(cfg), &mappings)
+	assert.Nil(t, err)
+	return buildEnumMappings(mappings)
+}
+
+func TestEnumMappings(t *testing.T) {
+	defer func() { enumMappings = builtinMappings() }()
+	mappings, err := testMappings(t, `
+vesselname:
+  rules:
+    - exact: MARINERESCUE3
+      value: Marine Rescue 3
+    - regex: '^MR[0-9]+$'
+      value: Marine Rescue
+jobaction:
+  rules:
+    - contains: [tow, drag]
+      value: Towed
+  default: Not Recorded
+boattype:
+  replace: true
+  rules:
+    - contains: yacht
+      value: Sailing
+`)
+	assert.Nil(t, err)
+	enumMappings = mappings
+
+	tests := []struct {
+		name   string
+		json   string
+		expect interface{}
+	}{
+		{name: "configured exact rule", json: `"MARINERESCUE3"`, expect: VMRVesselNameEnum("Marine Rescue 3")},
+		{name: "configured regex rule", json: `"MR12"`, expect: VMRVesselNameEnum("Marine Rescue")},
+		{name: "built-in rule still applies", json: `"MARINERESCUE1"`, expect: VMRVesselNameEnum("Marine Rescue 1")},
+		{name: "built-in default", json: `"OTHER"`, expect: VMRVesselNameEnum("")},
+		{name: "configured rule is checked first", json: `"Tow to ramp"`, expect: JobAction("Towed")},
+		{name: "configured list of contains", json: `"DRAGGED off sand"`, expect: JobAction("Towed")},
+		{name: "built-in rule after configured", json: `"Jump start"`, expect: JobAction("Jump Start")},
+		{name: "configured default", json: `"something"`, expect: JobAction("Not Recorded")},
+		{name: "replaced rules", json: `"Jet ski"`, expect: BoatTypeEnum("Speed/Motor Boat")},
+		{name: "replacement rule", json: `"Yacht"`, expect: BoatTypeEnum("Sailing")},
+		{name: "replaced blank rule", json: `""`, expect: BoatTypeEnum("Speed/Motor Boat")},
+		{name: "unconfigured mapping", json: `"Water Police"`, expect: JobSource("Police")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			switch expect := test.expect.(type) {
+			case VMRVesselNameEnum:
+				var v VMRVesselNameEnum
+				assert.Nil(t, json.Unmarshal([]byte(test.json), &v))
+				assert.Equal(t, expect, v)
+			case JobAction:
+				var v JobAction
+				assert.Nil(t, json.Unmarshal([]byte(test.json), &v))
+				assert.Equal(t, expect, v)
+			case BoatTypeEnum:
+				var v BoatTypeEnum
+				assert.Nil(t, json.Unmarshal([]byte(test.json), &v))
+				assert.Equal(t, expect, v)
+			case JobSource:
+				var v JobSource
+				assert.Nil(t, json.Unmarshal([]byte(test.json), &v))
+				assert.Equal(t, expect, v)
+			}
+		})
+	}
+}
+
+func TestEnumMappingsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  string
+	}{
+		{name: "unknown mapping", cfg: "colour:\n  rules:\n    - exact: red\n      value: Red\n"},
+		{name: "no matcher", cfg: "jobtype:\n  rules:\n    - value: Search\n"},
+		{name: "two matchers", cfg: "jobtype:\n  rules:\n    - exact: SAR\n      contains: search\n      value: Search\n"},
+		{name: "bad regex", cfg: "jobtype:\n  rules:\n    - regex: '[a-'\n      value: Search\n"},
+		{name: "value too long", cfg: "jobtype:\n  rules:\n    - exact: SAR\n      value: Search and rescue operation\n"},
+		{name: "default too long", cfg: "jobsource:\n  default: Somebody with a very long name\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := testMappings(t, test.cfg)
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Metrics are exported on the status server at /metrics in the Prometheus text format. Only
+// counters, gauges and histograms are needed, so they are implemented here rather than pulling in
+// the Prometheus client library.
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// A metric with a value (or histogram) for each combination of label values.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // Upper bounds of the histogram buckets, in increasing order
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // Counters and gauges
+	counts      []uint64 // Histograms: cumulative count of observations for each bucket
+	count       uint64
+	sum         float64
+}
+
+// Every metric, in the order they are written out.
+var metricRegistry []*metricVec
+
+func newMetric(name, help, kind string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricSeries{},
+	}
+	metricRegistry = append(metricRegistry, m)
+	return m
+}
+
+func (m *metricVec) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values, got %d", m.name, len(m.labels),
+			len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metricVec) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Format label pairs as {a="1",b="2"}, with extra pairs (such as a histogram's le) at the end.
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], escape.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escape.Replace(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricVec) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lines := []string{
+		fmt.Sprintf("# HELP %s %s", m.name, m.help),
+		fmt.Sprintf("# TYPE %s %s", m.name, m.kind),
+	}
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != metricHistogram {
+			lines = append(lines, m.name+formatLabels(m.labels, s.labelValues)+" "+
+				formatMetricValue(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			lines = append(lines, m.name+"_bucket"+
+				formatLabels(m.labels, s.labelValues, "le", formatMetricValue(bound))+" "+
+				strconv.FormatUint(s.counts[i], 10))
+		}
+		lines = append(lines,
+			m.name+"_bucket"+formatLabels(m.labels, s.labelValues, "le", "+Inf")+" "+
+				strconv.FormatUint(s.count, 10),
+			m.name+"_sum"+formatLabels(m.labels, s.labelValues)+" "+formatMetricValue(s.sum),
+			m.name+"_count"+formatLabels(m.labels, s.labelValues)+" "+
+				strconv.FormatUint(s.count, 10))
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+var (
+	cycleDuration = newMetric("vmrsync_cycle_duration_seconds",
+		"Time taken by each sync cycle.", metricHistogram,
+		[]float64{0.5, 1, 2, 5, 10, 20, 30, 60})
+	cyclesTotal = newMetric("vmrsync_cycles_total",
+		"Sync cycles run, by result (success or error).", metricCounter, nil, "result")
+	tripwatchCalls = newMetric("vmrsync_tripwatch_calls_total",
+		"TripWatch API calls, by endpoint and status code (or error if no response).",
+		metricCounter, nil, "endpoint", "code")
+	tripwatchCallDuration = newMetric("vmrsync_tripwatch_call_duration_seconds",
+		"Time taken by each TripWatch API call, by endpoint.", metricHistogram,
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "endpoint")
+	tripwatchRateLimit = newMetric("vmrsync_tripwatch_ratelimit_limit",
+		"TripWatch API calls allowed per minute, from X-RateLimit-Limit.", metricGauge, nil)
+	tripwatchRateRemaining = newMetric("vmrsync_tripwatch_ratelimit_remaining",
+		"TripWatch API calls left in the current minute, from X-RateLimit-Remaining.",
+		metricGauge, nil)
+	activationsTotal = newMetric("vmrsync_activations_total",
+		"Activations processed, by result (synced, cancelled or failed).", metricCounter, nil,
+		"result")
+	activationFailures = newMetric("vmrsync_activation_failures_total",
+		"Activations which failed to sync, by error class and for DB errors the table and"+
+			" statement type.", metricCounter, nil, "class", "table", "statement")
+	dbWrites = newMetric("vmrsync_db_writes_total",
+		"Rows written to Firebird, by table and statement type (insert or update).",
+		metricCounter, nil, "table", "statement")
+	crewRows = newMetric("vmrsync_crew_rows_total",
+		"Job crew rows added to or removed from DUTYJOBSCREW.", metricCounter, nil, "change")
+)
+
+// The endpoint of a TripWatch API URL, with IDs replaced so that each endpoint is one series,
+// e.g. "/activations/1234/sitreps?page=2" is "/activations/{id}/sitreps".
+func tripwatchEndpoint(url string) string {
+	if i := strings.IndexByte(url, '?'); i >= 0 {
+		url = url[:i]
+	}
+	parts := strings.Split(url, "/")
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			parts[i] = "{id}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func countTripwatchCall(url string, resp *http.Response, err error, elapsed time.Duration) {
+	endpoint := tripwatchEndpoint(url)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	tripwatchCalls.inc(endpoint, code)
+	tripwatchCallDuration.observe(elapsed.Seconds(), endpoint)
+}
+
+// The class of error an activation failed with, and for DB errors the table and the type of
+// statement.
+func errorClass(err error) (class, table, statement string) {
+	var dberr dbError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var numErr *strconv.NumError
+	var timeErr *time.ParseError
+	if errors.Is(err, matchFieldIsZero) {
+		return "match_field_zero", "", ""
+	} else if errors.As(err, &dberr) {
+		statement = "other"
+		if fields := strings.Fields(dberr.statement); len(fields) > 0 {
+			switch kind := strings.ToLower(fields[0]); kind {
+			case "select", "insert", "update", "delete", "create", "alter":
+				statement = kind
+			}
+		}
+		return "db", dberr.name, statement
+	} else if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.As(err, &numErr) ||
+		errors.As(err, &timeErr) {
+		return "parse", "", ""
+	}
+	return "other", "", ""
+}
+
+// Count an activation processed by the sync loop.
+func countActivation(activation *linkActivationDB, err error) {
+	if err != nil {
+		activationsTotal.inc("failed")
+		activationFailures.inc(errorClass(err))
+	} else if strings.ToLower(activation.Job.Status) == "cancelled" {
+		activationsTotal.inc("cancelled")
+	} else {
+		activationsTotal.inc("synced")
+	}
+}
+
+// A DB executor for a transaction which holds back the counts of rows written until the
+// transaction commits, so that rolled back writes aren't counted (see countWrite()).
+type txWrites struct {
+	dbExecutor
+	pending []pendingWrite
+}
+
+type pendingWrite struct {
+	metric      *metricVec
+	v           float64
+	labelValues []string
+}
+
+// Add the held back counts once the transaction has committed.
+func (tx *txWrites) commit() {
+	for _, w := range tx.pending {
+		w.metric.add(w.v, w.labelValues...)
+	}
+	tx.pending = nil
+}
+
+// Count rows written to the DB. Nothing is counted during a dry run, as the writes are only
+// recorded, and writes made through a txWrites are counted when it commits.
+func countWrite(db dbExecutor, metric *metricVec, v float64, labelValues ...string) {
+	if dryRun {
+		return
+	} else if tx, ok := db.(*txWrites); ok {
+		tx.pending = append(tx.pending, pendingWrite{metric, v, labelValues})
+		return
+	}
+	metric.add(v, labelValues...)
+}
+
+func countCycle(elapsed time.Duration, errlist []error) {
+	cycleDuration.observe(elapsed.Seconds())
+	if len(errlist) == 0 {
+		cyclesTotal.inc("success")
+	} else {
+		cyclesTotal.inc("error")
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// Write every metric, followed by gauges for the progress of the sync loop. An alert on
+// time() - vmrsync_last_success_timestamp_seconds picks up a stalled sync.
+func writeMetrics(w io.Writer, s *syncStatus) error {
+	for _, m := range metricRegistry {
+		if err := m.write(w); err != nil {
+			return errors.Wrapf(err, "write metric %s", m.name)
+		}
+	}
+	report := s.report()
+	for _, g := range []struct {
+		name, help string
+		value      float64
+	}{
+		{"vmrsync_start_timestamp_seconds", "When the service started.",
+			unixSeconds(report.Started)},
+		{"vmrsync_last_cycle_timestamp_seconds", "When the last sync cycle ran.",
+			unixSeconds(report.LastCycle)},
+		{"vmrsync_last_success_timestamp_seconds", "When the last sync cycle without errors ran.",
+			unixSeconds(report.LastSuccess)},
+		{"vmrsync_checkpoint_timestamp_seconds",
+			"The sync checkpoint (lastUpdatedTS). Activations updated before this have been synced.",
+			unixSeconds(report.LastUpdatedTS)},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help,
+			g.name, g.name, formatMetricValue(g.value)); err != nil {
+			return errors.Wrapf(err, "write metric %s", g.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricWrite(t *testing.T) {
+	counter := &metricVec{name: "test_total", help: "Test counter.", kind: metricCounter,
+		labels: []string{"table"}, series: map[string]*metricSeries{}}
+	counter.inc("DUTYJOBS")
+	counter.add(2, "DUTYJOBS")
+	counter.inc(`MEMBERS "M"`)
+	buf := &bytes.Buffer{}
+	assert.Nil(t, counter.write(buf))
+	assert.Equal(t, "# HELP test_total Test counter.\n"+
+		"# TYPE test_total counter\n"+
+		"test_total{table=\"DUTYJOBS\"} 3\n"+
+		"test_total{table=\"MEMBERS \\\"M\\\"\"} 1\n", buf.String())
+
+	hist := &metricVec{name: "test_seconds", help: "Test histogram.", kind: metricHistogram,
+		buckets: []float64{1, 5}, series: map[string]*metricSeries{}}
+	hist.observe(0.5)
+	hist.observe(2)
+	hist.observe(10)
+	buf.Reset()
+	assert.Nil(t, hist.write(buf))
+	assert.Equal(t, "# HELP test_seconds Test histogram.\n"+
+		"# TYPE test_seconds histogram\n"+
+		"test_seconds_bucket{le=\"1\"} 1\n"+
+		"test_seconds_bucket{le=\"5\"} 2\n"+
+		"test_seconds_bucket{le=\"+Inf\"} 3\n"+
+		"test_seconds_sum 12.5\n"+
+		"test_seconds_count 3\n", buf.String())
+
+	assert.Panics(t, func() { counter.inc() })
+}
+
+func TestTripwatchEndpoint(t *testing.T) {
+	assert.Equal(t, "/activations/recent", tripwatchEndpoint("/activations/recent"))
+	assert.Equal(t, "/activations/{id}/sitreps", tripwatchEndpoint("/activations/1234/sitreps?page=2"))
+	assert.Equal(t, "/activations", tripwatchEndpoint("/activations?page=3"))
+}
+
+func TestErrorClass(t *testing.T) {
+	class, table, statement := errorClass(errors.Wrapf(matchFieldIsZero, "job"))
+	assert.Equal(t, []string{"match_field_zero", "", ""}, []string{class, table, statement})
+
+	class, table, statement = errorClass(runError{error: errors.Wrapf(dbError{
+		error:     errors.Errorf("lock conflict"),
+		name:      "DUTYJOBS",
+		statement: "UPDATE DUTYJOBS SET JOBTYPE=? WHERE JOBJOBSEQUENCE=?",
+	}, "update")})
+	assert.Equal(t, []string{"db", "DUTYJOBS", "update"}, []string{class, table, statement})
+
+	_, err := strconv.Atoi("twelve")
+	class, _, _ = errorClass(errors.Wrapf(err, "engine hours"))
+	assert.Equal(t, "parse", class)
+	err = json.Unmarshal([]byte(`{"id": "x"}`), &struct{ ID int }{})
+	class, _, _ = errorClass(errors.Wrapf(err, "activation"))
+	assert.Equal(t, "parse", class)
+
+	class, _, _ = errorClass(errors.Errorf("something else"))
+	assert.Equal(t, "other", class)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	s := &syncStatus{}
+	s.recordCycle(time.Date(2022, 1, 7, 22, 0, 0, 0, time.UTC), 1, nil, nil)
+	countCycle(1500*time.Millisecond, nil)
+	countActivation(&linkActivationDB{Job: Job{Status: "Cancelled"}}, nil)
+	tripwatchRateRemaining.set(42)
+
+	rec := httptest.NewRecorder()
+	newStatusHandler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE vmrsync_cycle_duration_seconds histogram\n")
+	assert.Contains(t, body, "vmrsync_cycles_total{result=\"success\"}")
+	assert.Contains(t, body, "vmrsync_activations_total{result=\"cancelled\"}")
+	assert.Contains(t, body, "vmrsync_tripwatch_ratelimit_remaining 42\n")
+	assert.Contains(t, body, "vmrsync_last_success_timestamp_seconds 1.6415928e+09\n")
+	assert.Contains(t, body, "vmrsync_start_timestamp_seconds 0\n")
+}
+
+func TestCountWrite(t *testing.T) {
+	counter := &metricVec{name: "test_total", help: "Test counter.", kind: metricCounter,
+		labels: []string{"table"}, series: map[string]*metricSeries{}}
+	count := func() string {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, counter.write(buf))
+		return buf.String()
+	}
+	countWrite(nil, counter, 1, "DUTYJOBS")
+	assert.Contains(t, count(), "test_total{table=\"DUTYJOBS\"} 1\n")
+
+	// Writes in a transaction are only counted once it commits
+	tx := &txWrites{}
+	countWrite(tx, counter, 1, "DUTYJOBS")
+	countWrite(tx, counter, 2, "DUTYJOBSCREW")
+	assert.Contains(t, count(), "test_total{table=\"DUTYJOBS\"} 1\n")
+	assert.NotContains(t, count(), "DUTYJOBSCREW")
+	tx.commit()
+	assert.Contains(t, count(), "test_total{table=\"DUTYJOBS\"} 2\n")
+	assert.Contains(t, count(), "test_total{table=\"DUTYJOBSCREW\"} 2\n")
+
+	// Nothing is written during a dry run
+	dryRun = true
+	defer func() { dryRun = false }()
+	countWrite(nil, counter, 1, "DUTYJOBS")
+	assert.Contains(t, count(), "test_total{table=\"DUTYJOBS\"} 2\n")
+}
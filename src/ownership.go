@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const snapshotTableName = "VMRSYNC_SNAPSHOTS"
+
+// Hashes of the DUTYJOBS values which were last written for each activation, as one
+// COLUMN=hash line per column. A column whose value no longer matches its hash has been edited
+// in the VMR desktop app, and from then on the app owns it: TripWatch updates to the column are
+// skipped and recorded in the conflict table.
+const snapshotTableDDL = "CREATE TABLE " + snapshotTableName + " (" +
+	"TRIPWATCH_ID INTEGER NOT NULL PRIMARY KEY," +
+	"COLUMN_HASHES BLOB SUB_TYPE TEXT)"
+
+const conflictTableName = "VMRSYNC_CONFLICTS"
+
+// TripWatch values which weren't written because the column is owned by the VMR desktop app.
+// Only the latest conflict for each column is kept.
+const conflictTableDDL = "CREATE TABLE " + conflictTableName + " (" +
+	"TRIPWATCH_ID INTEGER NOT NULL," +
+	"COLUMN_NAME VARCHAR(31) NOT NULL," +
+	"DB_VALUE VARCHAR(255)," +
+	"TRIPWATCH_VALUE VARCHAR(255)," +
+	"LAST_SEEN TIMESTAMP," +
+	"PRIMARY KEY (TRIPWATCH_ID,COLUMN_NAME))"
+
+// Set once the snapshot and conflict tables are known to exist (see prepareServiceTables()).
+var snapshotTableReady, conflictTableReady bool
+
+// Set in the VMR desktop app to stop any further changes to a job.
+const jobLockedColumn = "JOBLOCKED"
+
+type jobSnapshot struct {
+	TripWatchID  int    `firebird:"TRIPWATCH_ID,match"`
+	ColumnHashes string `firebird:"COLUMN_HASHES" len:"8192"`
+}
+
+type fieldConflict struct {
+	TripWatchID    int       `firebird:"TRIPWATCH_ID,match"`
+	Column         string    `firebird:"COLUMN_NAME,match" len:"31"`
+	DBValue        string    `firebird:"DB_VALUE" len:"255"`
+	TripWatchValue string    `firebird:"TRIPWATCH_VALUE" len:"255"`
+	LastSeen       time.Time `firebird:"LAST_SEEN"`
+}
+
+// A linked job's DUTYJOBS row as it was before being written.
+type jobRowState struct {
+	locked   bool
+	current  map[string]interface{}
+	snapshot map[string]string
+}
+
+// The hash only needs to show whether a value has changed, so a short one is plenty.
+func valueHash(v interface{}) string {
+	sum := sha256.Sum256([]byte(dryRunValue(v)))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+func parseSnapshot(s string) map[string]string {
+	hashes := map[string]string{}
+	for _, line := range strings.Split(s, "\n") {
+		if parts := strings.SplitN(strings.TrimSpace(line), "=", 2); len(parts) == 2 {
+			hashes[parts[0]] = parts[1]
+		}
+	}
+	return hashes
+}
+
+func formatSnapshot(hashes map[string]string) string {
+	lines := make([]string, 0, len(hashes))
+	for name, hash := range hashes {
+		lines = append(lines, name+"="+hash)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// Text read from the DB, which is "" for NULL.
+func dbString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	s, _ := v.(string)
+	return s
+}
+
+func isLockedValue(v interface{}) bool {
+	return strings.EqualFold(strings.TrimSpace(dbString(v)), "Y")
+}
+
+// Read columns of a DUTYJOBS row. The map is nil if the row doesn't exist.
+func readJobRow(ctx context.Context, db dbExecutor, link jobLink, names []string) (map[string]interface{}, error) {
+	stmt := fmt.Sprintf("SELECT %s FROM %s WHERE JOBDUTYSEQUENCE=? AND JOBJOBSEQUENCE=?",
+		strings.Join(names, ","), jobTableName)
+	if rows, err := db.QueryContext(ctx, stmt, link.DutyLogID, link.JobID); err != nil {
+		return nil, errors.Wrapf(dbError{
+			error:     err,
+			name:      jobTableName,
+			statement: stmt,
+		}, "read job %d", link.JobID)
+	} else {
+		defer rows.Close()
+		if !rows.Next() {
+			return nil, nil
+		}
+		values := make([]interface{}, len(names))
+		ptrs := make([]interface{}, len(names))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, errors.Wrapf(dbError{
+				error:     err,
+				name:      jobTableName,
+				statement: stmt,
+			}, "read job %d scanning row", link.JobID)
+		}
+		row := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			row[name] = values[i]
+		}
+		return row, nil
+	}
+}
+
+// Whether a job has been locked in the VMR desktop app. Jobs which don't exist aren't locked.
+func isJobLocked(ctx context.Context, db dbExecutor, link jobLink) (bool, error) {
+	row, err := readJobRow(ctx, db, link, []string{jobLockedColumn})
+	if err != nil {
+		return false, errors.Wrapf(err, "is job locked")
+	}
+	return isLockedValue(row[jobLockedColumn]), nil
+}
+
+func findSnapshot(ctx context.Context, db dbExecutor, tripwatchID int) (map[string]string, error) {
+	stmt := "SELECT COLUMN_HASHES FROM " + snapshotTableName + " WHERE TRIPWATCH_ID=?"
+	if rows, err := db.QueryContext(ctx, stmt, tripwatchID); err != nil {
+		return nil, errors.Wrapf(dbError{
+			error:     err,
+			name:      snapshotTableName,
+			statement: stmt,
+		}, "find snapshot for activation %d", tripwatchID)
+	} else {
+		defer rows.Close()
+		var hashes interface{}
+		if rows.Next() {
+			if err := rows.Scan(&hashes); err != nil {
+				return nil, errors.Wrapf(dbError{
+					error:     err,
+					name:      snapshotTableName,
+					statement: stmt,
+				}, "find snapshot for activation %d reading row", tripwatchID)
+			}
+		}
+		return parseSnapshot(dbString(hashes)), nil
+	}
+}
+
+// Read the state of a job's row before the activation is written to it.
+func readJobState(ctx context.Context, db dbExecutor, tripwatchID int, link jobLink,
+	columns []column,
+) (jobRowState, error) {
+	names := []string{jobLockedColumn}
+	for _, col := range columns {
+		if !col.isSequence {
+			names = append(names, col.name)
+		}
+	}
+	row, err := readJobRow(ctx, db, link, names)
+	if err != nil {
+		return jobRowState{}, errors.Wrapf(err, "read job state")
+	} else if row == nil {
+		return jobRowState{}, nil
+	}
+	state := jobRowState{locked: isLockedValue(row[jobLockedColumn]), current: row}
+	if snapshotTableReady {
+		if state.snapshot, err = findSnapshot(ctx, db, tripwatchID); err != nil {
+			return jobRowState{}, errors.Wrapf(err, "read job state")
+		}
+	}
+	return state, nil
+}
+
+// Remove the columns which have been edited in the VMR desktop app since they were last
+// written. A conflict is returned for each one whose TripWatch value differs from the DB.
+func (s jobRowState) ownedColumns(tripwatchID int, columns []column) ([]column, []fieldConflict) {
+	kept := make([]column, 0, len(columns))
+	conflicts := []fieldConflict{}
+	for _, col := range columns {
+		current := s.current[col.name]
+		if hash, synced := s.snapshot[col.name]; col.isMatch || col.isSequence || col.isLog ||
+			!synced || valueHash(current) == hash {
+			kept = append(kept, col)
+		} else if dbValue, twValue := dryRunValue(current), dryRunValue(col.value); dbValue != twValue {
+			conflicts = append(conflicts, fieldConflict{
+				TripWatchID:    tripwatchID,
+				Column:         col.name,
+				DBValue:        dbValue,
+				TripWatchValue: twValue,
+				LastSeen:       now().UTC(),
+			})
+		}
+	}
+	return kept, conflicts
+}
+
+// Cut a string to at most maxLen bytes, without splitting a multibyte character.
+func truncate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	end := maxLen
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
+
+func recordConflicts(ctx context.Context, db dbExecutor, conflicts []fieldConflict) error {
+	for _, c := range conflicts {
+		log.Printf("Activation %d: %s was changed in the VMR app to %s, not overwriting it with %s",
+			c.TripWatchID, c.Column, c.DBValue, c.TripWatchValue)
+		if !conflictTableReady {
+			continue
+		}
+		c.DBValue = truncate(c.DBValue, 255)
+		c.TripWatchValue = truncate(c.TripWatchValue, 255)
+		if err := upsertRow(ctx, db, conflictTableName, c, true); err != nil {
+			return errors.Wrapf(err, "record conflict for activation %d", c.TripWatchID)
+		}
+	}
+	return nil
+}
+
+// Save the hashes of the columns which have just been written, as read back from the DB. The
+// previous hashes of any other columns are kept, so owned columns stay owned.
+func saveSnapshot(ctx context.Context, db dbExecutor, link jobLink, previous map[string]string,
+	written []column,
+) error {
+	if !snapshotTableReady || len(written) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(written))
+	for _, col := range written {
+		names = append(names, col.name)
+	}
+	row, err := readJobRow(ctx, db, link, names)
+	if err != nil {
+		return errors.Wrapf(err, "save snapshot for activation %d", link.TripWatchID)
+	} else if row == nil {
+		// Only possible during a dry run, where the job hasn't really been inserted.
+		return nil
+	}
+	hashes := make(map[string]string, len(previous)+len(row))
+	for name, hash := range previous {
+		hashes[name] = hash
+	}
+	for name, v := range row {
+		hashes[name] = valueHash(v)
+	}
+	if err := upsertRow(ctx, db, snapshotTableName, jobSnapshot{
+		TripWatchID:  link.TripWatchID,
+		ColumnHashes: formatSnapshot(hashes),
+	}, true); err != nil {
+		return errors.Wrapf(err, "save snapshot for activation %d", link.TripWatchID)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotFormat(t *testing.T) {
+	hashes := map[string]string{"JOBSEAS": valueHash("calm"), "JOBADULTS": valueHash(2)}
+	s := formatSnapshot(hashes)
+	assert.Equal(t, "JOBADULTS="+valueHash(2)+"\nJOBSEAS="+valueHash("calm"), s)
+	assert.Equal(t, hashes, parseSnapshot(s))
+	assert.Equal(t, map[string]string{}, parseSnapshot(""))
+
+	// DB values hash the same as the values which were written
+	assert.Len(t, valueHash("calm"), 16)
+	assert.Equal(t, valueHash("calm"), valueHash([]byte("calm      ")))
+	assert.Equal(t, valueHash(JobType("Search")), valueHash("Search"))
+	assert.NotEqual(t, valueHash(""), valueHash(nil))
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "Heading 270", truncate("Heading 270", 20))
+	assert.Equal(t, "Heading", truncate("Heading 270", 7))
+	// ˚ is two bytes, so it's left out rather than split
+	assert.Equal(t, "-27", truncate("-27˚ 30'S", 4))
+	assert.Equal(t, "-27˚", truncate("-27˚ 30'S", 5))
+	assert.Equal(t, "", truncate("˚", 1))
+}
+
+func TestIsLockedValue(t *testing.T) {
+	assert.True(t, isLockedValue("Y"))
+	assert.True(t, isLockedValue([]byte("y")))
+	assert.False(t, isLockedValue("N"))
+	assert.False(t, isLockedValue(nil))
+}
+
+func TestOwnedColumns(t *testing.T) {
+	fakeNow = time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	defer func() { fakeNow = time.Time{} }()
+	state := jobRowState{
+		current: map[string]interface{}{
+			"JOBSEAS":        []byte("rough"),
+			"JOBVESSELTYPE":  "Yacht",
+			"JOBDETAILS":     "Tow",
+			"JOBWINDSPEED":   "10kts",
+			"JOBJOBSEQUENCE": 3,
+		},
+		snapshot: map[string]string{
+			"JOBSEAS":        valueHash("calm"),
+			"JOBVESSELTYPE":  valueHash("Cruiser"),
+			"JOBDETAILS":     valueHash("Tow"),
+			"JOBJOBSEQUENCE": valueHash(2),
+		},
+	}
+	kept, conflicts := state.ownedColumns(88, []column{
+		{name: "JOBJOBSEQUENCE", isMatch: true, value: 3},
+		{name: "JOBSEAS", value: "moderate"},
+		{name: "JOBVESSELTYPE", value: "Yacht"},
+		{name: "JOBDETAILS", value: "Tow to ramp"},
+		{name: "JOBWINDSPEED", value: "15kts"},
+	})
+	// Unchanged since the last sync, or never synced
+	assert.Equal(t, []column{
+		{name: "JOBJOBSEQUENCE", isMatch: true, value: 3},
+		{name: "JOBDETAILS", value: "Tow to ramp"},
+		{name: "JOBWINDSPEED", value: "15kts"},
+	}, kept)
+	// JOBVESSELTYPE is owned by the app, but TripWatch now agrees with it
+	assert.Equal(t, []fieldConflict{{
+		TripWatchID:    88,
+		Column:         "JOBSEAS",
+		DBValue:        `"rough"`,
+		TripWatchValue: `"moderate"`,
+		LastSeen:       fakeNow,
+	}}, conflicts)
+}
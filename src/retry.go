@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const retryFileName = ".vmrsync-retry.yml"
+
+// Failed activations are retried after retryBackoff, doubling on each attempt up to
+// retryMaxBackoff. After retryMaxAttempts failures they are moved to the dead letter list.
+var (
+	retryMaxAttempts = 8
+	retryBackoff     = time.Minute
+	retryMaxBackoff  = 6 * time.Hour
+)
+
+type retryItem struct {
+	ID          int       `yaml:"id"`
+	Attempts    int       `yaml:"attempts"`
+	FirstFailed time.Time `yaml:"firstfailed"`
+	NextAttempt time.Time `yaml:"nextattempt"`
+	LastError   string    `yaml:"lasterror"`
+}
+
+// Activations which failed to sync. Pending activations are retried by the main sync loop,
+// while dead letters are only retried when an operator replays them.
+type retryQueue struct {
+	Pending []retryItem `yaml:"pending"`
+	Dead    []retryItem `yaml:"dead"`
+}
+
+func loadRetryQueue() (retryQueue, error) {
+	queue := retryQueue{}
+	if err := readStateFile(retryFileName, &queue); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return retryQueue{}, errors.Wrapf(err, "load retry queue")
+	}
+	return queue, nil
+}
+
+func saveRetryQueue(queue retryQueue) error {
+	if err := writeStateFile(retryFileName, queue); err != nil {
+		return errors.Wrapf(err, "save retry queue")
+	}
+	return nil
+}
+
+// Time to wait before the next attempt after the given number of failed attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := retryBackoff
+	for i := 1; i < attempts && delay < retryMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxBackoff {
+		delay = retryMaxBackoff
+	}
+	return delay
+}
+
+func findRetryItem(items []retryItem, id int) int {
+	for i, item := range items {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Record a failed attempt to sync an activation. Dead letters stay dead until an operator
+// replays them, even if the activation is updated in TripWatch and fails again.
+func (q *retryQueue) fail(id int, err error) {
+	if i := findRetryItem(q.Dead, id); i >= 0 {
+		q.Dead[i].Attempts++
+		q.Dead[i].LastError = err.Error()
+		return
+	}
+	ts := now().UTC()
+	item := retryItem{ID: id, FirstFailed: ts}
+	if i := findRetryItem(q.Pending, id); i >= 0 {
+		item = q.Pending[i]
+		q.Pending = append(q.Pending[:i], q.Pending[i+1:]...)
+	}
+	item.Attempts++
+	item.LastError = err.Error()
+	if item.Attempts >= retryMaxAttempts {
+		item.NextAttempt = time.Time{}
+		q.Dead = append(q.Dead, item)
+	} else {
+		item.NextAttempt = ts.Add(retryDelay(item.Attempts))
+		q.Pending = append(q.Pending, item)
+	}
+}
+
+// Remove an activation which has synced successfully.
+func (q *retryQueue) succeed(id int) {
+	if i := findRetryItem(q.Pending, id); i >= 0 {
+		q.Pending = append(q.Pending[:i], q.Pending[i+1:]...)
+	}
+	if i := findRetryItem(q.Dead, id); i >= 0 {
+		q.Dead = append(q.Dead[:i], q.Dead[i+1:]...)
+	}
+}
+
+// List the IDs of pending activations which are due to be retried.
+func (q *retryQueue) due(ts time.Time) []int {
+	ids := []int{}
+	for _, item := range q.Pending {
+		if !item.NextAttempt.After(ts) {
+			ids = append(ids, item.ID)
+		}
+	}
+	return ids
+}
+
+// List the retry queue and dead letters, or replay or drop dead letters.
+func retryCommand(args []string) error {
+	fs := flag.NewFlagSet("retry", flag.ContinueOnError)
+	replay := fs.Int("replay", 0, "Sync this dead letter activation ID again now")
+	replayAll := fs.Bool("replay-all", false, "Sync all dead letter activations again now")
+	drop := fs.Int("drop", 0, "Remove this activation ID from the dead letter list")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrapf(err, "retry flags")
+	} else if err := parseConfig(configFilePath); err != nil {
+		return errors.Wrapf(err, "retry config parsing")
+	}
+	ids, err := retryCommandQueue(*replay, *replayAll, *drop)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	db, closefunc, err := setup()
+	if err != nil {
+		return errors.Wrapf(err, "retry setup")
+	}
+	defer closefunc()
+	// The state lock is only held while each activation is written, so that the sync cycle
+	// isn't held up while the activations are fetched from TripWatch.
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		if activation, err := getOneActivation(ctx, id); err != nil {
+			fmt.Printf("Activation %d failed: %v\n", id, err)
+		} else if err := replayDeadLetter(ctx, db, &activation); err != nil {
+			cancel()
+			return errors.Wrapf(err, "retry command")
+		}
+		cancel()
+	}
+	return nil
+}
+
+// List or drop dead letters under the state lock, giving the IDs of the dead letters to replay.
+func retryCommandQueue(replay int, replayAll bool, drop int) ([]int, error) {
+	unlock, err := lockState(commandStateLockWait)
+	if err != nil {
+		return nil, errors.Wrapf(err, "retry command waiting for the sync cycle")
+	}
+	defer unlock()
+	queue, err := loadRetryQueue()
+	if err != nil {
+		return nil, errors.Wrapf(err, "retry command")
+	}
+
+	if drop != 0 {
+		if i := findRetryItem(queue.Dead, drop); i < 0 {
+			return nil, errors.Errorf("activation %d is not a dead letter", drop)
+		} else {
+			queue.Dead = append(queue.Dead[:i], queue.Dead[i+1:]...)
+		}
+		return nil, saveRetryQueue(queue)
+	}
+
+	ids := []int{}
+	if replayAll {
+		for _, item := range queue.Dead {
+			ids = append(ids, item.ID)
+		}
+	} else if replay != 0 {
+		if findRetryItem(queue.Dead, replay) < 0 {
+			return nil, errors.Errorf("activation %d is not a dead letter", replay)
+		}
+		ids = append(ids, replay)
+	} else {
+		fmt.Printf("%d activations waiting to be retried:\n", len(queue.Pending))
+		for _, item := range queue.Pending {
+			fmt.Printf("  %d: %d attempts, next at %s: %s\n", item.ID, item.Attempts,
+				item.NextAttempt.Format(time.RFC3339), item.LastError)
+		}
+		fmt.Printf("%d dead letters:\n", len(queue.Dead))
+		for _, item := range queue.Dead {
+			fmt.Printf("  %d: %d attempts since %s: %s\n", item.ID, item.Attempts,
+				item.FirstFailed.Format(time.RFC3339), item.LastError)
+		}
+	}
+	return ids, nil
+}
+
+// Write a dead letter which has been fetched from TripWatch, and update it in the retry queue.
+// The queue is loaded again under the state lock, as the sync cycle may have changed it while
+// the activation was being fetched.
+func replayDeadLetter(ctx context.Context, db *sql.DB, activation *linkActivationDB) error {
+	unlock, err := lockState(commandStateLockWait)
+	if err != nil {
+		return errors.Wrapf(err, "replay activation %d waiting for the sync cycle", activation.ID)
+	}
+	defer unlock()
+	queue, err := loadRetryQueue()
+	if err != nil {
+		return errors.Wrapf(err, "replay activation %d", activation.ID)
+	}
+	i := findRetryItem(queue.Dead, activation.ID)
+	if i < 0 {
+		fmt.Printf("Activation %d is no longer a dead letter\n", activation.ID)
+		return nil
+	} else if err := syncActivation(ctx, db, activation); err != nil {
+		fmt.Printf("Activation %d failed: %v\n", activation.ID, err)
+		queue.Dead[i].LastError = err.Error()
+	} else {
+		fmt.Printf("Activation %d synced\n", activation.ID)
+		queue.succeed(activation.ID)
+	}
+	return saveRetryQueue(queue)
+}
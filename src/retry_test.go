@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, retryDelay(1))
+	assert.Equal(t, 2*time.Minute, retryDelay(2))
+	assert.Equal(t, 8*time.Minute, retryDelay(4))
+	assert.Equal(t, retryMaxBackoff, retryDelay(20))
+	assert.Equal(t, retryMaxBackoff, retryDelay(1000))
+}
+
+func TestRetryQueue(t *testing.T) {
+	setNow(getTime(t, "2023-01-02T03:00:00Z"))
+	defer setNow(time.Time{})
+	oldAttempts := retryMaxAttempts
+	retryMaxAttempts = 3
+	defer func() { retryMaxAttempts = oldAttempts }()
+
+	q := retryQueue{}
+	q.fail(42, errors.Errorf("DB locked"))
+	q.fail(43, errors.Errorf("DB locked"))
+	if assert.Len(t, q.Pending, 2) {
+		assert.Equal(t, 1, q.Pending[0].Attempts)
+		assert.Equal(t, getTime(t, "2023-01-02T03:01:00Z"), q.Pending[0].NextAttempt)
+		assert.Equal(t, "DB locked", q.Pending[0].LastError)
+	}
+	assert.Empty(t, q.due(getTime(t, "2023-01-02T03:00:30Z")))
+	assert.Equal(t, []int{42, 43}, q.due(getTime(t, "2023-01-02T03:01:00Z")))
+
+	// Backoff doubles with each failure
+	q.fail(42, errors.Errorf("still locked"))
+	i := findRetryItem(q.Pending, 42)
+	if assert.LessOrEqual(t, 0, i) {
+		assert.Equal(t, 2, q.Pending[i].Attempts)
+		assert.Equal(t, getTime(t, "2023-01-02T03:02:00Z"), q.Pending[i].NextAttempt)
+		assert.Equal(t, getTime(t, "2023-01-02T03:00:00Z"), q.Pending[i].FirstFailed)
+	}
+
+	// Retries are exhausted, so move to the dead letters
+	q.fail(42, errors.Errorf("locked forever"))
+	assert.Equal(t, -1, findRetryItem(q.Pending, 42))
+	if assert.Len(t, q.Dead, 1) {
+		assert.Equal(t, 42, q.Dead[0].ID)
+		assert.Equal(t, 3, q.Dead[0].Attempts)
+		assert.Equal(t, "locked forever", q.Dead[0].LastError)
+	}
+
+	// A dead letter which fails again in the sync cycle stays dead
+	q.fail(42, errors.Errorf("updated and still locked"))
+	assert.Equal(t, -1, findRetryItem(q.Pending, 42))
+	if assert.Len(t, q.Dead, 1) {
+		assert.Equal(t, 4, q.Dead[0].Attempts)
+		assert.Equal(t, "updated and still locked", q.Dead[0].LastError)
+		assert.Equal(t, getTime(t, "2023-01-02T03:00:00Z"), q.Dead[0].FirstFailed)
+	}
+
+	q.succeed(43)
+	q.succeed(42)
+	assert.Empty(t, q.Pending)
+	assert.Empty(t, q.Dead)
+}
+
+func TestRetryCommand(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := dir + "/config.yml"
+	err := os.WriteFile(cfgFile, []byte("tripwatch:\n  poll: \"60s\"\n"+
+		"retry:\n  attempts: 4\n  backoff: \"30s\"\n  maxbackoff: \"1h\"\n"), 0600)
+	assert.Nil(t, err)
+	oldPath := configFilePath
+	configFilePath = cfgFile
+	oldAttempts, oldBackoff, oldMax := retryMaxAttempts, retryBackoff, retryMaxBackoff
+	defer func() {
+		configFilePath = oldPath
+		stateDir = ""
+		retryMaxAttempts, retryBackoff, retryMaxBackoff = oldAttempts, oldBackoff, oldMax
+	}()
+
+	err = runCommand([]string{"retry"})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, retryMaxAttempts)
+	assert.Equal(t, 30*time.Second, retryBackoff)
+	assert.Equal(t, time.Hour, retryMaxBackoff)
+
+	err = saveRetryQueue(retryQueue{
+		Pending: []retryItem{{ID: 1, Attempts: 1}},
+		Dead:    []retryItem{{ID: 2, Attempts: 4}, {ID: 3, Attempts: 4}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, runCommand([]string{"retry"}))
+	assert.NotNil(t, runCommand([]string{"retry", "-drop", "1"}))
+	assert.NotNil(t, runCommand([]string{"retry", "-replay", "1"}))
+	assert.Nil(t, runCommand([]string{"retry", "-drop", "2"}))
+
+	// The queue can't be changed while a sync cycle holds the state lock
+	oldWait := commandStateLockWait
+	commandStateLockWait = 200 * time.Millisecond
+	defer func() { commandStateLockWait = oldWait }()
+	unlock, err := lockState(0)
+	if assert.Nil(t, err) {
+		err = runCommand([]string{"retry", "-drop", "3"})
+		assert.True(t, errors.Is(err, stateLocked), "%v", err)
+		unlock()
+	}
+
+	queue, err := loadRetryQueue()
+	assert.Nil(t, err)
+	assert.Len(t, queue.Pending, 1)
+	if assert.Len(t, queue.Dead, 1) {
+		assert.Equal(t, 3, queue.Dead[0].ID)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Rules for turning TripWatch risk priorities into the five DUTYJOBS risk scores.
+const (
+	// JOBRISK1..5 hold the scores of the five highest-priority risks, highest first.
+	riskRuleHighest = "highest"
+	// JOBRISKn holds the number of risks with priority n.
+	riskRuleCount = "count"
+)
+
+const numRiskSlots = 5
+
+type riskConfig struct {
+	Rule string `yaml:"rule"`
+	// Score for each TripWatch priority under the "highest" rule. Priorities which aren't
+	// listed score the priority itself.
+	Scores map[int]int `yaml:"scores"`
+	// Unacknowledged risks at or above this priority are listed in the job comments.
+	HighPriority int `yaml:"highpriority"`
+}
+
+var riskCfg = defaultRiskConfig()
+
+func defaultRiskConfig() riskConfig {
+	return riskConfig{
+		Rule:         riskRuleHighest,
+		HighPriority: 4,
+	}
+}
+
+func validateRiskConfig() error {
+	switch riskCfg.Rule {
+	case riskRuleHighest, riskRuleCount:
+		return nil
+	}
+	return errors.Errorf("unknown risk scoring rule '%s'", riskCfg.Rule)
+}
+
+func (cfg riskConfig) score(priority int) int {
+	if score, ok := cfg.Scores[priority]; ok {
+		return score
+	}
+	return priority
+}
+
+// Fill the job risk scores from the activation's risks.
+func aggregateRisks(data *linkActivationDB) error {
+	scores := make([]int, numRiskSlots)
+	switch riskCfg.Rule {
+	case riskRuleHighest:
+		priorities := make([]int, 0, len(data.Risks))
+		for _, risk := range data.Risks {
+			priorities = append(priorities, int(risk.Priority))
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+		for i := 0; i < len(priorities) && i < numRiskSlots; i++ {
+			scores[i] = riskCfg.score(priorities[i])
+		}
+	case riskRuleCount:
+		for _, risk := range data.Risks {
+			if p := int(risk.Priority); p >= 1 && p <= numRiskSlots {
+				scores[p-1]++
+			}
+		}
+	default:
+		return errors.Errorf("unknown risk scoring rule '%s'", riskCfg.Rule)
+	}
+	data.Job.JobRisks = JobRisks{
+		Risk1: scores[0],
+		Risk2: scores[1],
+		Risk3: scores[2],
+		Risk4: scores[3],
+		Risk5: scores[4],
+	}
+	return nil
+}
+
+// List the unacknowledged high-priority risks for the job comments, highest priority first.
+func riskComments(risks []Risk) string {
+	high := make([]Risk, 0, len(risks))
+	for _, risk := range risks {
+		if !risk.IsAcknowledged() && int(risk.Priority) >= riskCfg.HighPriority {
+			high = append(high, risk)
+		}
+	}
+	if len(high) == 0 {
+		return ""
+	}
+	sort.SliceStable(high, func(i, j int) bool {
+		return high[i].Priority > high[j].Priority
+	})
+	comment := strings.Builder{}
+	comment.WriteString("Unacknowledged risks:\n")
+	for _, risk := range high {
+		comment.WriteString(fmt.Sprintf("* Priority %d: %s\n",
+			int(risk.Priority), strings.TrimSpace(risk.Description)))
+	}
+	comment.WriteString("\n")
+	return comment.String()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRisks(t *testing.T) []Risk {
+	risks := []Risk{}
+	err := json.Unmarshal([]byte(`[
+		{"id":1,"activationsriskspriority":"3","activationsrisksstatus":"UnAcknowledged",
+		 "activationsrisksdescription":"The vessel has 3 HIGH priority maintenance tasks Open."},
+		{"id":2,"activationsriskspriority":"4","activationsrisksstatus":"UnAcknowledged",
+		 "activationsrisksdescription":"The vessels certificate of operation has expired"},
+		{"id":3,"activationsriskspriority":"5","activationsrisksstatus":"Acknowledged",
+		 "activationsrisksdescription":"The vessel flares have expired"},
+		{"id":4,"activationsriskspriority":"1","activationsrisksstatus":"UnAcknowledged",
+		 "activationsrisksdescription":"No fire extinguisher expiry date on record"},
+		{"id":5,"activationsriskspriority":"1","activationsrisksstatus":"UnAcknowledged",
+		 "activationsrisksdescription":"No engine service date recorded"},
+		{"id":6,"activationsriskspriority":"5","activationsrisksstatus":"UnAcknowledged",
+		 "activationsrisksdescription":"  The vessel is overdue for a survey inspection "}
+	]`), &risks)
+	assert.Nil(t, err)
+	return risks
+}
+
+func TestAggregateRisks(t *testing.T) {
+	defer func() { riskCfg = defaultRiskConfig() }()
+	data := &linkActivationDB{Risks: testRisks(t)}
+
+	err := aggregateRisks(data)
+	assert.Nil(t, err)
+	assert.Equal(t, JobRisks{Risk1: 5, Risk2: 5, Risk3: 4, Risk4: 3, Risk5: 1}, data.Job.JobRisks)
+
+	riskCfg.Scores = map[int]int{5: 10, 4: 7}
+	err = aggregateRisks(data)
+	assert.Nil(t, err)
+	assert.Equal(t, JobRisks{Risk1: 10, Risk2: 10, Risk3: 7, Risk4: 3, Risk5: 1}, data.Job.JobRisks)
+
+	riskCfg.Rule = riskRuleCount
+	err = aggregateRisks(data)
+	assert.Nil(t, err)
+	assert.Equal(t, JobRisks{Risk1: 2, Risk2: 0, Risk3: 1, Risk4: 1, Risk5: 2}, data.Job.JobRisks)
+
+	// No risks clears the scores
+	data.Risks = nil
+	err = aggregateRisks(data)
+	assert.Nil(t, err)
+	assert.Equal(t, JobRisks{}, data.Job.JobRisks)
+
+	riskCfg.Rule = "random"
+	assert.NotNil(t, validateRiskConfig())
+	assert.NotNil(t, aggregateRisks(data))
+}
+
+func TestRiskComments(t *testing.T) {
+	defer func() { riskCfg = defaultRiskConfig() }()
+	assert.Equal(t, "", riskComments(nil))
+	assert.Equal(t, "Unacknowledged risks:\n"+
+		"* Priority 5: The vessel is overdue for a survey inspection\n"+
+		"* Priority 4: The vessels certificate of operation has expired\n\n",
+		riskComments(testRisks(t)))
+
+	riskCfg.HighPriority = 6
+	assert.Equal(t, "", riskComments(testRisks(t)))
+}
+
+func TestExtendCommentFieldWithRisks(t *testing.T) {
+	data := &linkActivationDB{
+		Job:     Job{Comments: "Towed to the ramp"},
+		Sitreps: []Sitrep{{Updated: CustomJSONTime(getTime(t, "2022-09-17T02:30:00Z")), Comment: "Underway"}},
+		Risks:   testRisks(t)[:2],
+	}
+	err := extendCommentField(data)
+	assert.Nil(t, err)
+	assert.Equal(t, sitrepLogStart+"\nTowed to the ramp\n\n"+
+		"Unacknowledged risks:\n"+
+		"* Priority 4: The vessels certificate of operation has expired\n\n"+
+		"* 12:30 AEST: Underway\n"+sitrepLogEnd,
+		data.Job.Comments)
+}
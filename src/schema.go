@@ -0,0 +1,408 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const jobTableName = "DUTYJOBS"
+
+// The default mapping of activations to DUTYJOBS columns. It can be extended or changed with an
+// override file (see loadSchema()).
+//
+//go:embed schema.yml
+var defaultSchemaYAML []byte
+
+type columnSchema struct {
+	Column string `yaml:"column"`
+	// Path of Go field names in the parsed Job struct
+	Field string `yaml:"field"`
+	// Dot-separated path in the TripWatch activation JSON
+	JSON      string `yaml:"json"`
+	Transform string `yaml:"transform"`
+	Len       int    `yaml:"len"`
+	Key       bool   `yaml:"key"`
+	Sequence  bool   `yaml:"sequence"`
+	// When TripWatch may clear the column: never, zero or null
+	Clear string `yaml:"clear"`
+	// The column holds the TripWatch log, which is merged with the text in the DB
+	Log bool `yaml:"log"`
+	// Remove a column from the default schema
+	Omit bool `yaml:"omit"`
+}
+
+type tableSchema struct {
+	Table string `yaml:"table"`
+	// Replace the default schema's columns for the table instead of merging with them
+	Replace bool           `yaml:"replace"`
+	Columns []columnSchema `yaml:"columns"`
+}
+
+type fieldSchema struct {
+	Tables []tableSchema `yaml:"tables"`
+}
+
+var activeSchema = mustDefaultSchema()
+
+func parseSchema(data []byte) (fieldSchema, error) {
+	schema := fieldSchema{}
+	if err := yaml.UnmarshalStrict(data, &schema); err != nil {
+		return fieldSchema{}, errors.Wrapf(err, "parse schema YAML")
+	}
+	return schema, nil
+}
+
+// The embedded schema is part of the build, so failing to parse it is a coding error.
+func mustDefaultSchema() fieldSchema {
+	schema, err := parseSchema(defaultSchemaYAML)
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// Load the default schema and apply the override file, if any. Tables in the override are
+// merged column by column with the default tables: a column with the same name replaces the
+// default one, new columns are added to the end and `omit` removes a default column.
+func loadSchema(overrideFile string) (fieldSchema, error) {
+	schema := mustDefaultSchema()
+	if overrideFile == "" {
+		if err := schema.validate(); err != nil {
+			return fieldSchema{}, errors.Wrapf(err, "load default schema")
+		}
+		return schema, nil
+	}
+	override := fieldSchema{}
+	if data, err := ioutil.ReadFile(overrideFile); err != nil {
+		return fieldSchema{}, errors.Wrapf(err, "load schema override")
+	} else if override, err = parseSchema(data); err != nil {
+		return fieldSchema{}, errors.Wrapf(err, "load schema override %s", overrideFile)
+	}
+	for _, table := range override.Tables {
+		schema.mergeTable(table)
+	}
+	if err := schema.validate(); err != nil {
+		return fieldSchema{}, errors.Wrapf(err, "load schema override %s", overrideFile)
+	}
+	return schema, nil
+}
+
+// Check the settings of every column which can be checked without an activation, so that
+// mistakes in the schema stop the service starting rather than failing every activation.
+// Enum mappings must be loaded first as they can be used as transforms.
+func (s fieldSchema) validate() error {
+	for _, table := range s.Tables {
+		for _, col := range table.Columns {
+			if err := col.validate(); err != nil {
+				return errors.Wrapf(err, "schema column %s.%s", table.Table, col.Column)
+			}
+		}
+	}
+	return nil
+}
+
+func (c columnSchema) validate() error {
+	isString := false
+	switch c.Clear {
+	case "", clearNever, clearZero, clearNull:
+	default:
+		return errors.Errorf("unknown clear policy '%s'", c.Clear)
+	}
+	if c.Column == "" {
+		return errors.Errorf("has no column name")
+	} else if c.Field != "" && c.JSON != "" {
+		return errors.Errorf("has both a field and a json path")
+	} else if c.Field != "" {
+		if v, _, err := schemaFieldValue(Job{}, c.Field); err != nil {
+			return err
+		} else {
+			isString = reflect.ValueOf(v).Kind() == reflect.String
+		}
+	} else if _, ok := getSchemaTransform(c.Transform); !ok {
+		return errors.Errorf("unknown transform '%s'", c.Transform)
+	} else if err := validJSONPath(c.JSON); err != nil {
+		return err
+	} else {
+		isString = reflect.ValueOf(transformSample(c.Transform)).Kind() == reflect.String
+	}
+	if c.Len < 0 {
+		return errors.Errorf("has a negative length")
+	} else if isString && c.Len == 0 && !c.Log {
+		return errors.Errorf("has no length")
+	}
+	return nil
+}
+
+// A JSON path is a list of object keys separated by dots, e.g. activationsnotes.remark.
+func validJSONPath(path string) error {
+	if path == "" {
+		return errors.Errorf("has neither a field nor a json path")
+	}
+	for _, name := range strings.Split(path, ".") {
+		if name == "" || strings.TrimSpace(name) != name {
+			return errors.Errorf("json path '%s' is malformed", path)
+		}
+	}
+	return nil
+}
+
+func (s *fieldSchema) mergeTable(override tableSchema) {
+	idx := -1
+	for i, table := range s.Tables {
+		if table.Table == override.Table {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		s.Tables = append(s.Tables, tableSchema{Table: override.Table})
+		idx = len(s.Tables) - 1
+	}
+	table := &s.Tables[idx]
+	if override.Replace {
+		table.Columns = nil
+	}
+	for _, col := range override.Columns {
+		found := false
+		for i := range table.Columns {
+			if table.Columns[i].Column == col.Column {
+				table.Columns[i] = col
+				found = true
+			}
+		}
+		if !found {
+			table.Columns = append(table.Columns, col)
+		}
+	}
+	columns := table.Columns[:0]
+	for _, col := range table.Columns {
+		if !col.Omit {
+			columns = append(columns, col)
+		}
+	}
+	table.Columns = columns
+}
+
+type schemaTransform func(raw json.RawMessage) (interface{}, error)
+
+// Parse the JSON value into the type returned by newValue, using that type's JSON unmarshaler.
+func unmarshalTransform(newValue func() interface{}) schemaTransform {
+	return func(raw json.RawMessage) (interface{}, error) {
+		v := newValue()
+		if err := json.Unmarshal(raw, v); err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(v).Elem().Interface(), nil
+	}
+}
+
+func stringTransform(raw json.RawMessage) (interface{}, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	} else if string(raw) == "null" {
+		return "", nil
+	}
+	// Numbers and bools are written as they appear in the JSON
+	return strings.TrimSpace(string(raw)), nil
+}
+
+var schemaTransforms = map[string]schemaTransform{
+	"":       stringTransform,
+	"string": stringTransform,
+	"int": func(raw json.RawMessage) (interface{}, error) {
+		var i IntString
+		err := json.Unmarshal(raw, &i)
+		return int(i), err
+	},
+	"float": func(raw json.RawMessage) (interface{}, error) {
+		var i IntString
+		err := json.Unmarshal(raw, &i)
+		return usageValue(i), err
+	},
+	"bool":      unmarshalTransform(func() interface{} { return new(CustomBool) }),
+	"time":      unmarshalTransform(func() interface{} { return new(CustomJSONTime) }),
+	"length":    unmarshalTransform(func() interface{} { return new(LengthEnum) }),
+	"seastate":  unmarshalTransform(func() interface{} { return new(SeaStateEnum) }),
+	"winddir":   unmarshalTransform(func() interface{} { return new(WindDirEnum) }),
+	"windspeed": unmarshalTransform(func() interface{} { return new(WindSpeedEnum) }),
+}
+
+// Find a transform by name. As well as the fixed transforms, each enum mapping (see
+// mapping.go) can be used as a transform.
+func getSchemaTransform(name string) (schemaTransform, bool) {
+	if transform, ok := schemaTransforms[name]; ok {
+		return transform, true
+	} else if _, ok := enumMappings[name]; ok {
+		return func(raw json.RawMessage) (interface{}, error) {
+			s, err := stringTransform(raw)
+			return mapEnum(name, s.(string)), err
+		}, true
+	}
+	return nil, false
+}
+
+// Follow a path of Go field names from the Job struct. The JSON path of the field in the
+// TripWatch activation is also returned, or "" if the field isn't read from TripWatch.
+func schemaFieldValue(job Job, path string) (interface{}, string, error) {
+	v := reflect.ValueOf(job)
+	jsonPath := []string{}
+	fromJSON := true
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() != reflect.Struct {
+			return nil, "", errors.Errorf("field %s: %s is not a struct", path, v.Type())
+		} else if f, ok := v.Type().FieldByName(name); !ok || f.PkgPath != "" {
+			return nil, "", errors.Errorf("field %s: no field %s in %s", path, name, v.Type())
+		} else {
+			v = v.FieldByIndex(f.Index)
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" {
+				jsonPath = append(jsonPath, tag)
+			} else if !f.Anonymous {
+				// Embedded structs are flattened into their parent in the JSON
+				fromJSON = false
+			}
+		}
+	}
+	if !fromJSON || len(jsonPath) == 0 {
+		return v.Interface(), "", nil
+	}
+	return v.Interface(), strings.Join(jsonPath, "."), nil
+}
+
+// Follow a dot-separated path through the activation JSON. The returned value is nil if any
+// part of the path is missing.
+func schemaJSONValue(raw json.RawMessage, path string) (json.RawMessage, error) {
+	for _, name := range strings.Split(path, ".") {
+		if len(raw) == 0 {
+			return nil, nil
+		}
+		obj := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, errors.Wrapf(err, "json %s: parent of %s is not an object", path, name)
+		}
+		raw = obj[name]
+	}
+	return raw, nil
+}
+
+// Whether a column's value was given by TripWatch.
+type valueState int
+
+const (
+	valueSet    valueState = iota // Given, or derived by vmrsync
+	valueNull                     // Null or blank in the activation JSON
+	valueAbsent                   // Not in the activation JSON at all
+)
+
+// Policies for when TripWatch may clear a column (see columnSchema.Clear).
+const (
+	clearNever = "never" // Zero and null values are skipped, keeping the DB value (default)
+	clearZero  = "zero"  // Zero values are written, null values are skipped
+	clearNull  = "null"  // Zero values are written and null values set the column to NULL
+)
+
+func jsonState(raw json.RawMessage) valueState {
+	var s string
+	if raw == nil {
+		return valueAbsent
+	} else if strings.TrimSpace(string(raw)) == "null" {
+		return valueNull
+	} else if err := json.Unmarshal(raw, &s); err == nil && strings.TrimSpace(s) == "" {
+		return valueNull
+	}
+	return valueSet
+}
+
+func (c columnSchema) value(data *linkActivationDB) (interface{}, valueState, error) {
+	if c.Field != "" {
+		v, jsonPath, err := schemaFieldValue(data.Job, c.Field)
+		if err != nil || jsonPath == "" || len(data.raw) == 0 {
+			return v, valueSet, err
+		} else if raw, err := schemaJSONValue(data.raw, jsonPath); err != nil {
+			return nil, valueSet, err
+		} else {
+			return v, jsonState(raw), nil
+		}
+	}
+	transform, ok := getSchemaTransform(c.Transform)
+	if !ok {
+		return nil, valueSet, errors.Errorf("unknown transform '%s'", c.Transform)
+	}
+	if raw, err := schemaJSONValue(data.raw, c.JSON); err != nil {
+		return nil, valueSet, err
+	} else if state := jsonState(raw); state == valueAbsent {
+		return nil, state, nil
+	} else if v, err := transform(raw); err != nil {
+		return nil, state, errors.Wrapf(err, "json %s transform '%s'", c.JSON, c.Transform)
+	} else {
+		return v, state, nil
+	}
+}
+
+// Evaluate the schema for an activation, giving the columns of each table in schema order.
+// Columns whose value is zero or nil are only written if they have writeEmpty set, as allowed
+// by the column's clear policy. A nil value is written as NULL.
+func (s fieldSchema) columns(data *linkActivationDB) (map[string][]column, error) {
+	tables := make(map[string][]column)
+	for _, table := range s.Tables {
+		columns := make([]column, 0, len(table.Columns))
+		for _, col := range table.Columns {
+			v, state, err := col.value(data)
+			if err != nil {
+				return nil, errors.Wrapf(err, "schema column %s.%s", table.Table, col.Column)
+			}
+			if v != nil && reflect.ValueOf(v).Kind() == reflect.String && col.Len <= 0 && !col.Log {
+				return nil, errors.Errorf("schema column %s.%s has no length", table.Table, col.Column)
+			}
+			writeEmpty := false
+			switch clear := col.Clear; {
+			case clear != "" && clear != clearNever && clear != clearZero && clear != clearNull:
+				return nil, errors.Errorf("schema column %s.%s has unknown clear policy '%s'",
+					table.Table, col.Column, clear)
+			case v != nil && !reflect.ValueOf(v).IsZero():
+				// Values are always written
+			case state == valueNull:
+				if clear == clearNull {
+					v = nil
+					writeEmpty = true
+				}
+			case state == valueSet:
+				writeEmpty = clear == clearZero || clear == clearNull
+			}
+			columns = append(columns, column{
+				name:       col.Column,
+				isMatch:    col.Key,
+				isSequence: col.Sequence,
+				writeEmpty: writeEmpty,
+				isLog:      col.Log,
+				maxStrlen:  col.Len,
+				value:      v,
+			})
+		}
+		tables[table.Table] = columns
+	}
+	return tables, nil
+}
+
+// Columns which find a job's DUTYJOBS row when the job has no link.
+func jobKeyColumns(data *linkActivationDB) ([]column, error) {
+	tables, err := activeSchema.columns(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "job key columns")
+	}
+	keys := []column{}
+	for _, col := range tables[jobTableName] {
+		if col.isMatch {
+			keys = append(keys, col)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("schema has no key columns for %s", jobTableName)
+	}
+	return keys, nil
+}
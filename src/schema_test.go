@@ -0,0 +1,262 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func schemaColumn(columns []column, name string) (column, bool) {
+	for _, col := range columns {
+		if col.name == name {
+			return col, true
+		}
+	}
+	return column{}, false
+}
+
+func TestDefaultSchemaColumns(t *testing.T) {
+	data := &linkActivationDB{
+		ID: 42,
+		Job: Job{
+			DutyLogID: 3,
+			StartTime: CustomJSONTime(time.Now()),
+			Type:      JobType("Search"),
+			VMRVessel: VMRVessel{
+				ID:   1,
+				Name: "MR1",
+			},
+			AssistedVessel: AssistedVessel{Name: "Nautilus"},
+			JobRisks:       JobRisks{Risk2: 4},
+		},
+	}
+	tables, err := activeSchema.columns(data)
+	assert.Nil(t, err)
+	assert.Len(t, tables, 1)
+	columns := tables[jobTableName]
+
+	col, ok := schemaColumn(columns, "JOBDUTYVESSELNAME")
+	assert.True(t, ok)
+	assert.Equal(t, data.Job.VMRVessel.Name, col.value)
+	assert.True(t, col.isMatch)
+	assert.Equal(t, 30, col.maxStrlen)
+	col, _ = schemaColumn(columns, "JOBDUTYVESSELNO")
+	assert.Equal(t, 1, col.value)
+	col, _ = schemaColumn(columns, "JOBVESSELNAME")
+	assert.Equal(t, "Nautilus", col.value)
+	col, _ = schemaColumn(columns, "JOBTIMEOUT")
+	assert.Equal(t, data.Job.StartTime, col.value)
+	assert.True(t, col.isMatch)
+	col, _ = schemaColumn(columns, "JOBRISK2")
+	assert.Equal(t, 4, col.value)
+
+	// Only the last sequence column is allocated on insert
+	assert.Equal(t, "JOBDUTYSEQUENCE", columns[0].name)
+	assert.Equal(t, 3, columns[0].value)
+	assert.True(t, columns[0].isSequence)
+	assert.Equal(t, "JOBJOBSEQUENCE", columns[1].name)
+	assert.True(t, columns[1].isSequence)
+
+	keys, err := jobKeyColumns(data)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"JOBTIMEOUT", "JOBDUTYVESSELNAME"}, []string{keys[0].name, keys[1].name})
+
+	seqTables, err := sequenceTables()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{jobTableName}, seqTables)
+}
+
+func TestSchemaOverride(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "schema.yml")
+	err := ioutil.WriteFile(fname, []byte(`
+tables:
+  - table: DUTYJOBS
+    columns:
+      - {column: JOBDETAILS, field: Purpose, len: 40}
+      - {column: JOBLOA, omit: true}
+      - {column: JOBREMARKS, json: activationsnotes.remark, len: 30}
+      - {column: JOBTYPE2, json: activationstype, transform: jobtype, len: 20}
+      - {column: JOBHOURS, json: activationshours, transform: float}
+      - {column: JOBDEPART, json: activationsrvdeparttime, transform: time}
+  - table: EXTRAJOBS
+    columns:
+      - {column: TRIPWATCH_ID, json: id, transform: int, key: true}
+`), 0644)
+	assert.Nil(t, err)
+	schema, err := loadSchema(fname)
+	assert.Nil(t, err)
+
+	data := &linkActivationDB{
+		Job: Job{Purpose: "Tow to ramp", AssistedVessel: AssistedVessel{Length: "<4.5m"}},
+		raw: []byte(`{"id":86239,"activationstype":"SAR","activationshours":"12.5",
+			"activationsrvdeparttime":"2022-09-17 02:16:00","activationsnotes":{"remark":"Big swell"}}`),
+	}
+	tables, err := schema.columns(data)
+	assert.Nil(t, err)
+	assert.Len(t, tables, 2)
+
+	col, ok := schemaColumn(tables[jobTableName], "JOBDETAILS")
+	assert.True(t, ok)
+	assert.Equal(t, 40, col.maxStrlen)
+	_, ok = schemaColumn(tables[jobTableName], "JOBLOA")
+	assert.False(t, ok)
+	col, _ = schemaColumn(tables[jobTableName], "JOBREMARKS")
+	assert.Equal(t, "Big swell", col.value)
+	col, _ = schemaColumn(tables[jobTableName], "JOBTYPE2")
+	assert.Equal(t, "Search", col.value)
+	col, _ = schemaColumn(tables[jobTableName], "JOBHOURS")
+	assert.Equal(t, 12.5, col.value)
+	col, _ = schemaColumn(tables[jobTableName], "JOBDEPART")
+	assert.Equal(t, CustomJSONTime(getTime(t, "2022-09-17T02:16:00Z")), col.value)
+	assert.Equal(t, []column{{name: "TRIPWATCH_ID", isMatch: true, value: 86239}}, tables["EXTRAJOBS"])
+
+	// JSON which isn't in the activation gives a nil value
+	data.raw = []byte(`{"id":86239}`)
+	tables, err = schema.columns(data)
+	assert.Nil(t, err)
+	col, _ = schemaColumn(tables[jobTableName], "JOBREMARKS")
+	assert.Nil(t, col.value)
+
+	// The default schema is unchanged
+	tables, err = mustDefaultSchema().columns(data)
+	assert.Nil(t, err)
+	_, ok = schemaColumn(tables[jobTableName], "JOBLOA")
+	assert.True(t, ok)
+}
+
+func TestSchemaErrors(t *testing.T) {
+	data := &linkActivationDB{raw: []byte(`{"id":1}`)}
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{name: "unknown field", schema: "tables:\n  - table: T\n    columns:\n      - {column: A, field: Nope}\n"},
+		{name: "unknown transform", schema: "tables:\n  - table: T\n    columns:\n      - {column: A, json: id, transform: nope}\n"},
+		{name: "string without length", schema: "tables:\n  - table: T\n    columns:\n      - {column: A, field: Purpose}\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema, err := parseSchema([]byte(test.schema))
+			assert.Nil(t, err)
+			_, err = schema.columns(data)
+			assert.NotNil(t, err)
+		})
+	}
+
+	_, err := parseSchema([]byte("tables:\n  - table: T\n    colums: []\n"))
+	assert.NotNil(t, err)
+}
+
+func TestLoadSchemaValidation(t *testing.T) {
+	// Mistakes which can't be caught by parsing the YAML are found when the schema is loaded
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		column string
+	}{
+		{name: "unknown clear policy", column: "{column: JOBADULTS, field: AssistedVessel.NumAdults, clear: sometimes}"},
+		{name: "unknown transform", column: "{column: JOBHOURS, json: activationshours, transform: flaot}"},
+		{name: "unknown field", column: "{column: JOBDETAILS, field: Porpose, len: 40}"},
+		{name: "string field without len", column: "{column: JOBDETAILS, field: Purpose}"},
+		{name: "string json without len", column: "{column: JOBREMARKS, json: activationsnotes.remark}"},
+		{name: "enum without len", column: "{column: JOBTYPE, json: activationstype, transform: seastate}"},
+		{name: "negative len", column: "{column: JOBDETAILS, field: Purpose, len: -1}"},
+		{name: "empty json path segment", column: "{column: JOBREMARKS, json: activationsnotes..remark, len: 30}"},
+		{name: "trailing dot in json path", column: "{column: JOBREMARKS, json: activationsnotes., len: 30}"},
+		{name: "space in json path", column: "{column: JOBREMARKS, json: \"activationsnotes. remark\", len: 30}"},
+		{name: "no field or json", column: "{column: JOBREMARKS, len: 30}"},
+		{name: "field and json", column: "{column: JOBDETAILS, field: Purpose, json: activationspurpose, len: 40}"},
+		{name: "no column name", column: "{field: Purpose, len: 40}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := filepath.Join(dir, "schema.yml")
+			err := ioutil.WriteFile(fname, []byte("tables:\n  - table: DUTYJOBS\n    columns:\n      - "+
+				test.column+"\n"), 0644)
+			assert.Nil(t, err)
+			_, err = loadSchema(fname)
+			assert.NotNil(t, err)
+		})
+	}
+
+	// The built-in schema is checked too, and numbers, times and log columns need no len
+	_, err := loadSchema("")
+	assert.Nil(t, err)
+	fname := filepath.Join(dir, "schema.yml")
+	err = ioutil.WriteFile(fname, []byte("tables:\n  - table: DUTYJOBS\n    columns:\n"+
+		"      - {column: JOBHOURSEND, json: activationsvesselhoursend, transform: float}\n"+
+		"      - {column: JOBTIMEIN, json: activationsreturned, transform: time}\n"+
+		"      - {column: JOBNOTES, json: activationsnotes, log: true}\n"), 0644)
+	assert.Nil(t, err)
+	_, err = loadSchema(fname)
+	assert.Nil(t, err)
+}
+
+func TestSchemaClearPolicy(t *testing.T) {
+	schema, err := parseSchema([]byte(`
+tables:
+  - table: DUTYJOBS
+    columns:
+      - {column: JOBADULTS, field: AssistedVessel.NumAdults}
+      - {column: JOBCHILDREN, field: AssistedVessel.NumKids, clear: zero}
+      - {column: JOBDONATION, field: Donation, clear: "null"}
+      - {column: JOBASSISTNO, field: AssistNum, clear: "null"}
+      - {column: JOBVESSELNAME, field: AssistedVessel.Name, len: 30, clear: "null"}
+      - {column: JOBQASNO, json: activationspoliceincidentnumber, len: 10, clear: "null"}
+      - {column: JOBRISK1, field: JobRisks.Risk1, clear: zero}
+`))
+	assert.Nil(t, err)
+	byName := func(data *linkActivationDB) map[string]column {
+		tables, err := schema.columns(data)
+		assert.Nil(t, err)
+		cols := map[string]column{}
+		for _, col := range tables[jobTableName] {
+			cols[col.name] = col
+		}
+		return cols
+	}
+
+	// Zero values given by TripWatch
+	data := &linkActivationDB{}
+	data.raw = []byte(`{"activationsdvpobadult":0,"activationsdvpobchildren":0,
+		"activationsdonationreceived":"0","activationsdvvesselsname":"  ",
+		"activationspoliceincidentnumber":null}`)
+	cols := byName(data)
+	assert.False(t, cols["JOBADULTS"].writeEmpty)
+	assert.True(t, cols["JOBCHILDREN"].writeEmpty)
+	assert.Equal(t, 0, cols["JOBCHILDREN"].value)
+	assert.True(t, cols["JOBDONATION"].writeEmpty)
+	assert.Equal(t, IntString(0), cols["JOBDONATION"].value)
+	// Absent from the JSON, so left alone
+	assert.False(t, cols["JOBASSISTNO"].writeEmpty)
+	// Null and blank values clear the column
+	assert.True(t, cols["JOBVESSELNAME"].writeEmpty)
+	assert.Nil(t, cols["JOBVESSELNAME"].value)
+	assert.True(t, cols["JOBQASNO"].writeEmpty)
+	assert.Nil(t, cols["JOBQASNO"].value)
+	// Values derived by vmrsync are never absent or null
+	assert.True(t, cols["JOBRISK1"].writeEmpty)
+	assert.Equal(t, 0, cols["JOBRISK1"].value)
+
+	// Null values under the zero policy are skipped
+	data.raw = []byte(`{"activationsdvpobchildren":null,"activationsdonationreceived":null}`)
+	cols = byName(data)
+	assert.False(t, cols["JOBCHILDREN"].writeEmpty)
+	assert.True(t, cols["JOBDONATION"].writeEmpty)
+	assert.Nil(t, cols["JOBDONATION"].value)
+
+	// Values which aren't zero are always written
+	data.Job.AssistedVessel.NumAdults = 2
+	data.Job.Donation = 50
+	cols = byName(data)
+	assert.Equal(t, 2, cols["JOBADULTS"].value)
+	assert.Equal(t, IntString(50), cols["JOBDONATION"].value)
+
+	schema.Tables[0].Columns[0].Clear = "sometimes"
+	_, err = schema.columns(data)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Strategies for allocating new sequence numbers (e.g. JOBJOBSEQUENCE) when inserting rows.
+const (
+	// Use a Firebird generator, which is created on demand. Generators are atomic across
+	// connections so concurrent writers can never be handed the same number. The generator is
+	// also moved past MAX(col) on each allocation so that it stays ahead of rows inserted by
+	// the VMR desktop app.
+	seqStrategyGenerator = "generator"
+	// Use MAX(col)+1, but write the whole activation in a serializable transaction so that
+	// other writers to the table are locked out until it commits.
+	seqStrategyLocked = "locked"
+	// Use MAX(col)+1 with no locking. This was the original behaviour.
+	seqStrategyMax = "max"
+)
+
+// Number of times an insert is attempted with a fresh sequence number after the DB reports a
+// duplicate key.
+const maxInsertAttempts = 5
+
+type sequenceConfig struct {
+	Strategy  string `yaml:"strategy"`
+	Generator string `yaml:"generator"`
+}
+
+// Sequence allocation config keyed by table name. Tables which aren't listed use a generator
+// named VMRSYNC_GEN_<TABLE>.
+var sequenceConfigs = map[string]sequenceConfig{}
+
+var generatorNameRegex = regexp.MustCompile(`^[A-Z][A-Z0-9_$]{0,30}$`)
+
+func getSequenceConfig(table string) sequenceConfig {
+	cfg := sequenceConfigs[table]
+	if cfg.Strategy == "" {
+		cfg.Strategy = seqStrategyGenerator
+	}
+	if cfg.Strategy == seqStrategyGenerator && cfg.Generator == "" {
+		cfg.Generator = "VMRSYNC_GEN_" + table
+	}
+	return cfg
+}
+
+func validateSequenceConfigs() error {
+	for table := range sequenceConfigs {
+		switch cfg := getSequenceConfig(table); cfg.Strategy {
+		case seqStrategyGenerator:
+			if !generatorNameRegex.MatchString(cfg.Generator) {
+				return errors.Errorf("sequence generator name '%s' for table %s is invalid",
+					cfg.Generator, table)
+			}
+		case seqStrategyLocked, seqStrategyMax:
+		default:
+			return errors.Errorf("unknown sequence strategy '%s' for table %s", cfg.Strategy, table)
+		}
+	}
+	return nil
+}
+
+// List all tables which have a sequence number column that is allocated on insert.
+func sequenceTables() ([]string, error) {
+	list := []string{}
+	for _, table := range activeSchema.Tables {
+		for _, col := range table.Columns {
+			if col.Sequence {
+				list = append(list, table.Table)
+				break
+			}
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// Should activations be written inside a serializable transaction?
+func usesLockedSequences() bool {
+	for table := range sequenceConfigs {
+		if getSequenceConfig(table).Strategy == seqStrategyLocked {
+			return true
+		}
+	}
+	return false
+}
+
+// Create any sequence generators which don't exist in the DB yet.
+func prepareSequences(ctx context.Context, db dbExecutor) error {
+	tables, err := sequenceTables()
+	if err != nil {
+		return errors.Wrapf(err, "prepare sequences")
+	}
+	for _, table := range tables {
+		cfg := getSequenceConfig(table)
+		if cfg.Strategy != seqStrategyGenerator {
+			continue
+		}
+		const STMT = "SELECT COUNT(*) FROM RDB$GENERATORS WHERE RDB$GENERATOR_NAME=?"
+		var count int
+		if rows, err := db.QueryContext(ctx, STMT, cfg.Generator); err != nil {
+			return errors.Wrapf(dbError{
+				error:     err,
+				name:      "RDB$GENERATORS",
+				statement: STMT,
+			}, "prepare sequences finding generator %s", cfg.Generator)
+		} else {
+			for rows.Next() {
+				if err := rows.Scan(&count); err != nil {
+					rows.Close()
+					return errors.Wrapf(err, "prepare sequences scanning generator count")
+				}
+			}
+			rows.Close()
+		}
+		if count > 0 {
+			continue
+		}
+		// The generator starts at 0 and is moved past the table's current maximum on first use.
+		stmt := fmt.Sprintf("CREATE SEQUENCE %s", cfg.Generator)
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return errors.Wrapf(dbError{
+				error:     err,
+				name:      table,
+				statement: stmt,
+			}, "prepare sequences creating generator")
+		}
+	}
+	return nil
+}
+
+func getMaxID(ctx context.Context, db dbExecutor, tableName, colName string) (int, error) {
+	var maxID sql.NullInt64
+	// Statement to get the maximum sequence number from the current DB table
+	idStmt := fmt.Sprintf("SELECT MAX(%s) FROM %s", colName, tableName)
+	if rows, err := db.QueryContext(ctx, idStmt); err != nil {
+		return 0, errors.Wrapf(dbError{
+			error:     err,
+			name:      tableName,
+			cols:      []column{{name: colName}},
+			statement: idStmt,
+		}, "insert getting next sequence number")
+	} else {
+		defer rows.Close()
+		if !rows.Next() {
+			return 0, errors.Errorf("insert tx max id rows failed for table %s", tableName)
+		} else if err := rows.Scan(&maxID); err != nil {
+			return 0, errors.Errorf("insert tx max ID scan failed for table %s", tableName)
+		}
+	}
+	return int(maxID.Int64), nil
+}
+
+func incrementGenerator(ctx context.Context, db dbExecutor, generator string, step int) (int, error) {
+	var id int
+	stmt := fmt.Sprintf("SELECT GEN_ID(%s, %d) FROM RDB$DATABASE", generator, step)
+	if rows, err := db.QueryContext(ctx, stmt); err != nil {
+		return 0, errors.Wrapf(dbError{
+			error:     err,
+			name:      generator,
+			statement: stmt,
+		}, "increment generator")
+	} else {
+		defer rows.Close()
+		if !rows.Next() {
+			return 0, errors.Errorf("increment generator %s returned no rows", generator)
+		} else if err := rows.Scan(&id); err != nil {
+			return 0, errors.Wrapf(err, "increment generator %s scan", generator)
+		}
+	}
+	return id, nil
+}
+
+// Allocate the next sequence number for a column. The number returned is always greater than
+// lastID, which is the number tried by a previous failed insert (or 0).
+func allocateSequence(ctx context.Context, db dbExecutor, tableName, colName string, lastID int) (int, error) {
+	cfg := getSequenceConfig(tableName)
+	if dryRun {
+		// Don't consume generator values when nothing is going to be written.
+		cfg.Strategy = seqStrategyMax
+	}
+	maxID, err := getMaxID(ctx, db, tableName, colName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "allocate sequence")
+	}
+	if cfg.Strategy != seqStrategyGenerator {
+		if maxID == 0 {
+			return 0, errors.Wrapf(dbError{
+				error: errors.Errorf("max sequence number is 0"),
+				name:  tableName,
+				cols:  []column{{name: colName}},
+			}, "maxID cannot be 0")
+		} else if maxID < lastID {
+			maxID = lastID
+		}
+		return maxID + 1, nil
+	}
+
+	id, err := incrementGenerator(ctx, db, cfg.Generator, 1)
+	if err != nil {
+		return 0, errors.Wrapf(err, "allocate sequence for table %s", tableName)
+	}
+	floor := maxID
+	if lastID > floor {
+		floor = lastID
+	}
+	if id <= floor {
+		// Another writer has used numbers beyond the generator. Move the generator past them.
+		if id, err = incrementGenerator(ctx, db, cfg.Generator, floor-id+1); err != nil {
+			return 0, errors.Wrapf(err, "allocate sequence advancing %s", cfg.Generator)
+		}
+	}
+	return id, nil
+}
+
+// Firebird reports unique constraint violations with one of these messages.
+func isDuplicateKeyError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "violation of PRIMARY or UNIQUE KEY constraint") ||
+		strings.Contains(msg, "attempt to store duplicate value")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenceConfig(t *testing.T) {
+	defer func() { sequenceConfigs = map[string]sequenceConfig{} }()
+
+	sequenceConfigs = map[string]sequenceConfig{}
+	assert.Equal(t, sequenceConfig{Strategy: "generator", Generator: "VMRSYNC_GEN_DUTYJOBS"},
+		getSequenceConfig("DUTYJOBS"))
+	assert.False(t, usesLockedSequences())
+
+	sequenceConfigs = map[string]sequenceConfig{
+		"DUTYJOBS": {Generator: "GEN_JOBS"},
+	}
+	assert.Nil(t, validateSequenceConfigs())
+	assert.Equal(t, "GEN_JOBS", getSequenceConfig("DUTYJOBS").Generator)
+
+	sequenceConfigs = map[string]sequenceConfig{
+		"DUTYJOBS": {Strategy: "locked"},
+	}
+	assert.Nil(t, validateSequenceConfigs())
+	assert.True(t, usesLockedSequences())
+
+	sequenceConfigs = map[string]sequenceConfig{
+		"DUTYJOBS": {Strategy: "random"},
+	}
+	assert.NotNil(t, validateSequenceConfigs())
+
+	sequenceConfigs = map[string]sequenceConfig{
+		"DUTYJOBS": {Generator: "GEN; DROP TABLE DUTYJOBS"},
+	}
+	assert.NotNil(t, validateSequenceConfigs())
+}
+
+func TestSequenceTables(t *testing.T) {
+	tables, err := sequenceTables()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DUTYJOBS"}, tables)
+}
+
+func TestIsDuplicateKeyError(t *testing.T) {
+	assert.True(t, isDuplicateKeyError(errors.Wrapf(errors.New(
+		"violation of PRIMARY or UNIQUE KEY constraint \"PK_JOBS\" on table \"DUTYJOBS\"\n"),
+		"insert errored")))
+	assert.True(t, isDuplicateKeyError(errors.New(
+		"attempt to store duplicate value (visible to active transactions) in unique index \"PK\"\n")))
+	assert.False(t, isDuplicateKeyError(errors.New("RowsAffected is 0")))
+}
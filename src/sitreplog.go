@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The TripWatch log is kept between these markers in the job comments (JOBDETAILS_LONG).
+// Anything outside the markers was written in the VMR desktop app and is never changed.
+const (
+	sitrepLogStart = "[TripWatch log - updated by vmrsync, add notes outside this section]"
+	sitrepLogEnd   = "[End of TripWatch log]"
+)
+
+var (
+	sitrepEntryRE   = regexp.MustCompile(`^\* \d\d:\d\d AEST(?: #(\d+))?[ :]`)
+	sitrepOmittedRE = regexp.MustCompile(`^\[(\d+) earlier entries omitted, up to #(\d+)\]$`)
+)
+
+type sitrepEntry struct {
+	id int // TripWatch sitrep ID, or 0 if unknown
+	// The entry line, followed by any lines added to it in the VMR desktop app
+	text string
+}
+
+// The activation comments, risks and tides, followed by one entry per sitrep. Sitreps are added to
+// the log as they arrive, so that entries stay put once they have been written. When the column
+// has a maximum length, the oldest entries are dropped to make room for new ones.
+type sitrepLog struct {
+	header      string
+	omitted     int
+	omittedUpTo int // Highest sitrep ID which has been dropped
+	entries     []sitrepEntry
+}
+
+func sitrepLine(sitrep Sitrep) string {
+	line := strings.Builder{}
+	line.WriteString(fmt.Sprintf("* %s AEST", sitrep.Updated.AEST().Format("15:04")))
+	if sitrep.ID != 0 {
+		line.WriteString(fmt.Sprintf(" #%d", sitrep.ID))
+	}
+	if by := strings.TrimSpace(sitrep.UpdatedBy); by != "" {
+		line.WriteString(" " + by)
+	}
+	// Each entry must stay on one line
+	note := strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(sitrep.Comment)
+	line.WriteString(": " + strings.TrimSpace(note))
+	motion := []string{}
+	if !sitrep.Speed.IsZero() {
+		motion = append(motion, fmt.Sprintf("%g kn", sitrep.Speed))
+	}
+	if !sitrep.Heading.IsZero() {
+		motion = append(motion, fmt.Sprintf("heading %g", sitrep.Heading))
+	}
+	if len(motion) > 0 {
+		line.WriteString(" (" + strings.Join(motion, ", ") + ")")
+	}
+	return line.String()
+}
+
+func newSitrepLog(data *linkActivationDB) sitrepLog {
+	latest := sitrepLog{
+		header: strings.TrimSpace(strings.TrimSpace(data.Job.Comments) + "\n\n" +
+			statsComments(data.Job.JobStats) + riskComments(data.Risks) +
+			tideComments(data.Job.Weather.tides)),
+	}
+	for _, sitrep := range data.Sitreps {
+		latest.entries = append(latest.entries, sitrepEntry{id: sitrep.ID, text: sitrepLine(sitrep)})
+	}
+	return latest
+}
+
+// Parse the lines between the log markers.
+func parseSitrepLog(section string) sitrepLog {
+	parsed := sitrepLog{}
+	header := []string{}
+	for _, line := range strings.Split(section, "\n") {
+		if m := sitrepEntryRE.FindStringSubmatch(line); m != nil {
+			id, _ := strconv.Atoi(m[1])
+			parsed.entries = append(parsed.entries, sitrepEntry{id: id, text: line})
+		} else if m := sitrepOmittedRE.FindStringSubmatch(line); m != nil && len(parsed.entries) == 0 {
+			parsed.omitted, _ = strconv.Atoi(m[1])
+			parsed.omittedUpTo, _ = strconv.Atoi(m[2])
+		} else if len(parsed.entries) > 0 {
+			parsed.entries[len(parsed.entries)-1].text += "\n" + line
+		} else {
+			header = append(header, line)
+		}
+	}
+	parsed.header = strings.TrimSpace(strings.Join(header, "\n"))
+	for i := range parsed.entries {
+		parsed.entries[i].text = strings.TrimRight(parsed.entries[i].text, " \r\n")
+	}
+	return parsed
+}
+
+func (l sitrepLog) String() string {
+	lines := []string{sitrepLogStart}
+	if l.header != "" {
+		lines = append(lines, l.header, "")
+	}
+	if l.omitted > 0 {
+		lines = append(lines, fmt.Sprintf("[%d earlier entries omitted, up to #%d]",
+			l.omitted, l.omittedUpTo))
+	}
+	for _, entry := range l.entries {
+		lines = append(lines, entry.text)
+	}
+	return strings.Join(append(lines, sitrepLogEnd), "\n")
+}
+
+// Bring the log up to date with the latest activation. The header is replaced, entries for
+// sitreps which are already in the log are updated and new sitreps are added to the end.
+func (l sitrepLog) merge(latest sitrepLog) sitrepLog {
+	merged := l
+	merged.header = latest.header
+	merged.entries = append([]sitrepEntry{}, l.entries...)
+	for _, entry := range latest.entries {
+		found := false
+		for i, existing := range merged.entries {
+			if entry.id != 0 && existing.id == entry.id {
+				// Keep any lines which were added to the entry in the VMR desktop app
+				lines := strings.SplitN(existing.text, "\n", 2)
+				lines[0] = entry.text
+				merged.entries[i].text = strings.Join(lines, "\n")
+				found = true
+			} else if entry.id == 0 && strings.SplitN(existing.text, "\n", 2)[0] == entry.text {
+				found = true
+			}
+		}
+		if !found && (entry.id == 0 || entry.id > l.omittedUpTo) {
+			merged.entries = append(merged.entries, entry)
+		}
+	}
+	return merged
+}
+
+// Drop the oldest entries until the log is no longer than maxLen, and then the header if that
+// isn't enough. Returns false if the log still doesn't fit.
+func (l *sitrepLog) fit(maxLen int) bool {
+	for len(l.String()) > maxLen && len(l.entries) > 0 {
+		l.omitted++
+		if l.entries[0].id > l.omittedUpTo {
+			l.omittedUpTo = l.entries[0].id
+		}
+		l.entries = l.entries[1:]
+	}
+	if len(l.String()) > maxLen {
+		l.header = ""
+	}
+	return len(l.String()) <= maxLen
+}
+
+// Split comments into the text before the TripWatch log, the log itself and the text after it.
+func splitSitrepLog(comments string) (string, string, string, bool) {
+	start := strings.Index(comments, sitrepLogStart)
+	if start < 0 {
+		return comments, "", "", false
+	}
+	before, rest := comments[:start], comments[start+len(sitrepLogStart):]
+	if end := strings.Index(rest, sitrepLogEnd); end >= 0 {
+		return before, rest[:end], rest[end+len(sitrepLogEnd):], true
+	}
+	return before, rest, "", true
+}
+
+// Merge the latest TripWatch log into the comments currently in the DB, leaving any text
+// outside the log alone. Comments written by older versions, before the log had its own
+// section, are kept as they are too. If maxLen is set, old entries are dropped rather than the
+// comments being cut off, and the log is left out if the other text leaves no room for it.
+func mergeSitrepLog(current, latest string, maxLen int) string {
+	_, latestSection, _, _ := splitSitrepLog(latest)
+	before, section, after, _ := splitSitrepLog(current)
+	merged := parseSitrepLog(section).merge(parseSitrepLog(latestSection))
+	before, after = strings.TrimSpace(before), strings.TrimSpace(after)
+	section = merged.String()
+	if maxLen > 0 && !merged.fit(maxLen-len(before)-len(after)-2*len("\n\n")) {
+		log.Printf("Job comments added in the VMR app leave no room for the TripWatch log in %d "+
+			"characters, leaving the log out", maxLen)
+		section = ""
+	} else if maxLen > 0 {
+		section = merged.String()
+	}
+	parts := []string{}
+	for _, part := range []string{before, section, after} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSitrep(t *testing.T, id int, ts, comment string) Sitrep {
+	return Sitrep{
+		ID:        id,
+		Updated:   CustomJSONTime(getTime(t, ts)),
+		UpdatedBy: "radio@mrq.org.au",
+		Comment:   comment,
+	}
+}
+
+func TestSitrepLine(t *testing.T) {
+	sitrep := testSitrep(t, 214421, "2022-09-17T02:24:21Z", "RV has arrived\r\nat target ")
+	assert.Equal(t, "* 12:24 AEST #214421 radio@mrq.org.au: RV has arrived at target", sitrepLine(sitrep))
+	sitrep.Speed = 12.5
+	sitrep.Heading = 270
+	assert.Equal(t, "* 12:24 AEST #214421 radio@mrq.org.au: RV has arrived at target (12.5 kn, heading 270)",
+		sitrepLine(sitrep))
+}
+
+func TestMergeSitrepLog(t *testing.T) {
+	data := &linkActivationDB{
+		Job: Job{Comments: "Towed to the ramp"},
+		Sitreps: []Sitrep{
+			testSitrep(t, 101, "2022-09-17T02:24:00Z", "Underway"),
+			testSitrep(t, 102, "2022-09-17T02:30:00Z", "On scene"),
+		},
+	}
+	latest := newSitrepLog(data).String()
+	first := strings.Join([]string{
+		sitrepLogStart,
+		"Towed to the ramp",
+		"",
+		"* 12:24 AEST #101 radio@mrq.org.au: Underway",
+		"* 12:30 AEST #102 radio@mrq.org.au: On scene",
+		sitrepLogEnd,
+	}, "\n")
+	assert.Equal(t, first, latest)
+	assert.Equal(t, first, mergeSitrepLog("", latest, 0))
+
+	// Comments written by older versions are kept, including any lines added to them
+	legacy := "[Log entry maintained by TripWatch]\nTowed\n\n* 12:24 AEST: Underway\nOwner thanked crew"
+	assert.Equal(t, legacy+"\n\n"+first, mergeSitrepLog(legacy+"\n", latest, 0))
+	assert.Equal(t, legacy+"\n\n"+first, mergeSitrepLog(legacy+"\n\n"+first, latest, 0))
+	assert.Equal(t, "Skipper's notes\n\n"+first, mergeSitrepLog("Skipper's notes", latest, 0))
+
+	// Text added in the VMR app is left alone while new sitreps are added
+	current := "Called the owner\n\n" + strings.Replace(first, "Underway", "Underway\nSlow going", 1) +
+		"\nInvoice sent"
+	data.Job.Comments = "Towed to the ramp at Southport"
+	data.Sitreps[1].Comment = "On scene, towing"
+	data.Sitreps = append(data.Sitreps, testSitrep(t, 103, "2022-09-17T03:10:00Z", "Back at base"))
+	merged := mergeSitrepLog(current, newSitrepLog(data).String(), 0)
+	assert.Equal(t, strings.Join([]string{
+		"Called the owner",
+		"",
+		sitrepLogStart,
+		"Towed to the ramp at Southport",
+		"",
+		"* 12:24 AEST #101 radio@mrq.org.au: Underway",
+		"Slow going",
+		"* 12:30 AEST #102 radio@mrq.org.au: On scene, towing",
+		"* 13:10 AEST #103 radio@mrq.org.au: Back at base",
+		sitrepLogEnd,
+		"",
+		"Invoice sent",
+	}, "\n"), merged)
+	// Merging again changes nothing
+	assert.Equal(t, merged, mergeSitrepLog(merged, newSitrepLog(data).String(), 0))
+}
+
+func TestMergeSitrepLogOverflow(t *testing.T) {
+	data := &linkActivationDB{}
+	for i, comment := range []string{"Underway", "On scene", "Towing", "Back at base"} {
+		data.Sitreps = append(data.Sitreps, testSitrep(t, 101+i, "2022-09-17T02:24:00Z", comment))
+	}
+	merged := mergeSitrepLog("Notes", newSitrepLog(data).String(), 240)
+	assert.LessOrEqual(t, len(merged), 240)
+	assert.Equal(t, strings.Join([]string{
+		"Notes",
+		"",
+		sitrepLogStart,
+		"[2 earlier entries omitted, up to #102]",
+		"* 12:24 AEST #103 radio@mrq.org.au: Towing",
+		"* 12:24 AEST #104 radio@mrq.org.au: Back at base",
+		sitrepLogEnd,
+	}, "\n"), merged)
+
+	// Entries which were dropped aren't added again
+	assert.Equal(t, merged, mergeSitrepLog(merged, newSitrepLog(data).String(), 240))
+
+	// Text added in the VMR app is never cut, so the log is left out when there's no room for it
+	notes := strings.Repeat("Long notes. ", 18)
+	merged = mergeSitrepLog(notes, newSitrepLog(data).String(), 240)
+	assert.Equal(t, strings.TrimSpace(notes), merged)
+	assert.Equal(t, merged, mergeSitrepLog(merged, newSitrepLog(data).String(), 240))
+
+	// The header is dropped if the entries alone don't make enough room
+	data.Job.Comments = strings.Repeat("Towed. ", 20)
+	merged = mergeSitrepLog("Notes", newSitrepLog(data).String(), 180)
+	assert.LessOrEqual(t, len(merged), 180)
+	assert.NotContains(t, merged, "Towed.")
+	assert.Contains(t, merged, sitrepLogStart)
+}
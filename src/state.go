@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Directory holding the small YAML files used to persist sync state across restarts. This
+// defaults to the directory containing the config file (see parseConfig()).
+var stateDir string
+
+const checkpointFileName = ".vmrsync-checkpoint.yml"
+
+// Lock file guarding the state files which are both updated by the sync cycle and changed by
+// operator commands (the checkpoint, retry queue and review queue).
+const stateLockFileName = ".vmrsync-state.lock"
+
+var stateLocked = errors.Errorf("State files are locked by another vmrsync process")
+
+// How long a sync cycle waits for an operator command to release the state lock, and how long
+// a command waits for a sync cycle (which takes at most a minute) to finish.
+var (
+	cycleStateLockWait   = 10 * time.Second
+	commandStateLockWait = 90 * time.Second
+)
+
+// The checkpoint is the high-water mark of TripWatch activations which have been
+// successfully synchronised with Firebird.
+type checkpoint struct {
+	LastUpdated time.Time `yaml:"lastupdated"`
+	Saved       time.Time `yaml:"saved"`
+}
+
+func statePath(name string) string {
+	return filepath.Join(stateDir, name)
+}
+
+func readStateFile(name string, v interface{}) error {
+	if file, err := os.Open(statePath(name)); err != nil {
+		return errors.Wrapf(err, "read state file opening %s", name)
+	} else {
+		defer file.Close()
+		if err := yaml.NewDecoder(file).Decode(v); err != nil {
+			return errors.Wrapf(err, "read state file %s YAML unmarshalling", name)
+		}
+	}
+	return nil
+}
+
+// Write the state to a temporary file first and then move it into place, so that a crash
+// part-way through writing can never leave a corrupted state file behind.
+func writeStateFile(name string, v interface{}) error {
+	tmpName := statePath(name) + ".tmp"
+	if file, err := os.Create(tmpName); err != nil {
+		return errors.Wrapf(err, "write state file creating %s", tmpName)
+	} else if err := yaml.NewEncoder(file).Encode(v); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "write state file %s YAML marshalling", name)
+	} else if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "write state file %s closing", name)
+	} else if err := os.Rename(tmpName, statePath(name)); err != nil {
+		return errors.Wrapf(err, "write state file %s rename", name)
+	}
+	return nil
+}
+
+// Take the lock on the state files, waiting up to timeout for another process to release it.
+// The lock is held by the OS against the open file, so it's released even if the process holding
+// it crashes. The returned function releases the lock.
+func lockState(timeout time.Duration) (func(), error) {
+	file, err := os.OpenFile(statePath(stateLockFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lock state opening %s", stateLockFileName)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := lockFile(file); err == nil {
+			return func() {
+				unlockFile(file)
+				file.Close()
+			}, nil
+		} else if !errors.Is(err, stateLocked) || !time.Now().Before(deadline) {
+			file.Close()
+			return nil, errors.Wrapf(err, "lock state")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Load the checkpoint from disk. An error wrapping os.ErrNotExist is returned if no checkpoint
+// has been saved yet.
+func loadCheckpoint() (time.Time, error) {
+	cp := checkpoint{}
+	if err := readStateFile(checkpointFileName, &cp); err != nil {
+		return time.Time{}, errors.Wrapf(err, "load checkpoint")
+	} else if cp.LastUpdated.IsZero() {
+		return time.Time{}, errors.Errorf("load checkpoint has no lastupdated timestamp")
+	}
+	return cp.LastUpdated.UTC(), nil
+}
+
+func saveCheckpoint(ts time.Time) error {
+	if err := writeStateFile(checkpointFileName, checkpoint{
+		LastUpdated: ts.UTC(),
+		Saved:       now().UTC(),
+	}); err != nil {
+		return errors.Wrapf(err, "save checkpoint %s", ts)
+	}
+	return nil
+}
+
+// Restore lastUpdatedTS from the persisted checkpoint if one exists. If there is no
+// checkpoint the boot-time default is kept.
+func restoreCheckpoint() error {
+	if ts, err := loadCheckpoint(); err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "restore checkpoint")
+	} else {
+		lastUpdatedTS = ts
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	stateDir = t.TempDir()
+	defer func() { stateDir = "" }()
+
+	_, err := loadCheckpoint()
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// No checkpoint means the boot-time default is kept
+	bootTS := lastUpdatedTS
+	err = restoreCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, bootTS, lastUpdatedTS)
+
+	ts := getTimeFromAEST(t, "2023-01-02T03:04:05+10:00")
+	err = saveCheckpoint(ts)
+	assert.Nil(t, err)
+	loaded, err := loadCheckpoint()
+	assert.Nil(t, err)
+	assert.True(t, ts.Equal(loaded), "%s != %s", ts, loaded)
+
+	err = restoreCheckpoint()
+	assert.Nil(t, err)
+	assert.True(t, ts.Equal(lastUpdatedTS))
+	lastUpdatedTS = bootTS
+}
+
+func TestCheckpointCommand(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := dir + "/config.yml"
+	err := os.WriteFile(cfgFile, []byte("tripwatch:\n  poll: \"60s\"\n"), 0600)
+	assert.Nil(t, err)
+	oldPath := configFilePath
+	configFilePath = cfgFile
+	defer func() {
+		configFilePath = oldPath
+		stateDir = ""
+	}()
+
+	err = runCommand([]string{"checkpoint", "-rewind", "1h"})
+	assert.NotNil(t, err)
+
+	err = runCommand([]string{"checkpoint", "-set", "2023-01-02T03:00:00Z"})
+	assert.Nil(t, err)
+	assert.Equal(t, dir, stateDir)
+	ts, err := loadCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, getTime(t, "2023-01-02T03:00:00Z"), ts)
+
+	err = runCommand([]string{"checkpoint", "-rewind", "2h"})
+	assert.Nil(t, err)
+	ts, err = loadCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, getTime(t, "2023-01-02T01:00:00Z"), ts)
+
+	err = runCommand([]string{"no-such-command"})
+	assert.NotNil(t, err)
+}
+
+// A checkpoint rewound by the checkpoint command while the service is running is used by the
+// next cycle rather than being overwritten.
+func TestRunPicksUpRewoundCheckpoint(t *testing.T) {
+	fetched := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/activations/recent" {
+			fmt.Fprint(w, `[{"id":86239,"updated_at":"2023-01-02T00:30:00.000000Z"}]`)
+			return
+		} else if r.URL.Path == "/activations/86239" {
+			fetched++
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	cfgFile := dir + "/config.yml"
+	err := os.WriteFile(cfgFile, []byte(fmt.Sprintf(
+		"tripwatch:\n  url: \"%s\"\n  poll: \"60s\"\n", srv.URL)), 0600)
+	assert.Nil(t, err)
+	oldPath, bootTS := configFilePath, lastUpdatedTS
+	configFilePath = cfgFile
+	defer func() {
+		configFilePath = oldPath
+		lastUpdatedTS = bootTS
+		stateDir = ""
+		tripwatchURL = ""
+		setNow(time.Time{})
+	}()
+	assert.Nil(t, parseConfig(cfgFile))
+
+	setNow(getTime(t, "2023-01-02T03:00:00Z"))
+	lastUpdatedTS = getTime(t, "2023-01-02T02:00:00Z")
+	assert.Empty(t, run(nil))
+	assert.Equal(t, 0, fetched)
+
+	err = runCommand([]string{"checkpoint", "-rewind", "3h"})
+	assert.Nil(t, err)
+	setNow(getTime(t, "2023-01-02T03:01:00Z"))
+	assert.NotEmpty(t, run(nil))
+	assert.Equal(t, 1, fetched)
+	assert.Equal(t, getTime(t, "2023-01-02T00:00:00Z"), lastUpdatedTS)
+}
+
+func TestLockState(t *testing.T) {
+	stateDir = t.TempDir()
+	defer func() { stateDir = "" }()
+
+	unlock, err := lockState(0)
+	assert.Nil(t, err)
+	_, err = lockState(200 * time.Millisecond)
+	assert.True(t, errors.Is(err, stateLocked), "%v", err)
+
+	// The lock can be taken once it's released, including while waiting for it
+	go func(unlockFirst func()) {
+		time.Sleep(100 * time.Millisecond)
+		unlockFirst()
+	}(unlock)
+	unlock2, err := lockState(time.Second)
+	if assert.Nil(t, err) {
+		unlock2()
+	}
+}
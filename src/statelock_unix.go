@@ -0,0 +1,29 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Take an exclusive lock on the file without waiting. stateLocked is returned if another
+// process holds the lock.
+func lockFile(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return stateLocked
+		}
+		return errors.Wrapf(err, "lock file %s", file.Name())
+	}
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		return errors.Wrapf(err, "unlock file %s", file.Name())
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// Take an exclusive lock on the file without waiting. stateLocked is returned if another
+// process holds the lock.
+func lockFile(file *os.File) error {
+	ol := new(windows.Overlapped)
+	if err := windows.LockFileEx(windows.Handle(file.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0, 1, 0, ol); err != nil {
+		if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+			return stateLocked
+		}
+		return errors.Wrapf(err, "lock file %s", file.Name())
+	}
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	ol := new(windows.Overlapped)
+	if err := windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, ol); err != nil {
+		return errors.Wrapf(err, "unlock file %s", file.Name())
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultStatusListen = "127.0.0.1:8765"
+	// The number of recent sync errors (and warnings) shown on the status page
+	statusErrorHistory = 20
+	// Time allowed for each /healthz check
+	healthCheckTimeout = 5 * time.Second
+)
+
+// Address the status server listens on. The server is disabled if this is empty.
+var statusListen string
+
+// A sync error from a recent cycle, with the activation it was for if known.
+type cycleError struct {
+	Time       time.Time `json:"time"`
+	Activation int       `json:"activation,omitempty"`
+	Error      string    `json:"error"`
+}
+
+// A problem with an activation's data from a recent cycle which didn't stop it being synced (see
+// linkActivationDB.warn()).
+type cycleWarning struct {
+	Time       time.Time `json:"time"`
+	Activation int       `json:"activation"`
+	Warning    string    `json:"warning"`
+}
+
+// List the warnings recorded for an activation during a cycle.
+func activationWarnings(activation *linkActivationDB) []cycleWarning {
+	warnings := make([]cycleWarning, 0, len(activation.warnings))
+	for _, w := range activation.warnings {
+		warnings = append(warnings, cycleWarning{Activation: activation.ID, Warning: w})
+	}
+	return warnings
+}
+
+// Summarise a sync cycle for the log. Warnings are listed so that they're reported for every
+// cycle, not only in the dry run report. Nothing is reported for a cycle with nothing to sync.
+func cycleReport(synced int, errlist []error, warnings []cycleWarning) string {
+	if synced == 0 && len(errlist) == 0 && len(warnings) == 0 {
+		return ""
+	}
+	report := strings.Builder{}
+	report.WriteString(fmt.Sprintf("Sync cycle: %d activations synced, %d errors, %d warnings\n",
+		synced, len(errlist), len(warnings)))
+	for _, w := range warnings {
+		report.WriteString(fmt.Sprintf("  Warning for activation %d: %s\n", w.Activation, w.Warning))
+	}
+	return report.String()
+}
+
+// Progress of the sync loop, shared with the status server.
+type syncStatus struct {
+	mu            sync.Mutex
+	db            *sql.DB
+	started       time.Time
+	lastCycle     time.Time
+	lastSuccess   time.Time // The last cycle with no errors
+	lastUpdatedTS time.Time
+	cycles        int
+	synced        int // Activations written since the service started
+	lastSynced    int // Activations written in the last cycle
+	errors        []cycleError
+	warnings      []cycleWarning
+}
+
+var serviceStatus = &syncStatus{started: now().UTC()}
+
+// The status of the sync loop as reported by /status.
+type statusReport struct {
+	Version       string         `json:"version"`
+	Started       time.Time      `json:"started"`
+	LastCycle     time.Time      `json:"last_cycle"`
+	LastSuccess   time.Time      `json:"last_success"`
+	LastUpdatedTS time.Time      `json:"last_updated_ts"`
+	Cycles        int            `json:"cycles"`
+	Synced        int            `json:"activations_synced"`
+	LastSynced    int            `json:"activations_synced_last_cycle"`
+	Errors        []cycleError   `json:"recent_errors"`
+	Warnings      []cycleWarning `json:"recent_warnings"`
+}
+
+// Record the DB connection used by the sync loop. This is called from the sync loop once it has
+// restored its checkpoint, so lastUpdatedTS is also picked up here.
+func (s *syncStatus) connected(db *sql.DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db = db
+	s.lastUpdatedTS = lastUpdatedTS
+}
+
+// Record the outcome of a sync cycle (see run()).
+func (s *syncStatus) recordCycle(cycleTS time.Time, synced int, errlist []error, warnings []cycleWarning) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCycle = cycleTS
+	s.lastUpdatedTS = lastUpdatedTS
+	s.cycles++
+	s.synced += synced
+	s.lastSynced = synced
+	if len(errlist) == 0 {
+		s.lastSuccess = cycleTS
+	}
+	for _, err := range errlist {
+		ce := cycleError{Time: cycleTS, Error: err.Error()}
+		var runerr runError
+		if errors.As(err, &runerr) && runerr.activation != nil {
+			ce.Activation = runerr.activation.ID
+		}
+		s.errors = append(s.errors, ce)
+	}
+	if len(s.errors) > statusErrorHistory {
+		s.errors = s.errors[len(s.errors)-statusErrorHistory:]
+	}
+	for _, w := range warnings {
+		w.Time = cycleTS
+		s.warnings = append(s.warnings, w)
+	}
+	if len(s.warnings) > statusErrorHistory {
+		s.warnings = s.warnings[len(s.warnings)-statusErrorHistory:]
+	}
+}
+
+func (s *syncStatus) report() statusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]cycleError, len(s.errors))
+	// Most recent first
+	for i, ce := range s.errors {
+		errs[len(errs)-1-i] = ce
+	}
+	warnings := make([]cycleWarning, len(s.warnings))
+	for i, w := range s.warnings {
+		warnings[len(warnings)-1-i] = w
+	}
+	return statusReport{
+		Version:       Version,
+		Started:       s.started,
+		LastCycle:     s.lastCycle,
+		LastSuccess:   s.lastSuccess,
+		LastUpdatedTS: s.lastUpdatedTS,
+		Cycles:        s.cycles,
+		Synced:        s.synced,
+		LastSynced:    s.lastSynced,
+		Errors:        errs,
+		Warnings:      warnings,
+	}
+}
+
+func (s *syncStatus) checkDB(ctx context.Context) error {
+	s.mu.Lock()
+	db := s.db
+	s.mu.Unlock()
+	if db == nil {
+		return errors.Errorf("not connected")
+	} else if err := db.PingContext(ctx); err != nil {
+		return errors.Wrapf(err, "ping")
+	}
+	return nil
+}
+
+// TripWatch is reachable if it answers at all, other than with a server error. No API call is
+// made, so the check doesn't use up the rate limit.
+func checkTripWatch(ctx context.Context) error {
+	if tripwatchURL == "" {
+		return errors.Errorf("no TripWatch URL configured")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, tripwatchURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "new request")
+	}
+	resp, err := (&http.Client{Transport: tripwatchTransport}).Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ts": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.In(time.FixedZone("UTC+10", 10*60*60)).Format("2006-01-02 15:04:05") + " AEST"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>VMRSync</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+.error { color: #a00; }
+</style>
+</head>
+<body>
+<h1>VMRSync {{.Version}}</h1>
+<table>
+<tr><th>Started</th><td>{{ts .Started}}</td></tr>
+<tr><th>Last cycle</th><td>{{ts .LastCycle}}</td></tr>
+<tr><th>Last successful cycle</th><td>{{ts .LastSuccess}}</td></tr>
+<tr><th>Synced up to</th><td>{{ts .LastUpdatedTS}}</td></tr>
+<tr><th>Cycles</th><td>{{.Cycles}}</td></tr>
+<tr><th>Activations synced</th><td>{{.Synced}} ({{.LastSynced}} in the last cycle)</td></tr>
+</table>
+<h2>Recent errors</h2>
+{{if .Errors}}<table>
+<tr><th>Time</th><th>Activation</th><th>Error</th></tr>
+{{range .Errors}}<tr><td>{{ts .Time}}</td><td>{{if .Activation}}{{.Activation}}{{end}}</td><td class="error">{{.Error}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+<h2>Recent warnings</h2>
+{{if .Warnings}}<table>
+<tr><th>Time</th><th>Activation</th><th>Warning</th></tr>
+{{range .Warnings}}<tr><td>{{ts .Time}}</td><td>{{.Activation}}</td><td>{{.Warning}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+<p><a href="status">status</a> | <a href="healthz">healthz</a> | <a href="metrics">metrics</a></p>
+</body>
+</html>
+`))
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Status server writing response: %v", err)
+	}
+}
+
+// The status server's routes: /healthz, /status, /metrics and the dashboard at /.
+func newStatusHandler(s *syncStatus) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+		code := http.StatusOK
+		health := struct {
+			Status string            `json:"status"`
+			Checks map[string]string `json:"checks"`
+		}{Status: "ok", Checks: map[string]string{}}
+		for name, check := range map[string]func(context.Context) error{
+			"db":        s.checkDB,
+			"tripwatch": checkTripWatch,
+		} {
+			if err := check(ctx); err != nil {
+				health.Checks[name] = err.Error()
+				health.Status = "unhealthy"
+				code = http.StatusServiceUnavailable
+			} else {
+				health.Checks[name] = "ok"
+			}
+		}
+		writeJSON(w, code, health)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.report())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := writeMetrics(w, s); err != nil {
+			log.Printf("Status server writing metrics: %v", err)
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, s.report()); err != nil {
+			log.Printf("Status server writing dashboard: %v", err)
+		}
+	})
+	return mux
+}
+
+// Start the status server in the background if it is enabled. Only a failure to listen is
+// returned.
+func startStatusServer() error {
+	if statusListen == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", statusListen)
+	if err != nil {
+		return errors.Wrapf(err, "status server listening on %s", statusListen)
+	}
+	server := &http.Server{
+		Handler:           newStatusHandler(serviceStatus),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Status server stopped: %v", err)
+		}
+	}()
+	return nil
+}
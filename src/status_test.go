@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordCycle(t *testing.T) {
+	s := &syncStatus{}
+	first := time.Date(2022, 1, 7, 22, 0, 0, 0, time.UTC)
+	s.recordCycle(first, 3, nil, nil)
+	second := first.Add(time.Minute)
+	s.recordCycle(second, 1, []error{
+		runError{error: errors.Errorf("DB update"), activation: &linkActivationDB{ID: 1234}},
+		errors.Wrapf(runError{error: errors.Errorf("DB update"), activation: &linkActivationDB{ID: 99}},
+			"Retry"),
+		errors.Errorf("List TripWatch activations"),
+	}, []cycleWarning{{Activation: 1234, Warning: "no usable position"}})
+
+	report := s.report()
+	assert.Equal(t, second, report.LastCycle)
+	assert.Equal(t, first, report.LastSuccess)
+	assert.Equal(t, 2, report.Cycles)
+	assert.Equal(t, 4, report.Synced)
+	assert.Equal(t, 1, report.LastSynced)
+	if assert.Len(t, report.Errors, 3) {
+		// Most recent first
+		assert.Equal(t, 0, report.Errors[0].Activation)
+		assert.Equal(t, 99, report.Errors[1].Activation)
+		assert.Equal(t, 1234, report.Errors[2].Activation)
+		assert.Equal(t, second, report.Errors[2].Time)
+	}
+	assert.Equal(t, []cycleWarning{{Time: second, Activation: 1234, Warning: "no usable position"}},
+		report.Warnings)
+
+	// Only the most recent errors are kept
+	for i := 0; i < statusErrorHistory; i++ {
+		s.recordCycle(second, 0, []error{errors.Errorf("error %d", i)}, nil)
+	}
+	report = s.report()
+	assert.Len(t, report.Errors, statusErrorHistory)
+	assert.Equal(t, "error 19", report.Errors[0].Error)
+	assert.Equal(t, "error 0", report.Errors[statusErrorHistory-1].Error)
+}
+
+func TestCycleReport(t *testing.T) {
+	assert.Equal(t, "", cycleReport(0, nil, nil))
+
+	activation := &linkActivationDB{ID: 86239}
+	activation.warn("ignoring sitrep 1: position -27,153 looks like a placeholder")
+	activation.warn("no usable position, latitude and longitude not set")
+	report := cycleReport(2, []error{errors.Errorf("DB update")}, activationWarnings(activation))
+	assert.Equal(t, "Sync cycle: 2 activations synced, 1 errors, 2 warnings\n"+
+		"  Warning for activation 86239: ignoring sitrep 1: position -27,153 looks like a placeholder\n"+
+		"  Warning for activation 86239: no usable position, latitude and longitude not set\n", report)
+}
+
+func TestStatusHandler(t *testing.T) {
+	s := &syncStatus{}
+	s.recordCycle(time.Date(2022, 1, 7, 22, 0, 0, 0, time.UTC), 0, []error{
+		runError{error: errors.Errorf("bad <vessel>"), activation: &linkActivationDB{ID: 1234}},
+	}, []cycleWarning{{Activation: 4321, Warning: "latitude and longitude of sitrep 3 were swapped"}})
+	handler := newStatusHandler(s)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	report := statusReport{}
+	if assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &report)) {
+		assert.Equal(t, 1, report.Cycles)
+		if assert.Len(t, report.Errors, 1) {
+			assert.Equal(t, 1234, report.Errors[0].Activation)
+		}
+		if assert.Len(t, report.Warnings, 1) {
+			assert.Equal(t, 4321, report.Warnings[0].Activation)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "2022-01-08 08:00:00 AEST")
+	assert.Contains(t, rec.Body.String(), "<td>1234</td>")
+	assert.Contains(t, rec.Body.String(), "bad &lt;vessel&gt;")
+	assert.Contains(t, rec.Body.String(),
+		"<td>4321</td><td>latitude and longitude of sitrep 3 were swapped</td>")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHealthz(t *testing.T) {
+	tripwatchStatus := http.StatusUnauthorized
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(tripwatchStatus)
+	}))
+	defer srv.Close()
+	tripwatchURL = srv.URL
+	defer func() { tripwatchURL = "" }()
+	handler := newStatusHandler(&syncStatus{})
+	health := func() (int, map[string]string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		body := struct {
+			Checks map[string]string `json:"checks"`
+		}{}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body.Checks
+	}
+
+	// TripWatch answers, but there is no DB connection yet
+	code, checks := health()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]string{"db": "not connected", "tripwatch": "ok"}, checks)
+
+	tripwatchStatus = http.StatusBadGateway
+	_, checks = health()
+	assert.Equal(t, "status code 502", checks["tripwatch"])
+}
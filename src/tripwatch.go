@@ -5,8 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -20,22 +20,9 @@ var (
 	twNotFound = errors.Errorf("TripWatch item not found")
 )
 
+// Make a TripWatch API call using the shared client.
 func tripwatchCall(ctx context.Context, method, url, body string) (*http.Response, error) {
-	if req, err := http.NewRequestWithContext(ctx,
-		method, tripwatchURL+url, strings.NewReader(body),
-	); err != nil {
-		return &http.Response{}, errors.Wrapf(err, "tripwatch call new request")
-	} else {
-		req.Header.Add("Authorization", "Bearer "+tripwatchAPIkey)
-		c := http.Client{}
-		if resp, err := c.Do(req); err != nil {
-			return &http.Response{}, errors.Wrapf(err, "tripwatch call execute")
-		} else if resp.StatusCode == 404 {
-			return &http.Response{}, errors.Wrapf(twNotFound, "tripwatch call")
-		} else {
-			return resp, nil
-		}
-	}
+	return twClient.call(ctx, method, url, body)
 }
 
 func listActivations(ctx context.Context, lastUpdatedTS time.Time) ([]linkActivationDB, error) {
@@ -72,6 +59,35 @@ func listActivations(ctx context.Context, lastUpdatedTS time.Time) ([]linkActiva
 	}
 }
 
+// Summary of an activation as returned in TripWatch activation listings.
+type activationSummary struct {
+	ID      int            `json:"id"`
+	Created CustomJSONTime `json:"created_at"`
+	Updated CustomJSONTime `json:"updated_at"`
+}
+
+// Fetch one page of the full TripWatch activation history. The history is paginated in the
+// standard Laravel format, and the page count is returned alongside the page's activations.
+func listActivationPage(ctx context.Context, page int) ([]activationSummary, int, error) {
+	history := struct {
+		Data     []activationSummary `json:"data"`
+		LastPage int                 `json:"last_page"`
+	}{}
+	if resp, err := tripwatchCall(ctx, http.MethodGet,
+		fmt.Sprintf("/activations?page=%d", page), ""); err != nil {
+		return []activationSummary{}, 0, errors.Wrapf(err, "list activation page %d call", page)
+	} else if body, err := ioutil.ReadAll(resp.Body); err != nil {
+		return []activationSummary{}, 0, errors.Wrapf(err, "list activation page %d body read", page)
+	} else if resp.StatusCode != http.StatusOK {
+		return []activationSummary{}, 0,
+			errors.Errorf("list activation page %d invalid status code %d", page, resp.StatusCode)
+	} else if err := json.Unmarshal(body, &history); err != nil {
+		return []activationSummary{}, 0, errors.Wrapf(err, "list activation page %d body parse", page)
+	} else {
+		return history.Data, history.LastPage, nil
+	}
+}
+
 func getOneActivation(ctx context.Context, id int) (linkActivationDB, error) {
 	activation := linkActivationDB{}
 	if resp, err := tripwatchCall(ctx, http.MethodGet, fmt.Sprintf("/activations/%d", id), ""); err != nil {
@@ -82,8 +98,12 @@ func getOneActivation(ctx context.Context, id int) (linkActivationDB, error) {
 		return linkActivationDB{}, errors.Wrapf(err, "get one activation body parse for ID %d '%s'", id, body)
 	} else if sitreps, err := getSitrepsForActivation(ctx, id); err != nil {
 		return linkActivationDB{}, errors.Wrapf(err, "list sitreps for activation %d", id)
+	} else if risks, err := getRisksForActivation(ctx, id); err != nil {
+		return linkActivationDB{}, errors.Wrapf(err, "list risks for activation %d", id)
 	} else {
 		activation.Sitreps = sitreps
+		activation.Risks = risks
+		activation.raw = body
 		return activation, nil
 	}
 }
@@ -100,3 +120,21 @@ func getSitrepsForActivation(ctx context.Context, id int) ([]Sitrep, error) {
 		return sitreps, nil
 	}
 }
+
+func getRisksForActivation(ctx context.Context, id int) ([]Risk, error) {
+	var risks []Risk
+	if resp, err := tripwatchCall(ctx, http.MethodGet, fmt.Sprintf("/activationrisks/%d", id), ""); err != nil &&
+		errors.Is(err, twNotFound) {
+		// Activations without a risk assessment have no risks entry
+		log.Printf("No risks found for activation %d", id)
+		return []Risk{}, nil
+	} else if err != nil {
+		return []Risk{}, errors.Wrapf(err, "list risks call for ID %d", id)
+	} else if body, err := ioutil.ReadAll(resp.Body); err != nil {
+		return []Risk{}, errors.Wrapf(err, "list risks body read for ID %d", id)
+	} else if err := json.Unmarshal([]byte(body), &risks); err != nil {
+		return []Risk{}, errors.Wrapf(err, "list risks body parse for ID %d '%s'", id, body)
+	} else {
+		return risks, nil
+	}
+}
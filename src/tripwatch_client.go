@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Minimum interval between TripWatch API calls. Zero (the default) means calls are only paced
+// when the rate limit is running low.
+var tripwatchCallInterval time.Duration
+
+// TripWatch rate limits are applied per minute.
+const tripwatchRateWindow = time.Minute
+
+// All TripWatch calls share one transport so that connections are reused between calls.
+var tripwatchTransport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConnsPerHost: 4,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+var twClient = newTripwatchClient(tripwatchTransport)
+
+// HTTP client for the TripWatch API. It tracks the rate limit reported by the API and spaces
+// out calls before the limit is reached, and retries GET requests which fail with a network
+// error, a 429 or a 5xx status.
+type tripwatchClient struct {
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration // Delay before the first retry, doubled on each further retry
+	maxBackoff  time.Duration
+
+	mu           sync.Mutex
+	lastCall     time.Time
+	limit        int       // Calls allowed per rate window, or 0 if unknown
+	remaining    int       // Calls remaining in the current rate window
+	blockedUntil time.Time // No calls are made before this time
+}
+
+func newTripwatchClient(transport http.RoundTripper) *tripwatchClient {
+	return &tripwatchClient{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+		maxAttempts: 4,
+		backoff:     time.Second,
+		maxBackoff:  30 * time.Second,
+	}
+}
+
+// Wait until the next call can be made without going over the rate limit.
+func (c *tripwatchClient) pace(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	interval := tripwatchCallInterval
+	if c.limit > 0 && c.remaining < c.limit/4 {
+		// Running low, so spread the remaining calls out at the sustainable rate.
+		if spread := tripwatchRateWindow / time.Duration(c.limit); spread > interval {
+			interval = spread
+		}
+	}
+	next := c.lastCall.Add(interval)
+	if c.blockedUntil.After(next) {
+		next = c.blockedUntil
+	}
+	if wait := time.Until(next); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "pace tripwatch call")
+		}
+	}
+	c.lastCall = time.Now()
+	return nil
+}
+
+// Record the rate limit state reported in a response.
+func (c *tripwatchClient) observe(resp *http.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit")); err == nil {
+		c.limit = limit
+		tripwatchRateLimit.set(float64(limit))
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		c.remaining = remaining
+		tripwatchRateRemaining.set(float64(remaining))
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.remaining = 0
+	}
+	after := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(after); err == nil {
+		c.blockedUntil = time.Now().Add(time.Duration(secs) * time.Second)
+	} else if ts, err := http.ParseTime(after); err == nil {
+		c.blockedUntil = ts
+	} else if c.limit > 0 && c.remaining <= 0 {
+		// No calls left and no indication of when the window resets, so wait a full window.
+		c.blockedUntil = time.Now().Add(tripwatchRateWindow)
+	}
+}
+
+// Delay before retrying after the given number of failed attempts. Full jitter is applied to
+// the upper half of the delay so that retries from several callers don't line up.
+func (c *tripwatchClient) retryDelay(attempt int) time.Duration {
+	delay := c.backoff
+	for i := 1; i < attempt && delay < c.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.maxBackoff {
+		delay = c.maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (c *tripwatchClient) call(ctx context.Context, method, url, body string) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if err := c.pace(ctx); err != nil {
+			return &http.Response{}, errors.Wrapf(err, "tripwatch call")
+		}
+		req, err := http.NewRequestWithContext(ctx, method, tripwatchURL+url, strings.NewReader(body))
+		if err != nil {
+			return &http.Response{}, errors.Wrapf(err, "tripwatch call new request")
+		}
+		req.Header.Add("Authorization", "Bearer "+tripwatchAPIkey)
+		start := time.Now()
+		resp, err := c.client.Do(req)
+		countTripwatchCall(url, resp, err, time.Since(start))
+		if err == nil {
+			c.observe(resp)
+		}
+		// Only GET requests are safe to repeat
+		retry := method == http.MethodGet && attempt < c.maxAttempts && ctx.Err() == nil &&
+			(err != nil || resp.StatusCode == http.StatusTooManyRequests ||
+				resp.StatusCode >= http.StatusInternalServerError)
+		if !retry {
+			if err != nil {
+				return &http.Response{}, errors.Wrapf(err, "tripwatch call execute")
+			} else if resp.StatusCode == http.StatusNotFound {
+				resp.Body.Close()
+				return &http.Response{}, errors.Wrapf(twNotFound, "tripwatch call")
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(c.retryDelay(attempt)):
+		case <-ctx.Done():
+			return &http.Response{}, errors.Wrapf(ctx.Err(), "tripwatch call retry %d", attempt)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaceTripwatchCall(t *testing.T) {
+	c := newTripwatchClient(tripwatchTransport)
+	tripwatchCallInterval = 50 * time.Millisecond
+	defer func() { tripwatchCallInterval = 0 }()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, c.pace(context.Background()))
+	}
+	assert.LessOrEqual(t, int64(100*time.Millisecond), int64(time.Since(start)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, c.pace(ctx))
+}
+
+func TestTripwatchClientRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "60")
+		w.Header().Set("X-RateLimit-Remaining", "50")
+		switch n := atomic.AddInt32(&calls, 1); {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case n == 1:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			fmt.Fprint(w, "[]")
+		}
+	}))
+	defer srv.Close()
+	tripwatchURL = srv.URL
+	defer func() { tripwatchURL = "" }()
+	c := newTripwatchClient(tripwatchTransport)
+	c.backoff = time.Millisecond
+
+	// The first call fails with a 502 and is retried
+	resp, err := c.call(context.Background(), http.MethodGet, "/activations/recent", "")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, 60, c.limit)
+	assert.Equal(t, 50, c.remaining)
+
+	// Not found isn't retried
+	_, err = c.call(context.Background(), http.MethodGet, "/missing", "")
+	assert.ErrorIs(t, err, twNotFound)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Only GETs are retried
+	atomic.StoreInt32(&calls, 0)
+	resp, err = c.call(context.Background(), http.MethodPost, "/activations/recent", "{}")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestTripwatchClientRateLimit(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "600")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		// Running low, so calls are spread out to one every 100ms
+		w.Header().Set("X-RateLimit-Remaining", "10")
+		fmt.Fprint(w, "[]")
+	}))
+	defer srv.Close()
+	tripwatchURL = srv.URL
+	defer func() { tripwatchURL = "" }()
+	c := newTripwatchClient(tripwatchTransport)
+	c.backoff = time.Millisecond
+
+	start := time.Now()
+	resp, err := c.call(context.Background(), http.MethodGet, "/activations/recent", "")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.LessOrEqual(t, int64(time.Second), int64(time.Since(start)))
+
+	// Measured between the times the calls were made, as the first call's request time has
+	// already been spent waiting for the second
+	first := c.lastCall
+	resp, err = c.call(context.Background(), http.MethodGet, "/activations/recent", "")
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+	}
+	assert.LessOrEqual(t, int64(100*time.Millisecond), int64(c.lastCall.Sub(first)))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestTripwatchRetryDelay(t *testing.T) {
+	c := newTripwatchClient(tripwatchTransport)
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		delay := c.retryDelay(attempt + 1)
+		assert.LessOrEqual(t, int64(max/2), int64(delay))
+		assert.LessOrEqual(t, int64(delay), int64(max))
+	}
+	assert.LessOrEqual(t, int64(c.retryDelay(20)), int64(c.maxBackoff))
+}
+
+func TestGetActivationWithoutRisks(t *testing.T) {
+	// Activations without a risk assessment return a 404 for their risks, which isn't an error
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/activations/42":
+			fmt.Fprint(w, `{"id":42,"activationsstatus":"Completed"}`)
+		case "/activationtransactions/42":
+			fmt.Fprint(w, "[]")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	tripwatchURL = srv.URL
+	defer func() { tripwatchURL = "" }()
+
+	activation, err := getOneActivation(context.Background(), 42)
+	assert.Nil(t, err)
+	assert.Equal(t, 42, activation.ID)
+	assert.Empty(t, activation.Risks)
+
+	// A missing activation is still an error
+	_, err = getOneActivation(context.Background(), 43)
+	assert.ErrorIs(t, err, twNotFound)
+}
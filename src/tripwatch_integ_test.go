@@ -75,15 +75,18 @@ func TestIntegTripwatchGetOneActivation(t *testing.T) {
 	assert.Equal(t, 153.15326141723338, a.Job.FirebirdGPS.Long)
 
 	// Test comment field aggregation
-	assert.True(t, strings.HasPrefix(a.Job.Comments, "[Log entry maintained by TripWatch]\n"))
+	assert.True(t, strings.HasPrefix(a.Job.Comments, sitrepLogStart+"\n"))
 	assert.Contains(t, a.Job.Comments, "Trial of getting sick person from place.\r\nNo incidents.\n")
-	assert.Contains(t, a.Job.Comments, "* 12:24 AEST: RV has arrived at target ->"+
+	assert.Contains(t, a.Job.Comments, "* 12:24 AEST #214421 marvin.the.martian@mrq.org.au: "+
+		"RV has arrived at target ->"+
 		" [DM.m Latitude: -27˚ 28.527485060091'S,  Longitude: 153˚ 9.1956850340028'E]"+
 		"  [DMS Latitude: -27˚ 28' 31.64910360546S,  Longitude: 153˚ 9' 11.741102040168E]\n")
-	assert.Contains(t, a.Job.Comments, "* 12:26 AEST: RV current location is ->"+
+	assert.Contains(t, a.Job.Comments, "* 12:26 AEST #214422 marvin.the.martian@mrq.org.au: "+
+		"RV current location is ->"+
 		" [DM.m Latitude: -27˚ 28.522014240232'S,  Longitude: 153˚ 9.1876644585792'E]"+
 		"  [DMS Latitude: -27˚ 28' 31.32085441392S,  Longitude: 153˚ 9' 11.259867514752E]\n")
-	assert.Contains(t, a.Job.Comments, "* 12:26 AEST: Target vessel in tow, current location is ->"+
+	assert.Contains(t, a.Job.Comments, "* 12:26 AEST #214423 marvin.the.martian@mrq.org.au: "+
+		"Target vessel in tow, current location is ->"+
 		" [DM.m Latitude: -27˚ 28.522015720508'S,  Longitude: 153˚ 9.187660493055'E]"+
 		"  [DMS Latitude: -27˚ 28' 31.32094323048S,  Longitude: 153˚ 9' 11.2596295833E]\n")
 }
@@ -20,6 +20,10 @@ func runLoop() {
 		defer closefunc()
 		db = fdb
 	}
+	serviceStatus.connected(db)
+	if err := startStatusServer(); err != nil {
+		log.Fatalf("Cannot start status server: %v", err)
+	}
 
 	for {
 		if errlist := run(db); len(errlist) > 0 {
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const vesselUseTableName = "VMRSYNC_VESSELUSE"
+
+// Engine hours and fuel reported by each activation. DUTYVESSELS holds the totals for a duty,
+// which are rebuilt from this table after every sync so that several jobs on the same duty roll
+// forward, and re-syncing a job never counts it twice. DUTYVESSELS has no columns for a third
+// engine, so those hours are only kept here.
+const vesselUseTableDDL = "CREATE TABLE " + vesselUseTableName + " (" +
+	"TRIPWATCH_ID INTEGER NOT NULL PRIMARY KEY," +
+	"DUTYSEQUENCE INTEGER NOT NULL," +
+	"DUTYVESSELNO INTEGER NOT NULL," +
+	"STARTHOURSPORT DOUBLE PRECISION," +
+	"ENDHOURSPORT DOUBLE PRECISION," +
+	"STARTHOURSSTAR DOUBLE PRECISION," +
+	"ENDHOURSSTAR DOUBLE PRECISION," +
+	"STARTHOURS3 DOUBLE PRECISION," +
+	"ENDHOURS3 DOUBLE PRECISION," +
+	"FUELUSED DOUBLE PRECISION)"
+
+// Set once the vessel use table is known to exist (see prepareServiceTables()).
+var vesselUseTableReady bool
+
+type vesselUse struct {
+	TripWatchID    int     `firebird:"TRIPWATCH_ID,match"`
+	DutyLogID      int     `firebird:"DUTYSEQUENCE"`
+	VesselID       int     `firebird:"DUTYVESSELNO"`
+	StartHoursPort float64 `firebird:"STARTHOURSPORT"`
+	EndHoursPort   float64 `firebird:"ENDHOURSPORT"`
+	StartHoursStbd float64 `firebird:"STARTHOURSSTAR"`
+	EndHoursStbd   float64 `firebird:"ENDHOURSSTAR"`
+	StartHours3    float64 `firebird:"STARTHOURS3"`
+	EndHours3      float64 `firebird:"ENDHOURS3"`
+	FuelUsed       float64 `firebird:"FUELUSED"`
+}
+
+// Totals for a vessel across all jobs in a duty, as written to DUTYVESSELS. DUTYENGINES is
+// left to the VMR desktop app, as engines without hours recorded yet can't be counted.
+type dutyVessel struct {
+	DutyLogID      int     `firebird:"DUTYSEQUENCE,match"`
+	VesselID       int     `firebird:"DUTYVESSELNO,match"`
+	VesselName     string  `firebird:"DUTYVESSELNAME" len:"30"`
+	StartHoursPort float64 `firebird:"STARTHOURSPORT"`
+	EndHoursPort   float64 `firebird:"ENDHOURSPORT"`
+	StartHoursStbd float64 `firebird:"STARTHOURSSTAR"`
+	EndHoursStbd   float64 `firebird:"ENDHOURSSTAR"`
+	FuelUsed       float64 `firebird:"FUELUSED"`
+}
+
+// TripWatch numbers are parsed as float32. Round them back to the precision used for engine
+// hours and fuel so that e.g. 1234.3 isn't stored as 1234.300048828125.
+func usageValue(i IntString) float64 {
+	return math.Round(float64(i)*100) / 100
+}
+
+func (v VMRVessel) hasUsage() bool {
+	return !v.StartHoursPort.IsZero() || !v.EndHoursPort.IsZero() ||
+		!v.StartHoursStbd.IsZero() || !v.EndHoursStbd.IsZero() ||
+		!v.StartHours3.IsZero() || !v.EndHours3.IsZero() || !v.FuelUsed.IsZero()
+}
+
+// Record the activation's engine hours and fuel, then bring the duty's DUTYVESSELS row up to
+// date with the totals for all of its jobs.
+func syncVesselUse(ctx context.Context, db dbExecutor, data *linkActivationDB, dutyID int) error {
+	vessel := data.Job.VMRVessel
+	if !vesselUseTableReady || data.ID == 0 || vessel.ID == 0 || dutyID == 0 || !vessel.hasUsage() {
+		return nil
+	}
+	if err := upsertRow(ctx, db, vesselUseTableName, vesselUse{
+		TripWatchID:    data.ID,
+		DutyLogID:      dutyID,
+		VesselID:       vessel.ID,
+		StartHoursPort: usageValue(vessel.StartHoursPort),
+		EndHoursPort:   usageValue(vessel.EndHoursPort),
+		StartHoursStbd: usageValue(vessel.StartHoursStbd),
+		EndHoursStbd:   usageValue(vessel.EndHoursStbd),
+		StartHours3:    usageValue(vessel.StartHours3),
+		EndHours3:      usageValue(vessel.EndHours3),
+		FuelUsed:       usageValue(vessel.FuelUsed),
+	}, true); err != nil {
+		return errors.Wrapf(err, "sync vessel use for activation %d", data.ID)
+	}
+
+	totals, err := getDutyVesselTotals(ctx, db, dutyID, vessel.ID)
+	if err != nil {
+		return errors.Wrapf(err, "sync vessel use")
+	}
+	totals.VesselName = string(vessel.Name)
+	if err := upsertRow(ctx, db, "DUTYVESSELS", totals, false); err != nil {
+		return errors.Wrapf(err, "sync vessel use for duty %d vessel %d", dutyID, vessel.ID)
+	}
+	return nil
+}
+
+// Sum the usage of a vessel across every synced job in a duty. Engine hours are rolled forward
+// from the earliest start to the latest end.
+func getDutyVesselTotals(ctx context.Context, db dbExecutor, dutyID, vesselID int) (dutyVessel, error) {
+	stmt := "SELECT MIN(NULLIF(STARTHOURSPORT,0)),MAX(ENDHOURSPORT)," +
+		"MIN(NULLIF(STARTHOURSSTAR,0)),MAX(ENDHOURSSTAR)," +
+		"MIN(NULLIF(STARTHOURS3,0)),MAX(ENDHOURS3),SUM(FUELUSED)" +
+		" FROM " + vesselUseTableName + " WHERE DUTYSEQUENCE=? AND DUTYVESSELNO=?"
+	totals := dutyVessel{DutyLogID: dutyID, VesselID: vesselID}
+	if rows, err := db.QueryContext(ctx, stmt, dutyID, vesselID); err != nil {
+		return dutyVessel{}, errors.Wrapf(dbError{
+			error:     err,
+			name:      vesselUseTableName,
+			statement: stmt,
+		}, "duty vessel totals for duty %d vessel %d", dutyID, vesselID)
+	} else {
+		defer rows.Close()
+		var vals [7]sql.NullFloat64
+		if !rows.Next() {
+			return totals, nil
+		} else if err := rows.Scan(&vals[0], &vals[1], &vals[2], &vals[3],
+			&vals[4], &vals[5], &vals[6]); err != nil {
+			return dutyVessel{}, errors.Wrapf(dbError{
+				error:     err,
+				name:      vesselUseTableName,
+				statement: stmt,
+			}, "duty vessel totals reading row")
+		}
+		totals.StartHoursPort = vals[0].Float64
+		totals.EndHoursPort = vals[1].Float64
+		totals.StartHoursStbd = vals[2].Float64
+		totals.EndHoursStbd = vals[3].Float64
+		totals.FuelUsed = vals[6].Float64
+	}
+	return totals, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVesselUsageParsing(t *testing.T) {
+	activation := linkActivationDB{}
+	err := json.Unmarshal([]byte(`{"id":1,
+		"activationsrvenginehours1start":"1234.3","activationsrvenginehours1end":"1236.1",
+		"activationsrvenginehours2start":"1200.3","activationsrvenginehours2end":"1202.1",
+		"activationsrvenginehours3start":"10","activationsrvenginehours3end":null,
+		"activationsfuelused":"85.5"}`), &activation)
+	assert.Nil(t, err)
+	vessel := activation.Job.VMRVessel
+	assert.True(t, vessel.hasUsage())
+	assert.Equal(t, 1234.3, usageValue(vessel.StartHoursPort))
+	assert.Equal(t, 1202.1, usageValue(vessel.EndHoursStbd))
+	assert.Equal(t, 10.0, usageValue(vessel.StartHours3))
+	assert.Equal(t, 0.0, usageValue(vessel.EndHours3))
+	assert.Equal(t, 85.5, usageValue(vessel.FuelUsed))
+
+	assert.False(t, VMRVessel{ID: 1, Name: "MR1"}.hasUsage())
+	assert.True(t, VMRVessel{FuelUsed: 20}.hasUsage())
+}
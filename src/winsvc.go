@@ -68,6 +68,10 @@ func (s *winsvc) Execute(args []string, r <-chan svc.ChangeRequest, changes chan
 		elog.Error(1, fmt.Sprintf("VMRSync failed to open config: %v", err))
 		return
 	}
+	if err := startStatusServer(); err != nil {
+		elog.Error(1, fmt.Sprintf("VMRSync failed to start status server: %v", err))
+		return
+	}
 	fasttick := time.Tick(tripwatchPollFrequency)
 	slowtick := time.Tick(4 * tripwatchPollFrequency)
 	tick := fasttick
@@ -85,6 +89,7 @@ loop:
 				} else {
 					defer closefunc()
 					s.db = db
+					serviceStatus.connected(db)
 				}
 			}
 			if errlist := run(s.db); len(errlist) > 0 {